@@ -0,0 +1,208 @@
+package graphsplit
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/xerrors"
+)
+
+// supported archive formats of restore, and of chunk but for zip
+const (
+	ArchiveTar     = "tar"
+	ArchiveTarZstd = "tar.zst"
+	ArchiveZip     = "zip"
+)
+
+// fixed modification time of archive entries, so that restoring the same
+// CAR files always gives byte-identical archives. zip can not go before 1980.
+var archiveModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// archiveWriter writes the entries of a dataset tree into an archive
+type archiveWriter interface {
+	WriteDir(p string) error
+	WriteSymlink(p, target string) error
+	WriteFile(p string, size int64, r io.Reader) error
+	Close() error
+}
+
+// RestoreArchive streams the files under carPath, with split files merged
+// back, into an archive of format written to w. Nothing is staged on disk,
+// and the entries are written in lexical order of their paths. If patterns
+// are given, only the files selected by them are written, as in RestorePaths.
+// The CAR files are opened as the files in them are reached, and each is
+// closed once the next one is needed.
+func RestoreArchive(ctx context.Context, carPath string, w io.Writer, format string, patterns []string) error {
+	pf, err := newPathFilter(patterns)
+	if err != nil {
+		return err
+	}
+	aw, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+	tree, err := loadDatasetTree(ctx, carPath, pf)
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+	return writeArchive(ctx, tree, aw)
+}
+
+// writeArchive writes the entries of tree to aw in lexical order of their
+// paths, keeping one CAR file open at a time, as chunk lays the files out in
+// the same order
+func writeArchive(ctx context.Context, tree *datasetTree, aw archiveWriter) error {
+	tree.cars.maxOpen = 1
+	for _, p := range tree.Paths() {
+		e := tree.entries[p]
+		var err error
+		switch {
+		case e.IsDir:
+			err = aw.WriteDir(p)
+		case e.Symlink != "":
+			err = aw.WriteSymlink(p, e.Symlink)
+		default:
+			r := tree.Open(ctx, e)
+			err = aw.WriteFile(p, e.Size, r)
+			r.Close()
+		}
+		if err != nil {
+			return xerrors.Errorf("write %s to archive: %w", p, err)
+		}
+	}
+	return aw.Close()
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case ArchiveTar:
+		return &tarArchive{tw: tar.NewWriter(w)}, nil
+	case ArchiveTarZstd:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchive{tw: tar.NewWriter(zw), zw: zw}, nil
+	case ArchiveZip:
+		return &zipArchive{zw: zip.NewWriter(w)}, nil
+	default:
+		return nil, xerrors.Errorf("unsupported archive format: %s", format)
+	}
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	// zstd compressor under the tar writer, if any
+	zw *zstd.Encoder
+}
+
+func (a *tarArchive) WriteDir(p string) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     p + "/",
+		Mode:     0755,
+		ModTime:  archiveModTime,
+		Format:   tar.FormatPAX,
+	})
+}
+
+func (a *tarArchive) WriteSymlink(p, target string) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     p,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  archiveModTime,
+		Format:   tar.FormatPAX,
+	})
+}
+
+func (a *tarArchive) WriteFile(p string, size int64, r io.Reader) error {
+	if err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     p,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  archiveModTime,
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		return err
+	}
+	n, err := io.Copy(a.tw, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return xerrors.Errorf("expect %d bytes, got %d", size, n)
+	}
+	return nil
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.zw != nil {
+		return a.zw.Close()
+	}
+	return nil
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) WriteDir(p string) error {
+	fh := &zip.FileHeader{
+		Name:     p + "/",
+		Modified: archiveModTime,
+	}
+	fh.SetMode(os.ModeDir | 0755)
+	_, err := a.zw.CreateHeader(fh)
+	return err
+}
+
+func (a *zipArchive) WriteSymlink(p, target string) error {
+	fh := &zip.FileHeader{
+		Name:     p,
+		Modified: archiveModTime,
+	}
+	fh.SetMode(os.ModeSymlink | 0777)
+	w, err := a.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, target)
+	return err
+}
+
+func (a *zipArchive) WriteFile(p string, size int64, r io.Reader) error {
+	fh := &zip.FileHeader{
+		Name:     p,
+		Method:   zip.Deflate,
+		Modified: archiveModTime,
+	}
+	fh.SetMode(0644)
+	w, err := a.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return xerrors.Errorf("expect %d bytes, got %d", size, n)
+	}
+	return nil
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
@@ -0,0 +1,78 @@
+package graphsplit
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRestoreArchive(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_restore_archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a/one.txt":   strings.Repeat("1", 600),
+		"b/big.bin":   strings.Repeat("0123456789", 250),
+		"c/three.txt": strings.Repeat("3", 600),
+	}
+	_, carDir := chunkTestFiles(t, dir, files, 1000)
+
+	ctx := context.Background()
+	pf, err := newPathFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := loadDatasetTree(ctx, carDir, pf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	var buf bytes.Buffer
+	aw, err := newArchiveWriter(&buf, ArchiveTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeArchive(ctx, tree, aw); err != nil {
+		t.Fatal(err)
+	}
+	// every CAR file is opened once, and closed before the next
+	if n := len(tree.cars.files); tree.cars.opened != n || len(tree.cars.open) > 1 {
+		t.Fatalf("expect %d CAR files opened once each and one left open, opened %d with %d open", n, tree.cars.opened, len(tree.cars.open))
+	}
+
+	tr := tar.NewReader(&buf)
+	got := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(data)
+	}
+	if len(got) != len(files) {
+		t.Fatalf("expect %d files in the archive, got %d", len(files), len(got))
+	}
+	for p, content := range files {
+		if got[p] != content {
+			t.Fatalf("content of %s does not match", p)
+		}
+	}
+}
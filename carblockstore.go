@@ -0,0 +1,146 @@
+package graphsplit
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+	"golang.org/x/xerrors"
+)
+
+// carBlockstore reads the blocks of a CARv1 file. The file is
+// walked once to build an offset table of its blocks, which are read from
+// the file when asked for, so memory use does not grow with the block data.
+type carBlockstore struct {
+	f      *os.File
+	roots  []cid.Cid
+	blocks map[string]blockOffset
+}
+
+// blockOffset is where the data of a block is in the CAR file
+type blockOffset struct {
+	offset int64
+	size   int
+}
+
+func openCarBlockstore(carPath string) (*carBlockstore, error) {
+	f, err := os.Open(carPath)
+	if err != nil {
+		return nil, err
+	}
+	bs := &carBlockstore{f: f, blocks: make(map[string]blockOffset)}
+	if err := bs.buildOffsets(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return bs, nil
+}
+
+// buildOffsets walks the sections of the CAR file, stopping at the end or at
+// the zero padding of a piece file
+func (bs *carBlockstore) buildOffsets() error {
+	h, err := car.ReadHeader(bufio.NewReader(io.NewSectionReader(bs.f, 0, 1<<62)))
+	if err != nil {
+		return err
+	}
+	if h.Version != 1 {
+		return xerrors.Errorf("unsupported car version %d", h.Version)
+	}
+	bs.roots = h.Roots
+
+	cr := &countingReader{r: bufio.NewReader(io.NewSectionReader(bs.f, 0, 1<<62))}
+	for sections := 0; ; sections++ {
+		l, err := binary.ReadUvarint(cr)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if l == 0 {
+			return nil
+		}
+		if l > uint64(util.MaxAllowedSectionSize) {
+			return xerrors.Errorf("section at %d is bigger than %d", cr.off, util.MaxAllowedSectionSize)
+		}
+		// the first section is the header
+		if sections == 0 {
+			if err := cr.Discard(int(l)); err != nil {
+				return err
+			}
+			continue
+		}
+		n, c, err := cid.CidFromReader(cr)
+		if err != nil {
+			return xerrors.Errorf("read cid at %d: %w", cr.off, err)
+		}
+		if uint64(n) > l {
+			return xerrors.Errorf("cid %s is longer than its section", c)
+		}
+		size := int(l) - n
+		bs.blocks[string(c.Hash())] = blockOffset{offset: cr.off, size: size}
+		if err := cr.Discard(size); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return xerrors.Errorf("block %s: %w", c, err)
+		}
+	}
+}
+
+func (bs *carBlockstore) Close() error {
+	return bs.f.Close()
+}
+
+func (bs *carBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	bo, ok := bs.blocks[string(c.Hash())]
+	if !ok {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	data := make([]byte, bo.size)
+	if _, err := bs.f.ReadAt(data, bo.offset); err != nil {
+		return nil, err
+	}
+	// check the data, as LoadCar did when the blocks were kept in memory
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !sum.Equals(c) {
+		return nil, xerrors.Errorf("block %s does not match its data", c)
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+// countingReader keeps the offset of what has been read
+type countingReader struct {
+	r   *bufio.Reader
+	off int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.off += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.off++
+	}
+	return b, err
+}
+
+func (cr *countingReader) Discard(n int) error {
+	m, err := cr.r.Discard(n)
+	cr.off += int64(m)
+	return err
+}
@@ -0,0 +1,121 @@
+package graphsplit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+)
+
+// writeTestCar writes a CARv1 file of roots holding blks in order, and
+// returns its bytes
+func writeTestCar(t *testing.T, carPath string, roots []cid.Cid, blks ...blocks.Block) []byte {
+	var buf bytes.Buffer
+	if err := car.WriteHeader(&car.CarHeader{Roots: roots, Version: 1}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, blk := range blks {
+		if err := util.LdWrite(&buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(carPath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCarBlockstore(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_car_blockstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var nodes []blocks.Block
+	for i := 0; i < 5; i++ {
+		nodes = append(nodes, merkledag.NewRawNode([]byte(fmt.Sprintf("block %d %s", i, strings.Repeat("x", i*100)))))
+	}
+	carPath := filepath.Join(dir, "test.car")
+	data := writeTestCar(t, carPath, []cid.Cid{nodes[0].Cid()}, nodes...)
+
+	ctx := context.Background()
+	open := func(data []byte) (*carBlockstore, error) {
+		if err := ioutil.WriteFile(carPath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return openCarBlockstore(carPath)
+	}
+
+	// every block is found at its offset
+	bs, err := open(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs.roots) != 1 || !bs.roots[0].Equals(nodes[0].Cid()) || len(bs.blocks) != len(nodes) {
+		t.Fatalf("expect 1 root and %d blocks, got %v and %d", len(nodes), bs.roots, len(bs.blocks))
+	}
+	for _, nd := range nodes {
+		bo := bs.blocks[string(nd.Cid().Hash())]
+		if !bytes.Equal(data[bo.offset:bo.offset+int64(bo.size)], nd.RawData()) {
+			t.Fatalf("block %s is not at offset %d", nd.Cid(), bo.offset)
+		}
+		blk, err := bs.Get(ctx, nd.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(blk.RawData(), nd.RawData()) {
+			t.Fatalf("block %s read differently", nd.Cid())
+		}
+	}
+	if _, err := bs.Get(ctx, merkledag.NewRawNode([]byte("missing")).Cid()); !ipld.IsNotFound(err) {
+		t.Fatalf("expect a missing block not to be found, got %v", err)
+	}
+	bs.Close()
+
+	// the zero padding of a piece file ends the blocks
+	bs, err = open(append(append([]byte{}, data...), make([]byte, 4096)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs.blocks) != len(nodes) {
+		t.Fatalf("expect %d blocks before the padding, got %d", len(nodes), len(bs.blocks))
+	}
+	bs.Close()
+
+	// a block not matching its cid fails when it is read
+	last := nodes[len(nodes)-1]
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	bs, err = open(corrupted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.Get(ctx, last.Cid()); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("expect the corrupted block to fail, got %v", err)
+	}
+	if _, err := bs.Get(ctx, nodes[0].Cid()); err != nil {
+		t.Fatalf("expect the other blocks to be read, got %v", err)
+	}
+	bs.Close()
+
+	// a CAR file cut short in a block fails to open
+	if _, err := open(data[:len(data)-10]); err == nil || !strings.Contains(err.Error(), "unexpected EOF") {
+		t.Fatalf("expect a truncated CAR file to fail, got %v", err)
+	}
+	// a CARv2 is not read as a CARv1
+	if _, err := open([]byte("\x11\xa2eroots\xf6gversion\x02")); err == nil {
+		t.Fatal("expect a CARv2 header to fail")
+	}
+}
@@ -0,0 +1,120 @@
+package graphsplit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"golang.org/x/xerrors"
+)
+
+// carPayloadReader reads a CARv1 up to its end, stopping at the zero padding
+// that chunk --add-padding appends to turn the CAR file into a piece. A
+// section of length zero is not valid CAR, so it marks the padding.
+type carPayloadReader struct {
+	br *bufio.Reader
+	// bytes left of the current section, including its length prefix
+	left int64
+	done bool
+}
+
+func newCarPayloadReader(r io.Reader) *carPayloadReader {
+	return &carPayloadReader{br: bufio.NewReader(r)}
+}
+
+func (r *carPayloadReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	if r.left == 0 {
+		head, err := r.br.Peek(binary.MaxVarintLen64)
+		if len(head) == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		l, n := binary.Uvarint(head)
+		if n <= 0 {
+			return 0, xerrors.New("bad section length")
+		}
+		if l == 0 {
+			r.done = true
+			return 0, io.EOF
+		}
+		r.left = int64(n) + int64(l)
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.br.Read(p)
+	r.left -= int64(n)
+	if err == io.EOF && r.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// checkPadding makes sure that whatever follows the CAR payload is zeros,
+// and returns the number of padding bytes
+func (r *carPayloadReader) checkPadding() (int64, error) {
+	if !r.done {
+		return 0, nil
+	}
+	var n int64
+	buf := make([]byte, 32<<10)
+	for {
+		m, err := r.br.Read(buf)
+		for _, b := range buf[:m] {
+			if b != 0 {
+				return n, xerrors.Errorf("non-zero byte in padding at %d", n)
+			}
+			n++
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// readCarHeader reads the header of the CAR file at path. It is how CAR files
+// are told apart from other files, whatever their names.
+func readCarHeader(path string) (*car.CarHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h, err := car.ReadHeader(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	if h.Version != 1 {
+		return nil, xerrors.Errorf("unsupported car version %d", h.Version)
+	}
+	return h, nil
+}
+
+// isCarFile reports whether the file at path starts with a CARv1 header
+func isCarFile(path string) bool {
+	_, err := readCarHeader(path)
+	return err == nil
+}
+
+// carRoot returns the only root of the CAR file at path
+func carRoot(path string) (cid.Cid, error) {
+	h, err := readCarHeader(path)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if len(h.Roots) != 1 {
+		return cid.Undef, xerrors.Errorf("expect one root, got %d", len(h.Roots))
+	}
+	return h.Roots[0], nil
+}
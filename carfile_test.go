@@ -0,0 +1,43 @@
+package graphsplit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCarPayloadReader(t *testing.T) {
+	payload := []byte("\x03abc\x02de")
+	padded := append(append([]byte{}, payload...), make([]byte, 1000)...)
+
+	pr := newCarPayloadReader(bytes.NewReader(padded))
+	got, err := ioutil.ReadAll(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("Unexpected payload: %q", got)
+	}
+	n, err := pr.checkPadding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Fatalf("Unexpected padding size: %d", n)
+	}
+
+	padded[len(padded)-1] = 1
+	pr = newCarPayloadReader(bytes.NewReader(padded))
+	if _, err := ioutil.ReadAll(pr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.checkPadding(); err == nil {
+		t.Fatal("expect error of non-zero padding")
+	}
+
+	// a section cut short is an error rather than the end
+	pr = newCarPayloadReader(bytes.NewReader(payload[:6]))
+	if _, err := ioutil.ReadAll(pr); err == nil {
+		t.Fatal("expect error of truncated section")
+	}
+}
@@ -0,0 +1,251 @@
+package graphsplit
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"golang.org/x/xerrors"
+)
+
+// most CAR files a carSet keeps open, each holds a file and the offset table
+// of its blocks
+var maxOpenCars = 8
+
+// carSet is the CAR files of a dataset, opened as their blocks are asked for
+// rather than all up front. At most maxOpen of them are kept open, the one
+// used least recently is closed first once it is not in use.
+type carSet struct {
+	files   []string
+	roots   [][]cid.Cid
+	maxOpen int
+
+	lock sync.Mutex
+	open map[int]*openCar
+	// open CAR files, the one used most recently at the front
+	lru *list.List
+	// number of times a CAR file was opened
+	opened int
+	// the CAR file of every block seen, if blocks are indexed, see carOf
+	blocks  map[string]int
+	indexed []bool
+}
+
+type openCar struct {
+	car   int
+	cd    *carDAG
+	err   error
+	ready chan struct{}
+	refs  int
+	elem  *list.Element
+}
+
+// newCarSet reads the headers of carFiles, none of them is kept open
+func newCarSet(carFiles []string) (*carSet, error) {
+	s := &carSet{
+		files:   carFiles,
+		roots:   make([][]cid.Cid, len(carFiles)),
+		maxOpen: maxOpenCars,
+		open:    make(map[int]*openCar),
+		lru:     list.New(),
+	}
+	for i, carFile := range carFiles {
+		h, err := readCarHeader(carFile)
+		if err != nil {
+			return nil, xerrors.Errorf("open %s: %w", carFile, err)
+		}
+		s.roots[i] = h.Roots
+	}
+	return s, nil
+}
+
+// acquire opens the i-th CAR file, or takes the one open, and keeps it open
+// until release is called
+func (s *carSet) acquire(ctx context.Context, i int) (*carDAG, func(), error) {
+	s.lock.Lock()
+	oc, ok := s.open[i]
+	if ok {
+		oc.refs++
+		s.lru.MoveToFront(oc.elem)
+		s.lock.Unlock()
+		<-oc.ready
+	} else {
+		oc = &openCar{car: i, ready: make(chan struct{}), refs: 1}
+		oc.elem = s.lru.PushFront(oc)
+		s.open[i] = oc
+		s.opened++
+		s.lock.Unlock()
+
+		cd, err := openCarDAG(ctx, s.files[i])
+		s.lock.Lock()
+		oc.cd, oc.err = cd, err
+		if oc.err == nil && s.blocks != nil {
+			for h := range oc.cd.bs.blocks {
+				s.blocks[h] = i
+			}
+			s.indexed[i] = true
+		}
+		close(oc.ready)
+		s.lock.Unlock()
+	}
+	if oc.err != nil {
+		s.release(oc)
+		return nil, nil, xerrors.Errorf("open %s: %w", s.files[i], oc.err)
+	}
+	return oc.cd, func() { s.release(oc) }, nil
+}
+
+func (s *carSet) release(oc *openCar) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	oc.refs--
+	if oc.err != nil && oc.refs == 0 && s.open[oc.car] == oc {
+		// opened again when asked for next
+		delete(s.open, oc.car)
+		s.lru.Remove(oc.elem)
+	}
+	for e := s.lru.Back(); e != nil && len(s.open) > s.maxOpen; {
+		prev := e.Prev()
+		if old := e.Value.(*openCar); old.refs == 0 {
+			old.cd.Close()
+			delete(s.open, old.car)
+			s.lru.Remove(e)
+		}
+		e = prev
+	}
+}
+
+// getBlock reads the block c from the i-th CAR file
+func (s *carSet) getBlock(ctx context.Context, i int, c cid.Cid) (blocks.Block, error) {
+	cd, release, err := s.acquire(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return cd.bs.Get(ctx, c)
+}
+
+// indexBlocks has the CAR file of every block recorded as the CAR files are
+// opened, starting with their roots and the ones open, so that carOf can find
+// blocks
+func (s *carSet) indexBlocks() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.blocks = make(map[string]int)
+	s.indexed = make([]bool, len(s.files))
+	for i, roots := range s.roots {
+		for _, root := range roots {
+			s.blocks[string(root.Hash())] = i
+		}
+	}
+	for i, oc := range s.open {
+		if oc.cd == nil {
+			continue
+		}
+		for h := range oc.cd.bs.blocks {
+			s.blocks[h] = i
+		}
+		s.indexed[i] = true
+	}
+}
+
+// learn records that c is in the i-th CAR file
+func (s *carSet) learn(c cid.Cid, i int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.blocks[string(c.Hash())] = i
+}
+
+// carOf finds the CAR file holding c. A block not recorded yet is looked for
+// in the CAR files not indexed yet, each is read once. A CAR file that fails
+// to open is left out.
+func (s *carSet) carOf(ctx context.Context, c cid.Cid) (int, error) {
+	lookup := func() (int, bool) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		car, ok := s.blocks[string(c.Hash())]
+		return car, ok
+	}
+	for i := range s.files {
+		if car, ok := lookup(); ok {
+			return car, nil
+		}
+		s.lock.Lock()
+		indexed := s.indexed[i]
+		s.lock.Unlock()
+		if indexed {
+			continue
+		}
+		_, release, err := s.acquire(ctx, i)
+		if err != nil {
+			log.Warn(err)
+			s.lock.Lock()
+			s.indexed[i] = true
+			s.lock.Unlock()
+			continue
+		}
+		release()
+	}
+	if car, ok := lookup(); ok {
+		return car, nil
+	}
+	return 0, ipld.ErrNotFound{Cid: c}
+}
+
+// dag is the DAG service over the blocks of the i-th CAR file
+func (s *carSet) dag(i int) ipld.DAGService {
+	return &carSetDAG{set: s, car: i}
+}
+
+func (s *carSet) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, oc := range s.open {
+		if oc.cd != nil {
+			oc.cd.Close()
+		}
+		delete(s.open, i)
+	}
+	s.lru.Init()
+	return nil
+}
+
+// carSetDAG is a read-only DAG service over a CAR file of a carSet, which is
+// opened when a node is asked for
+type carSetDAG struct {
+	set *carSet
+	car int
+}
+
+var _ ipld.DAGService = (*carSetDAG)(nil)
+
+func (d *carSetDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	blk, err := d.set.getBlock(ctx, d.car, c)
+	if err != nil {
+		return nil, err
+	}
+	return ipld.Decode(blk)
+}
+
+func (d *carSetDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	return getManyLazily(ctx, d.Get, cids)
+}
+
+func (d *carSetDAG) Add(context.Context, ipld.Node) error {
+	return xerrors.New("CAR file is read-only")
+}
+
+func (d *carSetDAG) AddMany(context.Context, []ipld.Node) error {
+	return xerrors.New("CAR file is read-only")
+}
+
+func (d *carSetDAG) Remove(context.Context, cid.Cid) error {
+	return xerrors.New("CAR file is read-only")
+}
+
+func (d *carSetDAG) RemoveMany(context.Context, []cid.Cid) error {
+	return xerrors.New("CAR file is read-only")
+}
@@ -0,0 +1,406 @@
+package graphsplit
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+	"golang.org/x/xerrors"
+)
+
+// room kept in every CAR file for its header
+const carHeaderReserve = 128
+
+// splitSlice is a CAR file of CarSplit holding whole sub-DAGs
+type splitSlice struct {
+	trees []cid.Cid
+	size  int64
+}
+
+// splitTop is the CAR file of CarSplit rooted at a root of the input CAR
+// file, holding the blocks above the sub-DAGs stored elsewhere
+type splitTop struct {
+	root    cid.Cid
+	partial *cid.Set
+	size    int64
+	// whole sub-DAGs stored with it
+	trees []cid.Cid
+}
+
+type carSplitter struct {
+	bs        *carBlockstore
+	sliceSize int64
+	// size of the sub-DAG under every block, counting shared blocks once per
+	// link, so it is never less than what the sub-DAG takes in a CAR file
+	sizes   map[cid.Cid]int64
+	missing int
+	slices  []*splitSlice
+	cur     *splitSlice
+	tops    []*splitTop
+}
+
+// CarSplit partitions the DAG of the CAR file at carPath into CAR files of
+// at most sliceSize bytes in carDir, named after graphName as Chunk does,
+// and hands every one to cb for the manifest, commP and padding.
+//
+// Sub-DAGs are kept whole in one CAR file where they fit. A CAR file with a
+// single sub-DAG is rooted at it; several are linked from a UnixFS directory
+// named by their cids. A DAG too big for one CAR file is cut below its root:
+// the blocks above the sub-DAGs stored elsewhere go in a last CAR file rooted
+// at the root of the DAG. That CAR file is not self-contained, its DAG links
+// to the roots of the other CAR files and is only complete together with
+// them. CarSplit fails before writing anything if those blocks, or a single
+// block, do not fit in a CAR file of sliceSize.
+func CarSplit(ctx context.Context, carPath string, sliceSize int64, carDir, graphName string, cb GraphBuildCallback) error {
+	if sliceSize <= carHeaderReserve {
+		return xerrors.Errorf("slice size %d is too small", sliceSize)
+	}
+	bs, err := openCarBlockstore(carPath)
+	if err != nil {
+		return err
+	}
+	defer bs.Close()
+	if len(bs.roots) == 0 {
+		return xerrors.Errorf("%s has no root", carPath)
+	}
+
+	s := &carSplitter{
+		bs:        bs,
+		sliceSize: sliceSize,
+		sizes:     make(map[cid.Cid]int64),
+		cur:       &splitSlice{},
+	}
+	for _, root := range bs.roots {
+		if _, err := s.dagSize(ctx, root); err != nil {
+			return err
+		}
+		top := &splitTop{root: root, partial: cid.NewSet()}
+		if err := s.pack(ctx, root, top); err != nil {
+			return err
+		}
+		if top.partial.Len() > 0 {
+			s.tops = append(s.tops, top)
+		}
+	}
+	if s.missing > 0 {
+		log.Warnf("%d blocks linked in %s are not in it, the CAR files will miss them too", s.missing, carPath)
+	}
+	// the sub-DAGs left go with the top if they are under its root
+	if len(bs.roots) == 1 && len(s.tops) == 1 && s.tops[0].size+s.cur.size <= sliceSize-carHeaderReserve {
+		s.tops[0].trees = s.cur.trees
+		s.tops[0].size += s.cur.size
+	} else {
+		s.closeCur()
+	}
+
+	for _, top := range s.tops {
+		if top.size > sliceSize-carHeaderReserve {
+			return xerrors.Errorf("the blocks of %s above its sub-DAGs take %d bytes, more than a CAR file of %d bytes holds, split it with a bigger slice size", top.root, top.size, sliceSize)
+		}
+	}
+
+	total := len(s.slices) + len(s.tops)
+	for i, sl := range s.slices {
+		if err := s.writeSlice(ctx, sl, carDir, GenGraphName(graphName, i, total), cb); err != nil {
+			return err
+		}
+	}
+	for i, top := range s.tops {
+		if err := s.writeTop(ctx, top, carDir, GenGraphName(graphName, len(s.slices)+i, total), cb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sectionSize is the size of the section of a block in a CAR file
+func sectionSize(c cid.Cid, size int) int64 {
+	l := uint64(len(c.Bytes()) + size)
+	var buf [binary.MaxVarintLen64]byte
+	return int64(binary.PutUvarint(buf[:], l)) + int64(l)
+}
+
+// links returns the cids linked from the block c, none if it is not in the
+// CAR file
+func (s *carSplitter) links(ctx context.Context, c cid.Cid) ([]cid.Cid, error) {
+	blk, err := s.bs.Get(ctx, c)
+	if ipld.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return blockLinks(blk), nil
+}
+
+// blockLinks returns the cids linked from blk, none if its codec is not known
+func blockLinks(blk blocks.Block) []cid.Cid {
+	nd, err := ipld.Decode(blk)
+	if err != nil {
+		log.Warnf("decode %s, keep it as a leaf: %s", blk.Cid(), err)
+		return nil
+	}
+	cids := make([]cid.Cid, 0, len(nd.Links()))
+	for _, lk := range nd.Links() {
+		cids = append(cids, lk.Cid)
+	}
+	return cids
+}
+
+func (s *carSplitter) dagSize(ctx context.Context, c cid.Cid) (int64, error) {
+	if n, ok := s.sizes[c]; ok {
+		return n, nil
+	}
+	bo, ok := s.bs.blocks[string(c.Hash())]
+	if !ok {
+		s.missing++
+		s.sizes[c] = 0
+		return 0, nil
+	}
+	n := sectionSize(c, bo.size)
+	links, err := s.links(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	for _, lc := range links {
+		ln, err := s.dagSize(ctx, lc)
+		if err != nil {
+			return 0, err
+		}
+		n += ln
+	}
+	s.sizes[c] = n
+	return n, nil
+}
+
+// treeCost is what the sub-DAG at c takes in a CAR file, with its link from
+// a wrapping directory
+func (s *carSplitter) treeCost(c cid.Cid) int64 {
+	return s.sizes[c] + 2*int64(len(c.Bytes())) + int64(len(c.String())) + 16
+}
+
+func (s *carSplitter) closeCur() {
+	if len(s.cur.trees) > 0 {
+		s.slices = append(s.slices, s.cur)
+	}
+	s.cur = &splitSlice{}
+}
+
+// pack puts the sub-DAG at c in the slice being filled, in a new one if it
+// does not fit, or cuts it below c when it is too big for any
+func (s *carSplitter) pack(ctx context.Context, c cid.Cid, top *splitTop) error {
+	if s.sizes[c] == 0 {
+		return nil
+	}
+	budget := s.sliceSize - carHeaderReserve
+	cost := s.treeCost(c)
+	if s.cur.size+cost <= budget {
+		s.cur.trees = append(s.cur.trees, c)
+		s.cur.size += cost
+		return nil
+	}
+	if cost <= budget {
+		s.closeCur()
+		s.cur.trees = append(s.cur.trees, c)
+		s.cur.size += cost
+		return nil
+	}
+	if top.partial.Has(c) {
+		return nil
+	}
+	links, err := s.links(ctx, c)
+	if err != nil {
+		return err
+	}
+	if len(links) == 0 && s.sizes[c] > budget {
+		return xerrors.Errorf("block %s takes %d bytes, more than a CAR file of %d bytes holds", c, s.sizes[c], s.sliceSize)
+	}
+	for _, lc := range links {
+		if err := s.pack(ctx, lc, top); err != nil {
+			return err
+		}
+	}
+	top.partial.Add(c)
+	top.size += sectionSize(c, s.bs.blocks[string(c.Hash())].size)
+	return nil
+}
+
+// carWriter writes the blocks of a CAR file once each
+type carWriter struct {
+	bs      *carBlockstore
+	f       *os.File
+	written *cid.Set
+}
+
+func newCarWriter(bs *carBlockstore, carPath string, root cid.Cid) (*carWriter, error) {
+	f, err := os.Create(carPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &carWriter{bs: bs, f: f, written: cid.NewSet()}, nil
+}
+
+// write writes the block c once, and returns it, or nil if it is not in the
+// input CAR file
+func (cw *carWriter) write(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := cw.bs.Get(ctx, c)
+	if ipld.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cw.written.Add(c)
+	return blk, util.LdWrite(cw.f, c.Bytes(), blk.RawData())
+}
+
+// writeTree writes the whole sub-DAG at c
+func (cw *carWriter) writeTree(ctx context.Context, c cid.Cid) error {
+	stack := []cid.Cid{c}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if cw.written.Has(c) {
+			continue
+		}
+		blk, err := cw.write(ctx, c)
+		if err != nil {
+			return err
+		}
+		if blk == nil {
+			continue
+		}
+		links := blockLinks(blk)
+		for i := len(links) - 1; i >= 0; i-- {
+			stack = append(stack, links[i])
+		}
+	}
+	return nil
+}
+
+func (s *carSplitter) writeSlice(ctx context.Context, sl *splitSlice, carDir, graphName string, cb GraphBuildCallback) error {
+	var root ipld.Node
+	var wrapper *merkledag.ProtoNode
+	if len(sl.trees) == 1 {
+		blk, err := s.bs.Get(ctx, sl.trees[0])
+		if err != nil {
+			return err
+		}
+		// a root of an unknown codec is wrapped as well
+		root, _ = ipld.Decode(blk)
+	}
+	if root == nil {
+		cidBuilder, err := merkledag.PrefixForCidVersion(1)
+		if err != nil {
+			return err
+		}
+		wrapper = unixfs.EmptyDirNode()
+		wrapper.SetCidBuilder(cidBuilder)
+		for _, c := range sl.trees {
+			if err := wrapper.AddRawLink(c.String(), &ipld.Link{Size: uint64(s.sizes[c]), Cid: c}); err != nil {
+				return err
+			}
+		}
+		root = wrapper
+	}
+
+	log.Infof("write slice %s with root %s", graphName, root.Cid())
+	cw, err := newCarWriter(s.bs, filepath.Join(carDir, root.Cid().String()+".car"), root.Cid())
+	if err != nil {
+		return err
+	}
+	if wrapper != nil {
+		err = util.LdWrite(cw.f, wrapper.Cid().Bytes(), wrapper.RawData())
+	}
+	for _, c := range sl.trees {
+		if err != nil {
+			break
+		}
+		err = cw.writeTree(ctx, c)
+	}
+	if err != nil {
+		cw.f.Close()
+		return err
+	}
+	if err := cw.f.Close(); err != nil {
+		return err
+	}
+	return s.onSuccess(root, sl.trees, sl.size, graphName, cb)
+}
+
+// writeTop writes the blocks above the sub-DAGs stored elsewhere, and the
+// whole sub-DAGs stored with them
+func (s *carSplitter) writeTop(ctx context.Context, top *splitTop, carDir, graphName string, cb GraphBuildCallback) error {
+	blk, err := s.bs.Get(ctx, top.root)
+	if err != nil {
+		return err
+	}
+	root, err := ipld.Decode(blk)
+	if err != nil {
+		return err
+	}
+	whole := cid.NewSet()
+	for _, c := range top.trees {
+		whole.Add(c)
+	}
+
+	log.Infof("write slice %s with root %s", graphName, root.Cid())
+	cw, err := newCarWriter(s.bs, filepath.Join(carDir, root.Cid().String()+".car"), root.Cid())
+	if err != nil {
+		return err
+	}
+	stack := []cid.Cid{top.root}
+	for len(stack) > 0 && err == nil {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		switch {
+		case whole.Has(c):
+			err = cw.writeTree(ctx, c)
+		case top.partial.Has(c) && !cw.written.Has(c):
+			var blk blocks.Block
+			if blk, err = cw.write(ctx, c); err != nil || blk == nil {
+				break
+			}
+			links := blockLinks(blk)
+			for i := len(links) - 1; i >= 0; i-- {
+				stack = append(stack, links[i])
+			}
+		}
+	}
+	if err != nil {
+		cw.f.Close()
+		return err
+	}
+	if err := cw.f.Close(); err != nil {
+		return err
+	}
+	return s.onSuccess(root, top.trees, top.size, graphName, cb)
+}
+
+func (s *carSplitter) onSuccess(root ipld.Node, trees []cid.Cid, size int64, graphName string, cb GraphBuildCallback) error {
+	detail := fsNode{Hash: root.Cid().String(), Size: uint64(size)}
+	if len(trees) > 1 || len(trees) == 1 && !trees[0].Equals(root.Cid()) {
+		for _, c := range trees {
+			detail.Link = append(detail.Link, fsNode{Name: c.String(), Hash: c.String(), Size: uint64(s.sizes[c])})
+		}
+	}
+	detailBytes, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+	cb.OnSuccess(root, graphName, string(detailBytes))
+	return callbackErr(cb)
+}
@@ -0,0 +1,196 @@
+package graphsplit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipld/go-car"
+)
+
+// splitCallback records the roots of the CAR files written
+type splitCallback struct {
+	roots []cid.Cid
+}
+
+func (cb *splitCallback) OnSuccess(node ipld.Node, graphName, fsDetail string) {
+	cb.roots = append(cb.roots, node.Cid())
+}
+
+func (cb *splitCallback) OnError(err error) {}
+
+// readSplitCars reads the blocks of every CAR file in carDir, by root
+func readSplitCars(t *testing.T, carDir string) map[cid.Cid][]cid.Cid {
+	cars, err := filepath.Glob(filepath.Join(carDir, "*.car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[cid.Cid][]cid.Cid)
+	for _, p := range cars {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cr, err := car.NewCarReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cr.Header.Roots) != 1 {
+			t.Fatalf("expect one root in %s, got %v", p, cr.Header.Roots)
+		}
+		var cids []cid.Cid
+		for {
+			blk, err := cr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			cids = append(cids, blk.Cid())
+		}
+		got[cr.Header.Roots[0]] = cids
+	}
+	return got
+}
+
+func testDir(t *testing.T, children ...ipld.Node) *merkledag.ProtoNode {
+	dir := unixfs.EmptyDirNode()
+	for i, child := range children {
+		if err := dir.AddNodeLink(fmt.Sprintf("f%02d", i), child); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func sameCids(a, b []cid.Cid) bool {
+	keys := func(cids []cid.Cid) string {
+		s := make([]string, 0, len(cids))
+		for _, c := range cids {
+			s = append(s, c.String())
+		}
+		sort.Strings(s)
+		return strings.Join(s, ",")
+	}
+	return keys(a) == keys(b)
+}
+
+func TestCarSplit(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_car_split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	leaf := func(s string, n int) *merkledag.RawNode {
+		return merkledag.NewRawNode(bytes.Repeat([]byte(s), n))
+	}
+	f1, f2, f3 := leaf("1", 400), leaf("2", 400), leaf("3", 400)
+	tree := testDir(t, f1, f2, f3)
+	f4 := leaf("4", 100)
+	other := testDir(t, f4)
+	absent := leaf("5", 400)
+	broken := testDir(t, f1, absent)
+
+	ctx := context.Background()
+	split := func(name string, roots []cid.Cid, sliceSize int64, blks ...blocks.Block) (map[cid.Cid][]cid.Cid, error) {
+		t.Helper()
+		carDir := filepath.Join(dir, name)
+		if err := os.MkdirAll(carDir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		carPath := filepath.Join(dir, name+".car")
+		writeTestCar(t, carPath, roots, blks...)
+		cb := &splitCallback{}
+		if err := CarSplit(ctx, carPath, sliceSize, carDir, name, cb); err != nil {
+			return readSplitCars(t, carDir), err
+		}
+		got := readSplitCars(t, carDir)
+		if len(cb.roots) != len(got) {
+			t.Fatalf("%s: expect a callback for each of %d CAR files, got %d", name, len(got), len(cb.roots))
+		}
+		return got, nil
+	}
+
+	// a tree that fits is rooted at its own root
+	got, err := split("single", []cid.Cid{tree.Cid()}, 1<<20, tree, f1, f2, f3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !sameCids(got[tree.Cid()], []cid.Cid{tree.Cid(), f1.Cid(), f2.Cid(), f3.Cid()}) {
+		t.Fatalf("expect one CAR file of the tree, got %v", got)
+	}
+
+	// trees sharing a CAR file are linked from a directory named by their cids
+	got, err = split("wrapped", []cid.Cid{tree.Cid(), other.Cid()}, 1<<20, tree, f1, f2, f3, other, f4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expect one CAR file, got %v", got)
+	}
+	for root, cids := range got {
+		if root.Equals(tree.Cid()) || root.Equals(other.Cid()) || !cids[0].Equals(root) {
+			t.Fatalf("expect the CAR file rooted at a wrapping directory, got %s", root)
+		}
+		if !sameCids(cids[1:], []cid.Cid{tree.Cid(), f1.Cid(), f2.Cid(), f3.Cid(), other.Cid(), f4.Cid()}) {
+			t.Fatalf("expect both trees in the CAR file, got %v", cids)
+		}
+	}
+
+	// a leaf per CAR file, and the root above them in a CAR file of its own
+	got, err = split("cut", []cid.Cid{tree.Cid()}, 800, tree, f1, f2, f3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 || !sameCids(got[tree.Cid()], []cid.Cid{tree.Cid()}) {
+		t.Fatalf("expect the root cut from its leaves, got %v", got)
+	}
+	for _, f := range []ipld.Node{f1, f2, f3} {
+		if !sameCids(got[f.Cid()], []cid.Cid{f.Cid()}) {
+			t.Fatalf("expect %s in a CAR file of its own, got %v", f.Cid(), got)
+		}
+	}
+
+	// a block linked but not in the CAR file is left out
+	got, err = split("missing", []cid.Cid{broken.Cid()}, 1<<20, broken, f1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !sameCids(got[broken.Cid()], []cid.Cid{broken.Cid(), f1.Cid()}) {
+		t.Fatalf("expect the blocks that are there, got %v", got)
+	}
+
+	// the blocks above the cut do not fit, nothing is written
+	wide := make([]ipld.Node, 30)
+	wideBlocks := make([]blocks.Block, 0, len(wide)+1)
+	for i := range wide {
+		wide[i] = leaf(fmt.Sprint(i), 100)
+	}
+	wideDir := testDir(t, wide...)
+	wideBlocks = append(wideBlocks, wideDir)
+	for _, nd := range wide {
+		wideBlocks = append(wideBlocks, nd)
+	}
+	got, err = split("wide", []cid.Cid{wideDir.Cid()}, 600, wideBlocks...)
+	if err == nil || !strings.Contains(err.Error(), "above its sub-DAGs") || len(got) != 0 {
+		t.Fatalf("expect the oversize top to fail before writing, got %v and %d CAR files", err, len(got))
+	}
+	_, err = split("big", []cid.Cid{f1.Cid()}, 300, f1)
+	if err == nil || !strings.Contains(err.Error(), "more than a CAR file of 300 bytes holds") {
+		t.Fatalf("expect an oversize block to fail, got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package graphsplit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// carV2Pragma starts every CARv2 file: a CARv1 header of version 2
+var carV2Pragma = []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+const (
+	// size of the CARv2 header after the pragma: the characteristics, and
+	// the offset and size of the CARv1 data and the offset of the index
+	carV2HeaderSize = 40
+	// multicodec of the IndexSorted index of CARv2
+	carIndexSorted = 0x0400
+)
+
+// carIndexRecord is where the section of a block starts in the CARv1 data
+type carIndexRecord struct {
+	digest []byte
+	offset uint64
+}
+
+// writeCarV2 wraps the CARv1 file of size bytes read from r into a CARv2
+// file written to w, with an IndexSorted index of its blocks, as go-car/v2
+// builds them. The index is read through first, r is read again from the
+// start to copy the data.
+func writeCarV2(w io.Writer, r io.ReadSeeker, size int64) error {
+	records, err := indexCarV1(r)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	dataOffset := uint64(len(carV2Pragma) + carV2HeaderSize)
+	header := make([]byte, carV2HeaderSize)
+	// no characteristics are set, the index leaves out no block
+	binary.LittleEndian.PutUint64(header[16:], dataOffset)
+	binary.LittleEndian.PutUint64(header[24:], uint64(size))
+	binary.LittleEndian.PutUint64(header[32:], dataOffset+uint64(size))
+	if _, err := w.Write(carV2Pragma); err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if n, err := io.Copy(w, r); err != nil {
+		return err
+	} else if n != size {
+		return xerrors.Errorf("CARv1 data has %d bytes, expect %d", n, size)
+	}
+	_, err = w.Write(marshalIndexSorted(records))
+	return err
+}
+
+// indexCarV1 finds where the section of every block of a CARv1 starts
+func indexCarV1(r io.Reader) ([]carIndexRecord, error) {
+	br := bufio.NewReader(r)
+	var offset uint64
+	readSection := func() ([]byte, error) {
+		l, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, l)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, err
+		}
+		offset += uint64(uvarintSize(l)) + l
+		return data, nil
+	}
+	if _, err := readSection(); err != nil {
+		return nil, xerrors.Errorf("read CARv1 header: %w", err)
+	}
+	var records []carIndexRecord
+	for {
+		start := offset
+		data, err := readSection()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("read section at %d: %w", start, err)
+		}
+		_, c, err := cid.CidFromBytes(data)
+		if err != nil {
+			return nil, xerrors.Errorf("cid of section at %d: %w", start, err)
+		}
+		dmh, err := multihash.Decode(c.Hash())
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, carIndexRecord{digest: dmh.Digest, offset: start})
+	}
+}
+
+func uvarintSize(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+// marshalIndexSorted encodes the IndexSorted index of records: its
+// multicodec, then the records bucketed by the width of their digests, in
+// increasing order, each holding its records ordered by digest
+func marshalIndexSorted(records []carIndexRecord) []byte {
+	buckets := make(map[int][]carIndexRecord)
+	for _, r := range records {
+		buckets[len(r.digest)] = append(buckets[len(r.digest)], r)
+	}
+	widths := make([]int, 0, len(buckets))
+	for width := range buckets {
+		widths = append(widths, width)
+	}
+	sort.Ints(widths)
+
+	var buf bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], carIndexSorted)])
+	binary.Write(&buf, binary.LittleEndian, int32(len(widths)))
+	for _, width := range widths {
+		bucket := buckets[width]
+		sort.Slice(bucket, func(i, j int) bool {
+			return bytes.Compare(bucket[i].digest, bucket[j].digest) < 0
+		})
+		recordWidth := width + 8
+		binary.Write(&buf, binary.LittleEndian, uint32(recordWidth))
+		binary.Write(&buf, binary.LittleEndian, int64(len(bucket)*recordWidth))
+		for _, r := range bucket {
+			buf.Write(r.digest)
+			binary.Write(&buf, binary.LittleEndian, r.offset)
+		}
+	}
+	return buf.Bytes()
+}
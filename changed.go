@@ -0,0 +1,139 @@
+package graphsplit
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// policies for the source files found to change while they are chunked
+const (
+	// fail the slice of the file
+	ChangedFail = "fail"
+	// read the file again, and fail if it keeps changing
+	ChangedRetry = "retry"
+	// leave the file out of its slice, and report it with the paths
+	// excluded. A part of a split file cannot be left out, as its other
+	// parts are in other slices, so the slice fails.
+	ChangedSkip = "skip"
+)
+
+// DefaultChangedRetries is how many times a file changed is read again with
+// ChangedRetry
+const DefaultChangedRetries = 3
+
+// changedRetryDelay is the wait before reading a file changed again, which
+// doubles on every retry
+var changedRetryDelay = time.Second
+
+// fileChangedError tells how a file changed while it was chunked
+type fileChangedError struct {
+	path   string
+	reason string
+}
+
+func (e *fileChangedError) Error() string {
+	return fmt.Sprintf("%s changed while it was chunked: %s", e.path, e.reason)
+}
+
+// statFinfo stats the file of item in fsys, or on the OS if fsys is nil
+func statFinfo(fsys fs.FS, item Finfo) (fs.FileInfo, error) {
+	if fsys == nil {
+		return os.Stat(item.Path)
+	}
+	return fs.Stat(fsys, item.Path)
+}
+
+// sizedReader counts the bytes read from r
+type sizedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (sr *sizedReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.n += int64(n)
+	return n, err
+}
+
+// readChecked calls read with the bytes of item from SeekStart to SeekEnd
+// in fsys, opened by open, and checks that its file is as planned: of the size it had when
+// the slices were planned, and of the same size and mtime after it is read
+// as before. A file rewritten with the same size before it is read is not
+// told apart, the slices only depend on the sizes.
+func readChecked(fsys fs.FS, item Finfo, open func(fs.FS, Finfo) (io.ReadCloser, error), read func(io.Reader) error) error {
+	before, err := statFinfo(fsys, item)
+	if err != nil {
+		return err
+	}
+	if before.Size() != item.Info.Size() {
+		return &fileChangedError{path: item.Path, reason: fmt.Sprintf("size is %d, planned %d", before.Size(), item.Info.Size())}
+	}
+	r, err := open(fsys, item)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	sr := &sizedReader{r: r}
+	if err := read(sr); err != nil {
+		return err
+	}
+	expect := item.Info.Size()
+	if isFilePart(item) {
+		expect = item.SeekEnd - item.SeekStart + 1
+	}
+	if sr.n != expect {
+		return &fileChangedError{path: item.Path, reason: fmt.Sprintf("read %d bytes from %d, planned %d", sr.n, item.SeekStart, expect)}
+	}
+	after, err := statFinfo(fsys, item)
+	if err != nil {
+		return err
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		return &fileChangedError{path: item.Path, reason: fmt.Sprintf("size %d and mtime %s before reading, %d and %s after",
+			before.Size(), before.ModTime().Format(time.RFC3339Nano), after.Size(), after.ModTime().Format(time.RFC3339Nano))}
+	}
+	return nil
+}
+
+// readFile calls read with the bytes of item as readChecked does, and
+// handles a change of its file by the policy of o. It tells if the file is
+// kept in its slice.
+func (o *chunkOptions) readFile(fsys fs.FS, item Finfo, read func(io.Reader) error) (bool, error) {
+	open := openRange
+	if o.sparse {
+		open = openSparse
+	}
+	delay := changedRetryDelay
+	for retry := 0; ; retry++ {
+		restore := func() {}
+		if o.hashes != nil && o.changedPolicy == ChangedRetry {
+			var err error
+			if restore, err = o.hashes.checkpoint(item); err != nil {
+				return false, err
+			}
+		}
+		err := readChecked(fsys, item, open, read)
+		var changed *fileChangedError
+		if !xerrors.As(err, &changed) {
+			return err == nil, err
+		}
+		switch {
+		case o.changedPolicy == ChangedRetry && retry < o.changedRetries:
+			log.Warnf("%s, reading it again in %s", err, delay)
+			restore()
+			time.Sleep(delay)
+			delay *= 2
+			continue
+		case o.changedPolicy == ChangedSkip && !isFilePart(item):
+			log.Warnf("%s, skipped", err)
+			o.excluded.add(item.Path, "changed: "+changed.reason)
+			return false, nil
+		}
+		return false, err
+	}
+}
@@ -0,0 +1,111 @@
+package graphsplit
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// touchingFS touches the file changed after opening it to read it, times
+// times
+type touchingFS struct {
+	fs.FS
+	dir     string
+	changed string
+	times   int
+}
+
+func (t *touchingFS) Open(name string) (fs.File, error) {
+	f, err := t.FS.Open(name)
+	if err == nil && name == t.changed && t.times != 0 {
+		t.times--
+		mtime := time.Now().Add(time.Hour)
+		if err := os.Chtimes(filepath.Join(t.dir, name), mtime, mtime); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, err
+}
+
+func (t *touchingFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(t.FS, name)
+}
+
+type resultCallback struct {
+	cids []string
+	err  error
+}
+
+func (cc *resultCallback) OnSuccess(node ipld.Node, graphName, fsDetail string) {
+	cc.cids = append(cc.cids, node.Cid().String())
+}
+
+func (cc *resultCallback) OnError(err error) {
+	cc.err = err
+}
+
+func TestChangedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_changed_files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.bin", "b.bin"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), bytes.Repeat([]byte(name), 1000), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changedRetryDelay = time.Millisecond
+	ctx := context.Background()
+	chunk := func(times int, opts ...ChunkOption) (*resultCallback, string) {
+		carDir, err := ioutil.TempDir(dir, "cars")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tfs := &touchingFS{FS: os.DirFS(src), dir: src, changed: "b.bin", times: times}
+		cb := &resultCallback{}
+		if err := ChunkFS(ctx, 1<<20, tfs, ".", carDir, "test", 1, cb, opts...); err != nil {
+			t.Fatal(err)
+		}
+		return cb, carDir
+	}
+
+	expect, _ := chunk(0)
+	if expect.err != nil || len(expect.cids) != 1 {
+		t.Fatalf("expect a slice, got %v, %v", expect.cids, expect.err)
+	}
+	if cb, _ := chunk(1); cb.err == nil || !strings.Contains(cb.err.Error(), "b.bin changed") {
+		t.Fatalf("expect b.bin to fail its slice, got %v", cb.err)
+	}
+	if cb, _ := chunk(1, WithChangedPolicy(ChangedRetry, 2)); cb.err != nil || cb.cids[0] != expect.cids[0] {
+		t.Fatalf("expect b.bin to be read again, got %v, %v", cb.cids, cb.err)
+	}
+	if cb, _ := chunk(-1, WithChangedPolicy(ChangedRetry, 2)); cb.err == nil {
+		t.Fatal("expect b.bin to fail its slice once retried")
+	}
+	cb, carDir := chunk(-1, WithChangedPolicy(ChangedSkip, 0))
+	if cb.err != nil || len(cb.cids) != 1 || cb.cids[0] == expect.cids[0] {
+		t.Fatalf("expect a slice without b.bin, got %v, %v", cb.cids, cb.err)
+	}
+	report, err := ioutil.ReadFile(filepath.Join(carDir, ExcludedName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(report), "b.bin,") || !strings.Contains(string(report), "changed: size 5000 and mtime") {
+		t.Fatalf("expect b.bin in the report, got\n%s", report)
+	}
+}
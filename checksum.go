@@ -0,0 +1,328 @@
+package graphsplit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+	"lukechampine.com/blake3"
+)
+
+// supported checksum algorithms
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumMD5    = "md5"
+	ChecksumBLAKE3 = "blake3"
+)
+
+// name of the SHA256SUMS-style file written to car-dir for each algorithm
+var checksumFileNames = map[string]string{
+	ChecksumSHA256: "SHA256SUMS",
+	ChecksumMD5:    "MD5SUMS",
+	ChecksumBLAKE3: "B3SUMS",
+}
+
+func newChecksumHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumMD5:
+		return md5.New(), nil
+	case ChecksumBLAKE3:
+		return blake3.New(32, nil), nil
+	default:
+		return nil, xerrors.Errorf("unsupported checksum algorithm: %s", algo)
+	}
+}
+
+// ChecksumFileName returns the name of the checksum file of algo, e.g. SHA256SUMS
+func ChecksumFileName(algo string) string {
+	return checksumFileNames[algo]
+}
+
+// checksumAlgoOf is the reverse of ChecksumFileName
+func checksumAlgoOf(fileName string) string {
+	for algo, name := range checksumFileNames {
+		if name == fileName {
+			return algo
+		}
+	}
+	return ""
+}
+
+// multiHash feeds the same bytes to several hash algorithms
+type multiHash struct {
+	algos  []string
+	hashes []hash.Hash
+}
+
+func newMultiHash(algos []string) (*multiHash, error) {
+	mh := &multiHash{algos: algos}
+	for _, algo := range algos {
+		h, err := newChecksumHash(algo)
+		if err != nil {
+			return nil, err
+		}
+		mh.hashes = append(mh.hashes, h)
+	}
+	return mh, nil
+}
+
+func (mh *multiHash) Write(p []byte) (int, error) {
+	for _, h := range mh.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// clone copies mh with the bytes written so far
+func (mh *multiHash) clone() (*multiHash, error) {
+	c := &multiHash{algos: mh.algos}
+	for i, h := range mh.hashes {
+		switch h := h.(type) {
+		case *blake3.Hasher:
+			hc := *h
+			c.hashes = append(c.hashes, &hc)
+			continue
+		case encoding.BinaryMarshaler:
+			state, err := h.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			hc, err := newChecksumHash(mh.algos[i])
+			if err != nil {
+				return nil, err
+			}
+			if err := hc.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+				return nil, err
+			}
+			c.hashes = append(c.hashes, hc)
+			continue
+		}
+		return nil, xerrors.Errorf("the state of %s cannot be copied", mh.algos[i])
+	}
+	return c, nil
+}
+
+func (mh *multiHash) Sums() map[string]string {
+	sums := make(map[string]string, len(mh.algos))
+	for i, algo := range mh.algos {
+		sums[algo] = hex.EncodeToString(mh.hashes[i].Sum(nil))
+	}
+	return sums
+}
+
+// fileHashes keeps the running whole-file hashes of split files, whose parts
+// are read one after another while building consecutive graph slices
+type fileHashes struct {
+	algos   []string
+	lock    sync.Mutex
+	running map[string]*multiHash
+}
+
+func newFileHashes(algos []string) (*fileHashes, error) {
+	for _, algo := range algos {
+		if _, err := newChecksumHash(algo); err != nil {
+			return nil, err
+		}
+	}
+	return &fileHashes{algos: algos, running: make(map[string]*multiHash)}, nil
+}
+
+// writerFor returns the writer that receives the bytes of item, together with
+// the hash of the bytes of item alone
+func (fh *fileHashes) writerFor(item Finfo) (io.Writer, *multiHash, error) {
+	rangeHash, err := newMultiHash(fh.algos)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !isFilePart(item) {
+		return rangeHash, rangeHash, nil
+	}
+	fh.lock.Lock()
+	defer fh.lock.Unlock()
+	fileHash, ok := fh.running[item.Path]
+	if !ok {
+		fileHash, err = newMultiHash(fh.algos)
+		if err != nil {
+			return nil, nil, err
+		}
+		fh.running[item.Path] = fileHash
+	}
+	return io.MultiWriter(rangeHash, fileHash), rangeHash, nil
+}
+
+// checkpoint saves the whole-file hash of item, and gives a function putting
+// it back as it is now, to read item again
+func (fh *fileHashes) checkpoint(item Finfo) (func(), error) {
+	if !isFilePart(item) {
+		return func() {}, nil
+	}
+	fh.lock.Lock()
+	defer fh.lock.Unlock()
+	fileHash, ok := fh.running[item.Path]
+	if !ok {
+		return func() {
+			fh.lock.Lock()
+			delete(fh.running, item.Path)
+			fh.lock.Unlock()
+		}, nil
+	}
+	saved, err := fileHash.clone()
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		fh.lock.Lock()
+		fh.running[item.Path] = saved
+		fh.lock.Unlock()
+	}, nil
+}
+
+// fileSums returns the whole-file checksums once the last part of item has
+// been read, or nil if there are parts still to come
+func (fh *fileHashes) fileSums(item Finfo, rangeSums map[string]string) map[string]string {
+	if !isFilePart(item) {
+		return rangeSums
+	}
+	if item.SeekEnd < item.Info.Size()-1 {
+		return nil
+	}
+	fh.lock.Lock()
+	defer fh.lock.Unlock()
+	fileHash, ok := fh.running[item.Path]
+	if !ok {
+		return nil
+	}
+	delete(fh.running, item.Path)
+	return fileHash.Sums()
+}
+
+func isFilePart(item Finfo) bool {
+	return item.SeekStart > 0 || item.SeekEnd > 0
+}
+
+// appendChecksumFiles adds the whole-file checksums of entries to the
+// SHA256SUMS-style files in s
+func appendChecksumFiles(s Sink, algos []string, entries []FileIndexEntry) error {
+	for _, algo := range algos {
+		var buf bytes.Buffer
+		for _, entry := range entries {
+			sum, ok := entry.FileChecksums[algo]
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(&buf, "%s  %s\n", sum, entry.Path)
+		}
+		if err := s.Append(ChecksumFileName(algo), nil, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindChecksumFiles returns the SHA256SUMS-style files present in dir
+func FindChecksumFiles(dir string) []string {
+	found := make([]string, 0)
+	for _, algo := range []string{ChecksumSHA256, ChecksumMD5, ChecksumBLAKE3} {
+		sumsPath := filepath.Join(dir, ChecksumFileName(algo))
+		if _, err := os.Stat(sumsPath); err == nil {
+			found = append(found, sumsPath)
+		}
+	}
+	return found
+}
+
+// ReadChecksumFile reads a SHA256SUMS-style file into a map of path to checksum
+func ReadChecksumFile(sumsPath string) (map[string]string, error) {
+	f, err := os.Open(sumsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		sum, fpath, ok := strings.Cut(line, "  ")
+		if !ok {
+			return nil, xerrors.Errorf("malformed line in %s: %q", sumsPath, line)
+		}
+		sums[fpath] = sum
+	}
+	return sums, scanner.Err()
+}
+
+// VerifyChecksums checks the files restored into outputDir against the
+// checksum file at sumsPath, the algorithm is inferred from its name. If
+// patterns are given, only the files selected by them are checked, as in
+// RestorePaths. It returns the paths that are missing or whose content differs.
+func VerifyChecksums(sumsPath, outputDir string, patterns []string) ([]string, error) {
+	algo := checksumAlgoOf(filepath.Base(sumsPath))
+	if algo == "" {
+		return nil, xerrors.Errorf("unknown checksum file: %s", sumsPath)
+	}
+	pf, err := newPathFilter(patterns)
+	if err != nil {
+		return nil, err
+	}
+	sums, err := ReadChecksumFile(sumsPath)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(sums))
+	for fpath := range sums {
+		if len(patterns) > 0 && !pf.match(fpath) {
+			continue
+		}
+		paths = append(paths, fpath)
+	}
+	sort.Strings(paths)
+
+	failed := make([]string, 0)
+	for _, fpath := range paths {
+		sum, err := fileChecksum(algo, filepath.Join(outputDir, filepath.FromSlash(fpath)))
+		if err != nil {
+			log.Warnf("checksum of %s: %s", fpath, err)
+			failed = append(failed, fpath)
+			continue
+		}
+		if sum != sums[fpath] {
+			log.Warnf("%s checksum mismatch of %s, expected %s, got %s", algo, fpath, sums[fpath], sum)
+			failed = append(failed, fpath)
+		}
+	}
+	return failed, nil
+}
+
+func fileChecksum(algo, fpath string) (string, error) {
+	h, err := newChecksumHash(algo)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
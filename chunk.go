@@ -4,9 +4,11 @@ import (
 	"context"
 	"encoding/csv"
 	"fmt"
+	"io/fs"
 	"os"
 	"path"
 	"strconv"
+	"sync"
 	"time"
 
 	ipld "github.com/ipfs/go-ipld-format"
@@ -72,159 +74,500 @@ func (cc *commPCallback) OnError(err error) {
 	log.Fatal(err)
 }
 
-type csvCallback struct {
-	carDir string
+type errCallback struct{}
+
+func (cc *errCallback) OnSuccess(ipld.Node, string, string) {}
+func (cc *errCallback) OnError(err error) {
+	log.Fatal(err)
 }
 
-func (cc *csvCallback) OnSuccess(node ipld.Node, graphName, fsDetail string) {
-	// Add node inof to manifest.csv
-	manifestPath := path.Join(cc.carDir, "manifest.csv")
-	_, err := os.Stat(manifestPath)
-	if err != nil && !os.IsNotExist(err) {
-		log.Fatal(err)
+func CommPCallback(carDir string, rename, addPadding bool) GraphBuildCallback {
+	return &commPCallback{carDir: carDir, rename: rename, addPadding: addPadding}
+}
+
+func CSVCallback(carDir string) GraphBuildCallback {
+	return SinkCallback(DirSink(carDir))
+}
+
+// errKeeper is a GraphBuildCallback keeping the errors it is handed, which
+// Chunk then returns rather than leaving the callback to exit
+type errKeeper interface {
+	Err() error
+}
+
+// callbackErr is the first error kept by cb, if it keeps them
+func callbackErr(cb GraphBuildCallback) error {
+	if k, ok := cb.(errKeeper); ok {
+		return k.Err()
 	}
-	var isCreateAction bool
-	if err != nil && os.IsNotExist(err) {
-		isCreateAction = true
+	return nil
+}
+
+// keptErr keeps the first error a callback is handed
+type keptErr struct {
+	lock sync.Mutex
+	err  error
+}
+
+func (k *keptErr) OnError(err error) {
+	log.Error(err)
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.err == nil {
+		k.err = err
 	}
-	f, err := os.OpenFile(manifestPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+func (k *keptErr) Err() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.err
+}
+
+// KeepErrCallback does nothing with the slices built, and keeps the first
+// error for Chunk to return, where ErrCallback exits
+func KeepErrCallback() GraphBuildCallback {
+	return &keepErrCallback{}
+}
+
+type keepErrCallback struct {
+	keptErr
+}
+
+func (cc *keepErrCallback) OnSuccess(ipld.Node, string, string) {}
+
+func ErrCallback() GraphBuildCallback {
+	return &errCallback{}
+}
+
+// ChunkOption customises the behaviour of Chunk
+type ChunkOption func(*chunkOptions)
+
+type chunkOptions struct {
+	saveIndex bool
+	checksums []string
+	// running whole-file hashes of split files
+	hashes    *fileHashes
+	sink      Sink
+	walkers   int
+	inventory string
+	sortOrder string
+	// recorded in the params of the run
+	source      string
+	inputFormat string
+	// the name of the only slice to build, if set
+	slice string
+	// the files to chunk, and the paths excluded
+	selection FileFilter
+	filter    *fileFilter
+	excluded  *exclusionReport
+	// what to do with the files changing while they are read
+	changedPolicy  string
+	changedRetries int
+	// what to do with special files
+	special string
+	// read the holes of sparse files as zeros
+	sparse bool
+	// cut split files at multiples of UnixfsChunkSize
+	alignCuts bool
+}
+
+// output is the sink of the files written to carDir
+func (o *chunkOptions) output(carDir string) Sink {
+	if o.sink != nil {
+		return o.sink
+	}
+	return DirSink(carDir)
+}
+
+func newChunkOptions(opts []ChunkOption) (*chunkOptions, error) {
+	o := &chunkOptions{walkers: DefaultWalkers, sortOrder: SortByPath, changedPolicy: ChangedFail, changedRetries: DefaultChangedRetries, special: SpecialSkip}
+	for _, opt := range opts {
+		opt(o)
+	}
+	switch o.sortOrder {
+	case SortByPath, SortBySize, SortByMtime:
+	default:
+		return nil, xerrors.Errorf("unsupported sort order: %s", o.sortOrder)
+	}
+	switch o.changedPolicy {
+	case ChangedFail, ChangedRetry, ChangedSkip:
+	default:
+		return nil, xerrors.Errorf("unsupported policy for changed files: %s", o.changedPolicy)
+	}
+	switch o.special {
+	case SpecialSkip, SpecialFail:
+	default:
+		return nil, xerrors.Errorf("unsupported policy for special files: %s", o.special)
+	}
+	filter, err := newFileFilter(o.selection)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer f.Close()
-	if isCreateAction {
-		if _, err := f.Write([]byte("playload_cid,filename,detail\n")); err != nil {
-			log.Fatal(err)
+	filter.failSpecial = o.special == SpecialFail
+	o.filter = filter
+	o.excluded = &exclusionReport{}
+	if len(o.checksums) > 0 {
+		// checksums are kept in the file index
+		o.saveIndex = true
+		hashes, err := newFileHashes(o.checksums)
+		if err != nil {
+			return nil, err
 		}
+		o.hashes = hashes
 	}
-	if _, err := f.Write([]byte(fmt.Sprintf("%s,%s,%s\n", node.Cid(), graphName, fsDetail))); err != nil {
-		log.Fatal(err)
+	return o, nil
+}
+
+// WithFileIndex makes Chunk save a fileindex.csv in car-dir, which records
+// the slice, byte range and cid of every file
+func WithFileIndex() ChunkOption {
+	return func(o *chunkOptions) {
+		o.saveIndex = true
 	}
 }
 
-func (cc *csvCallback) OnError(err error) {
-	log.Fatal(err)
+// WithChecksums makes Chunk compute checksums of every source file while it
+// is read, they are saved in the file index and in SHA256SUMS-style files
+func WithChecksums(algos ...string) ChunkOption {
+	return func(o *chunkOptions) {
+		o.checksums = append(o.checksums, algos...)
+	}
 }
 
-type errCallback struct{}
+// WithSink makes Chunk write the CAR files, file index and checksum files to
+// s instead of car-dir. The manifest goes to s too with SinkCallback.
+func WithSink(s Sink) ChunkOption {
+	return func(o *chunkOptions) {
+		o.sink = s
+	}
+}
 
-func (cc *errCallback) OnSuccess(ipld.Node, string, string) {}
-func (cc *errCallback) OnError(err error) {
-	log.Fatal(err)
+// WithWalkers sets the number of goroutines reading directories at once
+// when walking the source, DefaultWalkers by default
+func WithWalkers(n int) ChunkOption {
+	return func(o *chunkOptions) {
+		o.walkers = n
+	}
 }
 
-func CommPCallback(carDir string, rename, addPadding bool) GraphBuildCallback {
-	return &commPCallback{carDir: carDir, rename: rename, addPadding: addPadding}
+// WithInventory makes Chunk read the files to chunk from the inventory file
+// at inventoryPath, as SaveInventory saves it, instead of walking the
+// source. The inventory is saved by walking the source once if it does not
+// exist yet. The paths of the inventory are the ones of the files in the
+// file system of the source, under the parent path of Chunk, so it has to
+// be kept with the source and target path it was saved for. Without one,
+// the source is walked once into a temporary inventory.
+func WithInventory(inventoryPath string) ChunkOption {
+	return func(o *chunkOptions) {
+		o.inventory = inventoryPath
+	}
 }
 
-func CSVCallback(carDir string) GraphBuildCallback {
-	return &csvCallback{carDir: carDir}
+// WithSortOrder sets the order the files are packed into slices in, one of
+// SortByPath, the default, SortBySize and SortByMtime. The files are sorted
+// in memory for the other orders than SortByPath.
+func WithSortOrder(order string) ChunkOption {
+	return func(o *chunkOptions) {
+		o.sortOrder = order
+	}
 }
-func ErrCallback() GraphBuildCallback {
-	return &errCallback{}
+
+// WithFilter makes Chunk only chunk the files selected by f. Without it,
+// the files that are not hidden are chunked. The paths excluded are saved
+// in the report named ExcludedName in car-dir.
+func WithFilter(f FileFilter) ChunkOption {
+	return func(o *chunkOptions) {
+		o.selection = f
+	}
+}
+
+// WithChangedPolicy sets what Chunk does with a source file found to change
+// while it is read, one of ChangedFail, the default, ChangedRetry, which reads
+// it up to retries times again, and ChangedSkip
+func WithChangedPolicy(policy string, retries int) ChunkOption {
+	return func(o *chunkOptions) {
+		o.changedPolicy = policy
+		o.changedRetries = retries
+	}
 }
 
-func Chunk(ctx context.Context, sliceSize int64, parentPath, targetPath, carDir, graphName string, parallel int, cb GraphBuildCallback) error {
-	var cumuSize int64 = 0
+// WithSpecialFiles sets what Chunk does with devices, FIFOs, sockets and the
+// other files that are neither regular files nor directories: SpecialSkip,
+// the default, skips them and reports them with the paths excluded, and
+// SpecialFail fails
+func WithSpecialFiles(policy string) ChunkOption {
+	return func(o *chunkOptions) {
+		o.special = policy
+	}
+}
+
+// WithSparseFiles makes Chunk look for the holes of sparse files with
+// SEEK_HOLE and SEEK_DATA, and give zeros for them without reading them.
+// The chunks of zeros are laid out once, the CAR files are the same.
+func WithSparseFiles() ChunkOption {
+	return func(o *chunkOptions) {
+		o.sparse = true
+	}
+}
+
+// WithAlignedCuts makes Chunk cut split files at multiples of
+// UnixfsChunkSize, so that their parts are laid out in the same leaves as
+// the whole file, of the same cids. The slices holding a cut may be smaller
+// than sliceSize, by less than a chunk.
+func WithAlignedCuts() ChunkOption {
+	return func(o *chunkOptions) {
+		o.alignCuts = true
+	}
+}
+
+// alignment gives the multiple of bytes split files are cut at, 0 for any
+func (o *chunkOptions) alignment(sliceSize int64) (int64, error) {
+	if !o.alignCuts {
+		return 0, nil
+	}
+	if sliceSize < int64(UnixfsChunkSize) {
+		return 0, xerrors.Errorf("slice size %d is smaller than the chunks of %d bytes the cuts are aligned to", sliceSize, UnixfsChunkSize)
+	}
+	return int64(UnixfsChunkSize), nil
+}
+
+// WithSource records where the files chunked are read from in the params of
+// the run, the directory, archive or s3://bucket/prefix of the file system
+// and its input format, so that Regenerate can read them again
+func WithSource(source, inputFormat string) ChunkOption {
+	return func(o *chunkOptions) {
+		o.source = source
+		o.inputFormat = inputFormat
+	}
+}
+
+// withSlice makes Chunk plan all the slices but build only the one named
+func withSlice(name string) ChunkOption {
+	return func(o *chunkOptions) {
+		o.slice = name
+	}
+}
+
+func Chunk(ctx context.Context, sliceSize int64, parentPath, targetPath, carDir, graphName string, parallel int, cb GraphBuildCallback, opts ...ChunkOption) error {
+	if parentPath == "" {
+		parentPath = targetPath
+	}
+	dir, root, err := localSourceDir(parentPath, targetPath)
+	if err != nil {
+		return err
+	}
+	opts = append([]ChunkOption{WithSource(dir, "dir")}, opts...)
+	return ChunkFS(ctx, sliceSize, os.DirFS(dir), root, carDir, graphName, parallel, cb, opts...)
+}
+
+// ChunkFS is Chunk for the files under root in fsys, which may be a single
+// file. The files are placed in the graph by their paths in fsys, so root
+// only selects them, as the target path of Chunk under its parent path.
+// Split files are read by byte ranges, see RangeFS.
+//
+// The same files and options always give the same CAR files and manifests.
+// The parameters they depend on and the slices made are added to the
+// params.jsonl of carDir, for Regenerate.
+func ChunkFS(ctx context.Context, sliceSize int64, fsys fs.FS, root, carDir, graphName string, parallel int, cb GraphBuildCallback, opts ...ChunkOption) error {
 	graphSliceCount := 0
-	graphFiles := make([]Finfo, 0)
 	if sliceSize == 0 {
 		return xerrors.Errorf("Unexpected! Slice size has been set as 0")
 	}
 	if parallel <= 0 {
 		return xerrors.Errorf("Unexpected! Parallel has to be greater than 0")
 	}
-	if parentPath == "" {
-		parentPath = targetPath
+	o, err := newChunkOptions(opts)
+	if err != nil {
+		return err
+	}
+	align, err := o.alignment(sliceSize)
+	if err != nil {
+		return err
 	}
 
-	args := []string{targetPath}
-	sliceTotal := GetGraphCount(args, sliceSize)
-	if sliceTotal == 0 {
-		log.Warn("Empty folder or file!")
+	files, done, err := o.listFiles(fsys, root)
+	if err != nil {
+		return err
+	}
+	defer done()
+	var totalSize int64
+	if err := files(func(item Finfo) error {
+		totalSize += item.Info.Size()
 		return nil
+	}); err != nil {
+		return err
+	}
+	if totalSize == 0 {
+		log.Warn("Empty folder or file!")
+		if o.slice != "" {
+			return nil
+		}
+		return o.excluded.save(o.output(carDir))
 	}
-	files := GetFileListAsync(args)
-	for item := range files {
-		fileSize := item.Info.Size()
-		switch {
-		case cumuSize+fileSize < sliceSize:
-			cumuSize += fileSize
-			graphFiles = append(graphFiles, item)
-		case cumuSize+fileSize == sliceSize:
-			cumuSize += fileSize
-			graphFiles = append(graphFiles, item)
-			// todo build ipld from graphFiles
-			BuildIpldGraph(ctx, graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel, cb)
+	// as GetGraphCount counts them
+	sliceTotal := int(totalSize/sliceSize) + 1
+	if align > 0 {
+		// aligned cuts leave room in slices, which may add some
+		counter := &fileSlicer{sliceSize: sliceSize, align: align, flush: func([]Finfo, int64) error {
+			sliceTotal++
+			return nil
+		}}
+		sliceTotal = 0
+		if err := files(counter.push); err != nil {
+			return err
+		}
+		if err := counter.close(); err != nil {
+			return err
+		}
+	}
+	params := o.params(graphName, sliceSize, root)
+	cb = &paramsCallback{GraphBuildCallback: cb, params: params}
+	fsl := &fileSlicer{
+		sliceSize: sliceSize,
+		align:     align,
+		flush: func(graphFiles []Finfo, cumuSize int64) error {
+			if o.slice != "" && GenGraphName(graphName, graphSliceCount, sliceTotal) != o.slice {
+				graphSliceCount++
+				return nil
+			}
+			buildGraph(ctx, fsys, graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), ".", carDir, parallel, cb, o)
+			if err := callbackErr(cb); err != nil {
+				return err
+			}
 			fmt.Printf("cumu-size: %d\n", cumuSize)
 			fmt.Printf(GenGraphName(graphName, graphSliceCount, sliceTotal))
 			fmt.Printf("=================\n")
-			cumuSize = 0
-			graphFiles = make([]Finfo, 0)
 			graphSliceCount++
-		case cumuSize+fileSize > sliceSize:
-			fileSliceCount := 0
-			// need to split item to fit graph slice
-			//
-			// first cut
-			firstCut := sliceSize - cumuSize
-			var seekStart int64 = 0
-			var seekEnd int64 = seekStart + firstCut - 1
-			fmt.Printf("first cut %d, seek start at %d, end at %d", firstCut, seekStart, seekEnd)
-			fmt.Printf("----------------\n")
-			graphFiles = append(graphFiles, Finfo{
-				Path:      item.Path,
-				Name:      fmt.Sprintf("%s.%08d", item.Info.Name(), fileSliceCount),
-				Info:      item.Info,
-				SeekStart: seekStart,
-				SeekEnd:   seekEnd,
-			})
-			fileSliceCount++
-			// todo build ipld from graphFiles
-			BuildIpldGraph(ctx, graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel, cb)
-			fmt.Printf("cumu-size: %d\n", cumuSize+firstCut)
-			fmt.Printf(GenGraphName(graphName, graphSliceCount, sliceTotal))
-			fmt.Printf("=================\n")
-			cumuSize = 0
-			graphFiles = make([]Finfo, 0)
-			graphSliceCount++
-			for seekEnd < fileSize-1 {
-				seekStart = seekEnd + 1
-				seekEnd = seekStart + sliceSize - 1
-				if seekEnd >= fileSize-1 {
-					seekEnd = fileSize - 1
-				}
-				fmt.Printf("following cut %d, seek start at %d, end at %d", seekEnd-seekStart+1, seekStart, seekEnd)
-				fmt.Printf("----------------\n")
-				cumuSize += seekEnd - seekStart + 1
-				graphFiles = append(graphFiles, Finfo{
-					Path:      item.Path,
-					Name:      fmt.Sprintf("%s.%08d", item.Info.Name(), fileSliceCount),
-					Info:      item.Info,
-					SeekStart: seekStart,
-					SeekEnd:   seekEnd,
-				})
-				fileSliceCount++
-				if seekEnd-seekStart == sliceSize-1 {
-					// todo build ipld from graphFiles
-					BuildIpldGraph(ctx, graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel, cb)
-					fmt.Printf("cumu-size: %d\n", sliceSize)
-					fmt.Printf(GenGraphName(graphName, graphSliceCount, sliceTotal))
-					fmt.Printf("=================\n")
-					cumuSize = 0
-					graphFiles = make([]Finfo, 0)
-					graphSliceCount++
-				}
-			}
+			return nil
+		},
+	}
+	if err := files(fsl.push); err != nil {
+		return err
+	}
+	if err := fsl.close(); err != nil {
+		return err
+	}
+	if o.slice != "" {
+		return nil
+	}
+	if err := o.excluded.save(o.output(carDir)); err != nil {
+		return err
+	}
+	return appendParams(o.output(carDir), params)
+}
+
+// fileSlicer packs files into slices of sliceSize bytes in the order they
+// are pushed, cutting the files that do not fit into parts
+type fileSlicer struct {
+	sliceSize int64
+	// files are cut at multiples of align bytes, if set
+	align      int64
+	cumuSize   int64
+	graphFiles []Finfo
+	// add, if set, is called with every file or part as it is packed, in
+	// the order of their bytes
+	add func(Finfo) error
+	// flush is called with the files and parts of every slice once it is
+	// full, and their size
+	flush func([]Finfo, int64) error
+}
+
+func (fsl *fileSlicer) append(item Finfo) error {
+	fsl.graphFiles = append(fsl.graphFiles, item)
+	if fsl.add != nil {
+		return fsl.add(item)
+	}
+	return nil
+}
+
+func (fsl *fileSlicer) flushSlice(cumuSize int64) error {
+	graphFiles := fsl.graphFiles
+	fsl.cumuSize = 0
+	fsl.graphFiles = make([]Finfo, 0)
+	return fsl.flush(graphFiles, cumuSize)
+}
 
+func (fsl *fileSlicer) push(item Finfo) error {
+	sliceSize := fsl.sliceSize
+	fileSize := item.Info.Size()
+	switch {
+	case fsl.cumuSize+fileSize < sliceSize:
+		fsl.cumuSize += fileSize
+		return fsl.append(item)
+	case fsl.cumuSize+fileSize == sliceSize:
+		if err := fsl.append(item); err != nil {
+			return err
 		}
+		return fsl.flushSlice(sliceSize)
+	}
+	fileSliceCount := 0
+	// need to split item to fit graph slice
+	//
+	// first cut
+	firstCut := sliceSize - fsl.cumuSize
+	// the parts following the first one
+	partSize := sliceSize
+	if fsl.align > 0 {
+		firstCut -= firstCut % fsl.align
+		partSize -= partSize % fsl.align
+		if firstCut == 0 {
+			// not a chunk of the file fits in the slice, it starts the next
+			if err := fsl.flushSlice(fsl.cumuSize); err != nil {
+				return err
+			}
+			return fsl.push(item)
+		}
+	}
+	var seekStart int64 = 0
+	var seekEnd int64 = seekStart + firstCut - 1
+	fmt.Printf("first cut %d, seek start at %d, end at %d", firstCut, seekStart, seekEnd)
+	fmt.Printf("----------------\n")
+	if err := fsl.append(Finfo{
+		Path:      item.Path,
+		Name:      fmt.Sprintf("%s.%08d", item.Info.Name(), fileSliceCount),
+		Info:      item.Info,
+		SeekStart: seekStart,
+		SeekEnd:   seekEnd,
+	}); err != nil {
+		return err
 	}
-	if cumuSize > 0 {
-		// todo build ipld from graphFiles
-		BuildIpldGraph(ctx, graphFiles, GenGraphName(graphName, graphSliceCount, sliceTotal), parentPath, carDir, parallel, cb)
-		fmt.Printf("cumu-size: %d\n", cumuSize)
-		fmt.Printf(GenGraphName(graphName, graphSliceCount, sliceTotal))
-		fmt.Printf("=================\n")
+	fileSliceCount++
+	if err := fsl.flushSlice(fsl.cumuSize + firstCut); err != nil {
+		return err
+	}
+	for seekEnd < fileSize-1 {
+		seekStart = seekEnd + 1
+		seekEnd = seekStart + partSize - 1
+		if seekEnd >= fileSize-1 {
+			seekEnd = fileSize - 1
+		}
+		fmt.Printf("following cut %d, seek start at %d, end at %d", seekEnd-seekStart+1, seekStart, seekEnd)
+		fmt.Printf("----------------\n")
+		fsl.cumuSize += seekEnd - seekStart + 1
+		if err := fsl.append(Finfo{
+			Path:      item.Path,
+			Name:      fmt.Sprintf("%s.%08d", item.Info.Name(), fileSliceCount),
+			Info:      item.Info,
+			SeekStart: seekStart,
+			SeekEnd:   seekEnd,
+		}); err != nil {
+			return err
+		}
+		fileSliceCount++
+		if seekEnd-seekStart == partSize-1 {
+			if err := fsl.flushSlice(partSize); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// close flushes the last slice, if anything is left for it
+func (fsl *fileSlicer) close() error {
+	if fsl.cumuSize > 0 {
+		return fsl.flushSlice(fsl.cumuSize)
 	}
 	return nil
 }
@@ -0,0 +1,130 @@
+package graphsplit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	car "github.com/ipld/go-car"
+)
+
+func TestAlignedCuts(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_aligned_cuts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0777); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 7<<19)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := ioutil.WriteFile(filepath.Join(src, "a.bin"), data[:300000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "b.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the leaves of b.bin laid out whole
+	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dagServ := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	cidBuilder, err := merkledag.PrefixForCidVersion(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	whole, err := layoutFile(bytes.NewReader(data), dagServ, cidBuilder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(whole.Links()) != 4 {
+		t.Fatalf("expect 4 leaves, got %d", len(whole.Links()))
+	}
+
+	ctx := context.Background()
+	for _, aligned := range []bool{false, true} {
+		carDir, err := ioutil.TempDir(dir, "cars")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var opts []ChunkOption
+		if aligned {
+			opts = append(opts, WithAlignedCuts())
+		}
+		if err := Chunk(ctx, 3<<19, src, src, carDir, "test", 1, CSVCallback(carDir), opts...); err != nil {
+			t.Fatal(err)
+		}
+		blocks := make(map[string]bool)
+		cars, err := filepath.Glob(filepath.Join(carDir, "*.car"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range cars {
+			f, err := os.Open(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cr, err := car.NewCarReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for {
+				blk, err := cr.Next()
+				if err != nil {
+					break
+				}
+				blocks[blk.Cid().String()] = true
+			}
+			f.Close()
+		}
+		shared := 0
+		for _, l := range whole.Links() {
+			if blocks[l.Cid.String()] {
+				shared++
+			}
+		}
+		if aligned && shared != 4 || !aligned && shared == 4 {
+			t.Fatalf("aligned %t: expect the parts to share %t the leaves of the whole file, %d are", aligned, aligned, shared)
+		}
+
+		params, err := ioutil.ReadFile(filepath.Join(carDir, ParamsName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var run ChunkParams
+		if err := json.Unmarshal(params, &run); err != nil {
+			t.Fatal(err)
+		}
+		if !aligned {
+			continue
+		}
+		// the cuts leave room in the slices, which makes one more
+		if !run.AlignCuts || len(run.Slices) != 4 || run.Slices[3].Name != "test-total-4-part-4.car" {
+			t.Fatalf("expect 4 slices cut aligned, got %+v", run)
+		}
+		fsys, _, err := LocalSource(src, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outDir, err := ioutil.TempDir(dir, "out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Regenerate(ctx, &run, fsys, run.Slices[1].PayloadCid, outDir, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package graphsplit
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"path"
+	"strings"
+
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/xerrors"
+)
+
+// the files of an archive are placed under it, as under the parent path of
+// Chunk
+const tarParentPath = "/"
+
+// builtGraph is a slice whose CAR file is written, waiting for its name
+type builtGraph struct {
+	node     ipld.Node
+	fsDetail string
+	entries  []FileIndexEntry
+}
+
+// ChunkTar is Chunk for the files of a tar archive of format, ArchiveTar or
+// ArchiveTarZstd, read once from r. The files are packed in the order of the
+// archive, which gives the same slices as chunking the archive extracted if
+// its entries are sorted by name, as `tar --sort=name` writes them. The
+// files are selected as Chunk selects them, and symlinks, hard links and
+// other special entries are skipped, whose content is not in the entry.
+//
+// The CAR files are written while the archive is read, and handed to cb at
+// the end, once the number of slices for their names is known.
+func ChunkTar(ctx context.Context, sliceSize int64, r io.Reader, format, carDir, graphName string, cb GraphBuildCallback, opts ...ChunkOption) error {
+	if sliceSize == 0 {
+		return xerrors.Errorf("Unexpected! Slice size has been set as 0")
+	}
+	o, err := newChunkOptions(opts)
+	if err != nil {
+		return err
+	}
+	align, err := o.alignment(sliceSize)
+	if err != nil {
+		return err
+	}
+	if o.sortOrder != SortByPath {
+		return xerrors.Errorf("the files of an archive stream are chunked in the order of the archive")
+	}
+	if o.inputFormat == "" {
+		o.inputFormat = format
+	}
+	switch format {
+	case ArchiveTar:
+	case ArchiveTarZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return xerrors.Errorf("unsupported archive format: %s", format)
+	}
+	tr := tar.NewReader(r)
+
+	var gb *graphBuilder
+	var built []builtGraph
+	fsl := &fileSlicer{
+		sliceSize: sliceSize,
+		align:     align,
+		add: func(item Finfo) error {
+			if gb == nil {
+				if gb, err = newGraphBuilder(nil, o); err != nil {
+					return err
+				}
+			}
+			size := item.Info.Size()
+			if isFilePart(item) {
+				size = item.SeekEnd - item.SeekStart + 1
+			}
+			gb.fileList = append(gb.fileList, item)
+			gb.entries = append(gb.entries, FileIndexEntry{})
+			return gb.addFile(len(gb.fileList)-1, io.LimitReader(tr, size), tarParentPath, o)
+		},
+		flush: func(graphFiles []Finfo, cumuSize int64) error {
+			node, fsDetail, err := gb.build(ctx, tarParentPath, o.output(carDir))
+			if err != nil {
+				return err
+			}
+			built = append(built, builtGraph{node: node, fsDetail: fsDetail, entries: gb.entries})
+			gb = nil
+			log.Infof("cumu-size: %d", cumuSize)
+			return nil
+		},
+	}
+
+	fsel := &fileSelector{filter: o.filter, root: ".", report: o.excluded.add}
+	var totalSize int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return xerrors.Errorf("read archive: %w", err)
+		}
+		p := path.Clean(tarParentPath + hdr.Name)
+		switch hdr.Typeflag {
+		// special files are skipped or fail as in a directory
+		case tar.TypeReg, tar.TypeRegA, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+			continue
+		default:
+			log.Warnf("skip %s, entries of type %q are not chunked", p, hdr.Typeflag)
+			continue
+		}
+		keep, err := fsel.keep(strings.TrimPrefix(p, tarParentPath), hdr.Size, hdr.FileInfo().Mode())
+		if err != nil {
+			return err
+		}
+		if !keep {
+			continue
+		}
+		totalSize += hdr.Size
+		if err := fsl.push(Finfo{Path: p, Name: path.Base(p), Info: hdr.FileInfo()}); err != nil {
+			return xerrors.Errorf("%s: %w", p, err)
+		}
+	}
+	if totalSize == 0 {
+		log.Warn("Empty folder or file!")
+		return o.excluded.save(o.output(carDir))
+	}
+	if err := fsl.close(); err != nil {
+		return err
+	}
+
+	// as GetGraphCount counts them
+	sliceTotal := int(totalSize/sliceSize) + 1
+	if align > 0 {
+		// aligned cuts leave room in slices, which may add some
+		sliceTotal = len(built)
+	}
+	params := o.params(graphName, sliceSize, ".")
+	params.SortOrder = SortByArchive
+	cb = &paramsCallback{GraphBuildCallback: cb, params: params}
+	for i, g := range built {
+		finishGraph(g.node, g.fsDetail, g.entries, GenGraphName(graphName, i, sliceTotal), carDir, cb, o)
+		if err := callbackErr(cb); err != nil {
+			return err
+		}
+	}
+	if err := o.excluded.save(o.output(carDir)); err != nil {
+		return err
+	}
+	return appendParams(o.output(carDir), params)
+}
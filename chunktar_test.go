@@ -0,0 +1,101 @@
+package graphsplit
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestChunkTar(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_chunk_tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	big := make([]byte, 2500)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	files := map[string]string{
+		"a.txt":       strings.Repeat("a", 600),
+		"b/big.bin":   string(big),
+		"b/c/d.txt":   "d",
+		"e/empty.txt": "",
+	}
+	_, carDir := chunkTestFiles(t, dir, files, 1000)
+
+	// the archive with its entries sorted by name, as tar --sort=name
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	names := []string{"b/", "b/c/", "e/"}
+	for p := range files {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			hdr.Mode, hdr.Typeflag = 0755, tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var zstBuf bytes.Buffer
+	zw, err := zstd.NewWriter(&zstBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(tarBuf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		format string
+		data   []byte
+	}{
+		{ArchiveTar, tarBuf.Bytes()},
+		{ArchiveTarZstd, zstBuf.Bytes()},
+	} {
+		tarCarDir := filepath.Join(dir, c.format)
+		if err := os.MkdirAll(tarCarDir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ChunkTar(ctx, 1000, bytes.NewReader(c.data), c.format, tarCarDir, "test", CSVCallback(tarCarDir), WithFileIndex()); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{ManifestName, FileIndexName} {
+			want, err := ioutil.ReadFile(filepath.Join(carDir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(tarCarDir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("%s: %s differs from the one of the extracted tree:\n%s\nwant:\n%s", c.format, name, got, want)
+			}
+		}
+	}
+}
@@ -2,8 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/filedrive-team/go-graphsplit"
 	"github.com/filedrive-team/go-graphsplit/dataset"
@@ -21,6 +29,15 @@ func main() {
 		restoreCmd,
 		commpCmd,
 		importDatasetCmd,
+		verifyCmd,
+		lsCmd,
+		catCmd,
+		serveCmd,
+		extractCmd,
+		resliceCmd,
+		carsplitCmd,
+		inventoryCmd,
+		regenerateCmd,
 	}
 
 	app := &cli.App{
@@ -38,7 +55,7 @@ func main() {
 var chunkCmd = &cli.Command{
 	Name:  "chunk",
 	Usage: "Generate CAR files of the specified size",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.Uint64Flag{
 			Name:  "slice-size",
 			Value: 17179869184, // 16G
@@ -57,7 +74,7 @@ var chunkCmd = &cli.Command{
 		&cli.StringFlag{
 			Name:     "car-dir",
 			Required: true,
-			Usage:    "specify output CAR directory",
+			Usage:    "specify output CAR directory, or s3://bucket/prefix to upload the CAR files and manifests to",
 		},
 		&cli.StringFlag{
 			Name:  "parent-path",
@@ -84,14 +101,83 @@ var chunkCmd = &cli.Command{
 			Value: false,
 			Usage: "add padding to carfile in order to convert it to piece file",
 		},
-	},
+		&cli.BoolFlag{
+			Name:  "save-index",
+			Value: false,
+			Usage: "create a fileindex.csv in car-dir to save the slice, byte range and cid of every file",
+		},
+		&cli.StringSliceFlag{
+			Name:  "checksum",
+			Usage: "compute checksums of every source file while reading it, could be sha256, md5 or blake3",
+		},
+		&cli.StringFlag{
+			Name:  "input-format",
+			Value: "dir",
+			Usage: "specify the input format, could be dir, tar or tar.zst; - reads the archive from stdin",
+		},
+		&cli.StringFlag{
+			Name:  "s3-endpoint",
+			Value: "https://s3.amazonaws.com",
+			Usage: "specify the endpoint of the object store of s3://bucket/prefix paths, with the keys in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY",
+		},
+		&cli.StringFlag{
+			Name:  "s3-region",
+			Value: "us-east-1",
+			Usage: "specify the region of the object store",
+		},
+		&cli.IntFlag{
+			Name:  "walkers",
+			Value: graphsplit.DefaultWalkers,
+			Usage: "specify how many goroutines read directories at once when walking the target path",
+		},
+		&cli.StringFlag{
+			Name:  "inventory",
+			Usage: "read the files to chunk from the inventory file, which is saved by walking the target path once if it does not exist",
+		},
+		&cli.StringFlag{
+			Name:  "sort",
+			Value: graphsplit.SortByPath,
+			Usage: "specify the order files are packed into slices in, could be path, size or mtime",
+		},
+		&cli.StringFlag{
+			Name:  "on-change",
+			Value: graphsplit.ChangedFail,
+			Usage: "specify what to do with a source file changing while it is read, could be fail, retry or skip",
+		},
+		&cli.IntFlag{
+			Name:  "change-retries",
+			Value: graphsplit.DefaultChangedRetries,
+			Usage: "specify how many times a changed file is read again with --on-change=retry",
+		},
+		&cli.StringFlag{
+			Name:  "special",
+			Value: graphsplit.SpecialSkip,
+			Usage: "specify what to do with devices, FIFOs and sockets, could be skip or fail",
+		},
+		&cli.BoolFlag{
+			Name:  "sparse",
+			Value: false,
+			Usage: "look for the holes of sparse files and give zeros for them without reading them",
+		},
+		&cli.BoolFlag{
+			Name:  "align-cuts",
+			Value: false,
+			Usage: "cut split files at multiples of the UnixFS chunk size, so their parts share leaves with the whole file",
+		},
+	}, filterFlags...),
 	Action: func(c *cli.Context) error {
 		ctx := context.Background()
 		parallel := c.Uint("parallel")
 		sliceSize := c.Uint64("slice-size")
 		parentPath := c.String("parent-path")
 		carDir := c.String("car-dir")
-		if !graphsplit.ExistDir(carDir) {
+		var sink graphsplit.Sink
+		if strings.HasPrefix(carDir, "s3://") {
+			var err error
+			if sink, err = graphsplit.OpenS3Sink(s3Config(c, carDir)); err != nil {
+				return err
+			}
+		} else if !graphsplit.ExistDir(carDir) {
 			return xerrors.Errorf("Unexpected! The path of car-dir does not exist")
 		}
 		graphName := c.String("graph-name")
@@ -101,15 +187,201 @@ var chunkCmd = &cli.Command{
 
 		targetPath := c.Args().First()
 		var cb graphsplit.GraphBuildCallback
-		if c.Bool("calc-commp") {
+		var opts []graphsplit.ChunkOption
+		if sink != nil {
+			if c.Bool("calc-commp") {
+				sink = graphsplit.CommPSink(sink, c.Bool("rename"), c.Bool("add-padding"))
+			}
+			if c.Bool("calc-commp") || c.Bool("save-manifest") {
+				cb = graphsplit.SinkCallback(sink)
+			} else {
+				cb = graphsplit.KeepErrCallback()
+			}
+			opts = append(opts, graphsplit.WithSink(sink))
+		} else if c.Bool("calc-commp") {
 			cb = graphsplit.CommPCallback(carDir, c.Bool("rename"), c.Bool("add-padding"))
 		} else if c.Bool("save-manifest") {
 			cb = graphsplit.CSVCallback(carDir)
 		} else {
 			cb = graphsplit.ErrCallback()
 		}
-		return graphsplit.Chunk(ctx, int64(sliceSize), parentPath, targetPath, carDir, graphName, int(parallel), cb)
+		if c.Bool("save-index") {
+			opts = append(opts, graphsplit.WithFileIndex())
+		}
+		if checksums := c.StringSlice("checksum"); len(checksums) > 0 {
+			opts = append(opts, graphsplit.WithChecksums(checksums...))
+		}
+		filter, err := fileFilter(c)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, graphsplit.WithWalkers(c.Int("walkers")), graphsplit.WithSortOrder(c.String("sort")), graphsplit.WithFilter(filter),
+			graphsplit.WithChangedPolicy(c.String("on-change"), c.Int("change-retries")), graphsplit.WithSpecialFiles(c.String("special")))
+		if c.Bool("sparse") {
+			opts = append(opts, graphsplit.WithSparseFiles())
+		}
+		if c.Bool("align-cuts") {
+			opts = append(opts, graphsplit.WithAlignedCuts())
+		}
+		if inventory := c.String("inventory"); inventory != "" {
+			// recorded for regenerate
+			inventory, err := filepath.Abs(inventory)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, graphsplit.WithInventory(inventory))
+		}
+		err = chunk(ctx, c, int64(sliceSize), targetPath, parentPath, carDir, graphName, int(parallel), cb, opts)
+		if sink != nil {
+			// errors are returned rather than exiting, so this runs
+			if cerr := sink.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	},
+}
+
+// chunk chunks the target path of the chunk command, read as the flags tell
+func chunk(ctx context.Context, c *cli.Context, sliceSize int64, targetPath, parentPath, carDir, graphName string, parallel int, cb graphsplit.GraphBuildCallback, opts []graphsplit.ChunkOption) error {
+	format := c.String("input-format")
+	if strings.HasPrefix(targetPath, "s3://") {
+		format = inputFormatS3
+	}
+	if format == "dir" {
+		return graphsplit.Chunk(ctx, sliceSize, parentPath, targetPath, carDir, graphName, parallel, cb, opts...)
+	}
+	source := targetPath
+	if format != inputFormatS3 && targetPath != "-" {
+		abs, err := filepath.Abs(targetPath)
+		if err != nil {
+			return err
+		}
+		source = abs
+	}
+	opts = append(opts, graphsplit.WithSource(source, format))
+	if format == graphsplit.ArchiveTarZstd || targetPath == "-" {
+		var r io.Reader = os.Stdin
+		if targetPath != "-" {
+			f, err := os.Open(targetPath)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		return graphsplit.ChunkTar(ctx, sliceSize, r, format, carDir, graphName, cb, opts...)
+	}
+	// a tar file and the objects of a bucket are read at random, in parallel
+	fsys, closer, err := openSource(c, format, source)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	return graphsplit.ChunkFS(ctx, sliceSize, fsys, ".", carDir, graphName, parallel, cb, opts...)
+}
+
+// the input format recorded for the objects of an s3://bucket/prefix
+const inputFormatS3 = "s3"
+
+// openSource opens the source of a chunk run as a file system: the
+// directory of dir, a tar file or the objects of an s3://bucket/prefix
+func openSource(c *cli.Context, format, source string) (fs.FS, io.Closer, error) {
+	switch format {
+	case "dir":
+		return os.DirFS(source), io.NopCloser(nil), nil
+	case inputFormatS3:
+		fsys, err := graphsplit.OpenS3FS(s3Config(c, source))
+		return fsys, io.NopCloser(nil), err
+	case graphsplit.ArchiveTar:
+		if source == "-" {
+			break
+		}
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		fsys, err := graphsplit.OpenTarFS(f, info.Size())
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return fsys, f, nil
+	}
+	return nil, nil, xerrors.Errorf("the %s source %s is read once, in order, and cannot be read again", format, source)
+}
+
+// filterFlags select the files to chunk, see fileFilter
+var filterFlags = []cli.Flag{
+	&cli.StringSliceFlag{
+		Name:  "include",
+		Usage: "only chunk the files matching the glob pattern, or the regular expression after " + graphsplit.RegexPrefix + ", repeat for several",
+	},
+	&cli.StringSliceFlag{
+		Name:  "exclude",
+		Usage: "skip the files and directories matching the glob pattern, or the regular expression after " + graphsplit.RegexPrefix + ", repeat for several",
+	},
+	&cli.StringSliceFlag{
+		Name:  "exclude-from",
+		Usage: "skip the files and directories ignored by the file in gitignore syntax, repeat for several",
 	},
+	&cli.StringFlag{
+		Name:  "hidden",
+		Value: "exclude",
+		Usage: "include or exclude hidden files and directories, whose names start with a dot",
+	},
+	&cli.Int64Flag{
+		Name:  "min-size",
+		Usage: "skip the files smaller than this many bytes",
+	},
+	&cli.Int64Flag{
+		Name:  "max-size",
+		Usage: "skip the files larger than this many bytes, if set",
+	},
+}
+
+// fileFilter gives the files to chunk selected by the flags
+func fileFilter(c *cli.Context) (graphsplit.FileFilter, error) {
+	filter := graphsplit.FileFilter{
+		Include: c.StringSlice("include"),
+		Exclude: c.StringSlice("exclude"),
+		MinSize: c.Int64("min-size"),
+		MaxSize: c.Int64("max-size"),
+	}
+	switch c.String("hidden") {
+	case "include":
+		filter.Hidden = true
+	case "exclude":
+	default:
+		return filter, xerrors.Errorf("Unexpected! --hidden could be include or exclude, got %s", c.String("hidden"))
+	}
+	for _, p := range c.StringSlice("exclude-from") {
+		lines, err := graphsplit.ReadIgnoreFile(p)
+		if err != nil {
+			return filter, err
+		}
+		filter.Ignore = append(filter.Ignore, lines...)
+	}
+	return filter, nil
+}
+
+// s3Config locates the s3://bucket/prefix of target in the object store of
+// the flags
+func s3Config(c *cli.Context, target string) graphsplit.S3Config {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(target, "s3://"), "/")
+	return graphsplit.S3Config{
+		Endpoint:  c.String("s3-endpoint"),
+		Region:    c.String("s3-region"),
+		Bucket:    bucket,
+		Prefix:    prefix,
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
 }
 
 var restoreCmd = &cli.Command{
@@ -122,15 +394,55 @@ var restoreCmd = &cli.Command{
 			Usage:    "specify source car path, directory or file",
 		},
 		&cli.StringFlag{
-			Name:     "output-dir",
-			Required: true,
-			Usage:    "specify output directory",
+			Name:  "output-dir",
+			Usage: "specify output directory",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Value: "dir",
+			Usage: "specify output format, could be dir, tar, tar.zst or zip",
+		},
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "specify output archive file when format is not dir, - for stdout",
 		},
 		&cli.IntFlag{
 			Name:  "parallel",
 			Value: 4,
 			Usage: "specify how many number of goroutines runs when generate file node",
 		},
+		&cli.StringSliceFlag{
+			Name:  "path",
+			Usage: "only restore the files under the path inside the dataset, globs are allowed, e.g. /sub/dir/*.txt",
+		},
+		&cli.BoolFlag{
+			Name:  "verify-checksums",
+			Value: false,
+			Usage: "verify restored files against the SHA256SUMS-style files saved in car-path",
+		},
+		&cli.StringSliceFlag{
+			Name:  "checksum-file",
+			Usage: "specify the checksum files to verify against, instead of looking for them in car-path",
+		},
+		&cli.StringFlag{
+			Name:  "journal",
+			Usage: "specify the journal file keeping the progress of the restore (default: output-dir/" + graphsplit.RestoreJournalName + ")",
+		},
+		&cli.IntFlag{
+			Name:  "retries",
+			Value: 3,
+			Usage: "specify how many times to retry a CAR file failing on transient file system errors, such as EIO or timeouts",
+		},
+		&cli.StringFlag{
+			Name:  "on-conflict",
+			Value: graphsplit.ConflictFail,
+			Usage: "specify what to do with a path that has different files in two slices, or in a slice and output-dir: fail, keep-first or rename",
+		},
+		&cli.BoolFlag{
+			Name:  "dump-raw",
+			Value: false,
+			Usage: "write the blocks of roots that are not UnixFS to output-dir/<root cid>.blocks",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		parallel := c.Int("parallel")
@@ -140,8 +452,89 @@ var restoreCmd = &cli.Command{
 			return xerrors.Errorf("Unexpected! Parallel has to be greater than 0")
 		}
 
-		graphsplit.CarTo(carPath, outputDir, parallel)
-		graphsplit.Merge(outputDir, parallel)
+		if format := c.String("format"); format != "dir" {
+			output := c.String("output")
+			if output == "" {
+				return xerrors.Errorf("Unexpected! output has to be set when format is %s", format)
+			}
+			var w io.Writer = os.Stdout
+			if output != "-" {
+				f, err := os.Create(output)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				w = f
+			}
+			if err := graphsplit.RestoreArchive(context.Background(), carPath, w, format, c.StringSlice("path")); err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "completed!")
+			return nil
+		}
+		if outputDir == "" {
+			return xerrors.Errorf("Unexpected! output-dir has to be set when format is dir")
+		}
+
+		journal := c.String("journal")
+		if journal == "" {
+			journal = filepath.Join(outputDir, graphsplit.RestoreJournalName)
+		}
+		opts := []graphsplit.RestoreOption{
+			graphsplit.WithJournal(journal),
+			graphsplit.WithRetries(c.Int("retries")),
+			graphsplit.WithConflictPolicy(c.String("on-conflict")),
+		}
+		if c.Bool("dump-raw") {
+			opts = append(opts, graphsplit.WithRawBlocks())
+		}
+		res, err := graphsplit.RestorePaths(context.Background(), carPath, outputDir, c.StringSlice("path"), parallel, opts...)
+		if err != nil {
+			return err
+		}
+		for _, desc := range res.NonUnixFS {
+			fmt.Println(desc)
+		}
+		for _, desc := range res.Conflicts {
+			fmt.Println("conflict at", desc)
+		}
+		fmt.Printf("%d CAR files restored, %d skipped as restored already, %d files found in place, %d failed\n",
+			len(res.Restored), len(res.Skipped), res.SkippedFiles, len(res.Failed))
+		var failed []string
+		if err := res.Err(); err != nil {
+			failed = append(failed, err.Error())
+		}
+		carDir := carPath
+		if !graphsplit.ExistDir(carDir) {
+			carDir = filepath.Dir(carPath)
+		}
+		if err := graphsplit.MergeParts(outputDir, carDir, parallel); err != nil {
+			failed = append(failed, err.Error())
+		}
+		if len(failed) > 0 {
+			return xerrors.New(strings.Join(failed, "\n"))
+		}
+
+		if c.Bool("verify-checksums") || len(c.StringSlice("checksum-file")) > 0 {
+			sumsPaths := c.StringSlice("checksum-file")
+			if len(sumsPaths) == 0 {
+				sumsPaths = graphsplit.FindChecksumFiles(carDir)
+			}
+			if len(sumsPaths) == 0 {
+				return xerrors.Errorf("no checksum file found in %s", carPath)
+			}
+			for _, sumsPath := range sumsPaths {
+				res, err := graphsplit.VerifyChecksums(sumsPath, outputDir, c.StringSlice("path"))
+				if err != nil {
+					return err
+				}
+				failed = append(failed, res...)
+			}
+			if len(failed) > 0 {
+				return xerrors.Errorf("%d restored files failed checksum verification", len(failed))
+			}
+			fmt.Println("checksums verified")
+		}
 
 		fmt.Println("completed!")
 		return nil
@@ -180,13 +573,13 @@ var commpCmd = &cli.Command{
 var importDatasetCmd = &cli.Command{
 	Name:  "import-dataset",
 	Usage: "import files from the specified dataset",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:     "dsmongo",
 			Required: true,
 			Usage:    "specify the mongodb connection",
 		},
-	},
+	}, filterFlags...),
 	Action: func(c *cli.Context) error {
 		ctx := context.Background()
 
@@ -194,7 +587,490 @@ var importDatasetCmd = &cli.Command{
 		if !graphsplit.ExistDir(targetPath) {
 			return xerrors.Errorf("Unexpected! The path to dataset does not exist")
 		}
+		filter, err := fileFilter(c)
+		if err != nil {
+			return err
+		}
+
+		return dataset.Import(ctx, targetPath, c.String("dsmongo"), filter)
+	},
+}
+
+var verifyCmd = &cli.Command{
+	Name:  "verify",
+	Usage: "Verify CAR files against the manifest and the source data",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "car-dir",
+			Required: true,
+			Usage:    "specify the CAR directory to verify",
+		},
+		&cli.BoolFlag{
+			Name:  "calc-commp",
+			Value: false,
+			Usage: "recompute pieceCID and pieceSize and compare them to manifest.csv",
+		},
+		&cli.StringFlag{
+			Name:  "source",
+			Value: "",
+			Usage: "specify the parent path of the source data, to read the files in fileindex.csv again and compare their cids",
+		},
+		&cli.IntFlag{
+			Name:  "parallel",
+			Value: 2,
+			Usage: "specify how many number of CAR files are verified at the same time",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+		carDir := c.String("car-dir")
+		if !graphsplit.ExistDir(carDir) {
+			return xerrors.Errorf("Unexpected! The path of car-dir does not exist")
+		}
+
+		reports, err := graphsplit.Verify(ctx, carDir, c.String("source"), c.Bool("calc-commp"), c.Int("parallel"))
+		if err != nil {
+			return err
+		}
+		failed := 0
+		for _, r := range reports {
+			status := "PASS"
+			if !r.Passed() {
+				status = "FAIL"
+				failed++
+			}
+			carFile := "-"
+			if r.CarPath != "" {
+				carFile = filepath.Base(r.CarPath)
+			}
+			fmt.Printf("%s  %s  %s  %s  blocks: %d\n", status, r.Filename, r.PayloadCid, carFile, r.Blocks)
+			for _, e := range r.Errors {
+				fmt.Printf("    %s\n", e)
+			}
+		}
+		fmt.Printf("%d slices verified, %d failed\n", len(reports), failed)
+		if failed > 0 {
+			return xerrors.Errorf("%d slices failed verification", failed)
+		}
+		return nil
+	},
+}
+
+var lsCmd = &cli.Command{
+	Name:      "ls",
+	Usage:     "List the files in a CAR file, or in the CAR files of a car-dir",
+	ArgsUsage: "<car-path> [path]",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "recursive",
+			Aliases: []string{"R"},
+			Usage:   "list the directories recursively",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the entries as json",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+		if c.Args().Len() < 1 || c.Args().Len() > 2 {
+			return xerrors.Errorf("expect a car-path and an optional path")
+		}
+
+		entries, err := graphsplit.List(ctx, c.Args().Get(0), c.Args().Get(1), c.Bool("recursive"))
+		if err != nil {
+			return err
+		}
+		if c.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(entries)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, e := range entries {
+			switch {
+			case e.Type == graphsplit.EntryDir:
+				fmt.Fprintf(tw, "-\t-\t%s/\n", e.Path)
+			case e.Type == graphsplit.EntrySymlink:
+				fmt.Fprintf(tw, "-\t-\t%s -> %s\n", e.Path, e.Target)
+			case e.Cid != "":
+				fmt.Fprintf(tw, "%d\t%s\t%s\n", e.Size, e.Cid, e.Path)
+			default:
+				// a split file, of which the parts found are listed
+				parts := make([]string, 0, len(e.Parts))
+				for _, p := range e.Parts {
+					parts = append(parts, strconv.Itoa(p.Index))
+				}
+				fmt.Fprintf(tw, "%d\t-\t%s (parts %s)\n", e.Size, e.Path, strings.Join(parts, ","))
+			}
+		}
+		return tw.Flush()
+	},
+}
+
+var catCmd = &cli.Command{
+	Name:      "cat",
+	Usage:     "Write a file in a CAR file, or in the CAR files of a car-dir, to stdout",
+	ArgsUsage: "<car-path> <path>",
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+		if c.Args().Len() != 2 {
+			return xerrors.Errorf("expect a car-path and a path")
+		}
+
+		return graphsplit.Cat(ctx, c.Args().Get(0), c.Args().Get(1), os.Stdout)
+	},
+}
+
+var serveCmd = &cli.Command{
+	Name:  "serve",
+	Usage: "Serve the dataset in a CAR directory over HTTP, like a trustless IPFS gateway",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "car-dir",
+			Required: true,
+			Usage:    "specify the CAR directory to serve",
+		},
+		&cli.StringFlag{
+			Name:  "listen",
+			Value: "127.0.0.1:8080",
+			Usage: "specify the address to listen on",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		carDir := c.String("car-dir")
+		if !graphsplit.ExistDir(carDir) {
+			return xerrors.Errorf("Unexpected! The path of car-dir does not exist")
+		}
 
-		return dataset.Import(ctx, targetPath, c.String("dsmongo"))
+		gw, err := graphsplit.NewGateway(carDir)
+		if err != nil {
+			return err
+		}
+		defer gw.Close()
+		log.Infof("serving %s on http://%s", carDir, c.String("listen"))
+		return http.ListenAndServe(c.String("listen"), gw)
+	},
+}
+
+var extractCmd = &cli.Command{
+	Name:  "extract",
+	Usage: "Write a CAR file of a file or directory in a CAR file",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "car",
+			Required: true,
+			Usage:    "specify the CAR file to extract from",
+		},
+		&cli.StringFlag{
+			Name:     "path",
+			Required: true,
+			Usage:    "specify the path of the file or directory in the CAR file",
+		},
+		&cli.StringFlag{
+			Name:     "out",
+			Required: true,
+			Usage:    "specify the CAR file to write, - for stdout",
+		},
+		&cli.BoolFlag{
+			Name:  "with-path",
+			Value: false,
+			Usage: "root the CAR file at the root of the slice and keep the blocks on the path, so that it can be checked against the payload cid",
+		},
+		&cli.IntFlag{
+			Name:  "car-version",
+			Value: 1,
+			Usage: "specify the version of the CAR file to write, 1 or 2 for a CARv2 with an index of its blocks",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+		out := c.String("out")
+		var w io.Writer = os.Stdout
+		if out != "-" {
+			f, err := os.Create(out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+
+		root, err := graphsplit.Extract(ctx, c.String("car"), c.String("path"), w, c.Bool("with-path"), c.Int("car-version"))
+		if err != nil {
+			if out != "-" {
+				os.Remove(out)
+			}
+			return err
+		}
+		log.Infof("extracted %s with root %s", c.String("path"), root)
+		return nil
+	},
+}
+
+var resliceCmd = &cli.Command{
+	Name:  "reslice",
+	Usage: "Repack the CAR files of a dataset into slices of another size, without the source data",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "car-dir",
+			Required: true,
+			Usage:    "specify the CAR directory to read, with its manifest.csv and fileindex.csv",
+		},
+		&cli.StringFlag{
+			Name:     "out-dir",
+			Required: true,
+			Usage:    "specify the directory to write the new CAR files to",
+		},
+		&cli.Uint64Flag{
+			Name:  "slice-size",
+			Value: 34359738368, // 32G
+			Usage: "specify the new chunk piece size",
+		},
+		&cli.StringFlag{
+			Name:  "strategy",
+			Value: graphsplit.ResliceKeepParts,
+			Usage: "specify how to pack the files: keep-parts keeps every file and part so their cids stay the same, fill fills every slice like chunk does and chunks again the files cut differently",
+		},
+		&cli.StringFlag{
+			Name:     "graph-name",
+			Required: true,
+			Usage:    "specify graph name of the new slices",
+		},
+		&cli.BoolFlag{
+			Name:  "calc-commp",
+			Value: false,
+			Usage: "save the pieceCID and pieceSize of every new slice in manifest.csv",
+		},
+		&cli.BoolFlag{
+			Name:  "rename",
+			Value: false,
+			Usage: "rename carfile to piece",
+		},
+		&cli.BoolFlag{
+			Name:  "add-padding",
+			Value: false,
+			Usage: "add padding to carfile in order to convert it to piece file",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+		carDir := c.String("car-dir")
+		outDir := c.String("out-dir")
+		if !graphsplit.ExistDir(carDir) {
+			return xerrors.Errorf("Unexpected! The path of car-dir does not exist")
+		}
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return err
+		}
+
+		var cb graphsplit.GraphBuildCallback
+		if c.Bool("calc-commp") {
+			cb = graphsplit.CommPCallback(outDir, c.Bool("rename"), c.Bool("add-padding"))
+		} else {
+			cb = graphsplit.CSVCallback(outDir)
+		}
+		return graphsplit.Reslice(ctx, carDir, outDir, int64(c.Uint64("slice-size")), c.String("strategy"), c.String("graph-name"), cb)
+	},
+}
+
+var carsplitCmd = &cli.Command{
+	Name:      "carsplit",
+	Usage:     "Split the DAG of a CAR file into CAR files of the specified size",
+	ArgsUsage: "<car-file>",
+	Flags: []cli.Flag{
+		&cli.Uint64Flag{
+			Name:  "slice-size",
+			Value: 17179869184, // 16G
+			Usage: "specify the most bytes of every CAR file",
+		},
+		&cli.StringFlag{
+			Name:     "graph-name",
+			Required: true,
+			Usage:    "specify graph name",
+		},
+		&cli.StringFlag{
+			Name:     "car-dir",
+			Required: true,
+			Usage:    "specify output CAR directory",
+		},
+		&cli.BoolFlag{
+			Name:  "save-manifest",
+			Value: true,
+			Usage: "create a manifest.csv in car-dir to save mapping of data-cids and slice names",
+		},
+		&cli.BoolFlag{
+			Name:  "calc-commp",
+			Value: false,
+			Usage: "create a manifest.csv in car-dir to save mapping of data-cids, slice names, piece-cids and piece-sizes",
+		},
+		&cli.BoolFlag{
+			Name:  "rename",
+			Value: false,
+			Usage: "rename carfile to piece",
+		},
+		&cli.BoolFlag{
+			Name:  "add-padding",
+			Value: false,
+			Usage: "add padding to carfile in order to convert it to piece file",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+		if c.Args().Len() != 1 {
+			return xerrors.Errorf("Unexpected! Give the CAR file to split")
+		}
+		carDir := c.String("car-dir")
+		if !graphsplit.ExistDir(carDir) {
+			return xerrors.Errorf("Unexpected! The path of car-dir does not exist")
+		}
+
+		var cb graphsplit.GraphBuildCallback
+		if c.Bool("calc-commp") {
+			cb = graphsplit.CommPCallback(carDir, c.Bool("rename"), c.Bool("add-padding"))
+		} else if c.Bool("save-manifest") {
+			cb = graphsplit.CSVCallback(carDir)
+		} else {
+			cb = graphsplit.ErrCallback()
+		}
+		return graphsplit.CarSplit(ctx, c.Args().First(), int64(c.Uint64("slice-size")), carDir, c.String("graph-name"), cb)
+	},
+}
+
+var inventoryCmd = &cli.Command{
+	Name:      "inventory",
+	Usage:     "Walk the target path once and save its files to an inventory file, for chunk --inventory",
+	ArgsUsage: "<target-path>",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "out",
+			Required: true,
+			Usage:    "specify the inventory file to save",
+		},
+		&cli.StringFlag{
+			Name:  "parent-path",
+			Value: "",
+			Usage: "specify graph parent path, the same as of chunk",
+		},
+		&cli.IntFlag{
+			Name:  "walkers",
+			Value: graphsplit.DefaultWalkers,
+			Usage: "specify how many goroutines read directories at once",
+		},
+		&cli.StringFlag{
+			Name:  "s3-endpoint",
+			Value: "https://s3.amazonaws.com",
+			Usage: "specify the endpoint of the object store of s3://bucket/prefix paths, with the keys in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY",
+		},
+		&cli.StringFlag{
+			Name:  "s3-region",
+			Value: "us-east-1",
+			Usage: "specify the region of the object store",
+		},
+	}, filterFlags...),
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() != 1 {
+			return xerrors.Errorf("Unexpected! Give the target path to walk")
+		}
+		targetPath := c.Args().First()
+		var fsys fs.FS
+		root := "."
+		if strings.HasPrefix(targetPath, "s3://") {
+			var err error
+			if fsys, err = graphsplit.OpenS3FS(s3Config(c, targetPath)); err != nil {
+				return err
+			}
+		} else {
+			parentPath := c.String("parent-path")
+			if parentPath == "" {
+				parentPath = targetPath
+			}
+			var err error
+			if fsys, root, err = graphsplit.LocalSource(parentPath, targetPath); err != nil {
+				return err
+			}
+		}
+		filter, err := fileFilter(c)
+		if err != nil {
+			return err
+		}
+		count, totalSize, err := graphsplit.SaveInventory(fsys, root, c.Int("walkers"), filter, c.String("out"))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d files, %d bytes\n", count, totalSize)
+		return nil
+	},
+}
+
+var regenerateCmd = &cli.Command{
+	Name:      "regenerate",
+	Usage:     "Rebuild the CAR file of a slice from its source, as chunk built it",
+	ArgsUsage: "<payload-cid>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "car-dir",
+			Required: true,
+			Usage:    "specify the car-dir of chunk, with the " + graphsplit.ParamsName + " of the slice",
+		},
+		&cli.StringFlag{
+			Name:     "out-dir",
+			Required: true,
+			Usage:    "specify the directory to write the CAR file to",
+		},
+		&cli.StringFlag{
+			Name:  "source",
+			Usage: "specify the source if it has moved, instead of the one chunk recorded",
+		},
+		&cli.StringFlag{
+			Name:  "input-format",
+			Usage: "specify the input format of --source, such as tar for a tar.zst chunked from stdin and decompressed since",
+		},
+		&cli.UintFlag{
+			Name:  "parallel",
+			Value: 2,
+			Usage: "specify how many number of goroutines runs when generate file node",
+		},
+		&cli.StringFlag{
+			Name:  "s3-endpoint",
+			Value: "https://s3.amazonaws.com",
+			Usage: "specify the endpoint of the object store of s3://bucket/prefix paths, with the keys in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY",
+		},
+		&cli.StringFlag{
+			Name:  "s3-region",
+			Value: "us-east-1",
+			Usage: "specify the region of the object store",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+		if c.Args().Len() != 1 {
+			return xerrors.Errorf("Unexpected! Give the payload cid of the slice")
+		}
+		payloadCid := c.Args().First()
+		outDir := c.String("out-dir")
+		if !graphsplit.ExistDir(outDir) {
+			return xerrors.Errorf("Unexpected! The path of out-dir does not exist")
+		}
+		params, slice, err := graphsplit.FindChunkParams(filepath.Join(c.String("car-dir"), graphsplit.ParamsName), payloadCid)
+		if err != nil {
+			return err
+		}
+		if source := c.String("source"); source != "" {
+			params.Source = source
+		}
+		if format := c.String("input-format"); format != "" {
+			params.InputFormat = format
+		}
+		fsys, closer, err := openSource(c, params.InputFormat, params.Source)
+		if err != nil {
+			return err
+		}
+		defer closer.Close()
+		if err := graphsplit.Regenerate(ctx, params, fsys, payloadCid, outDir, int(c.Uint("parallel"))); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s\n", slice.Name, filepath.Join(outDir, payloadCid+".car"))
+		return nil
 	},
 }
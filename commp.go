@@ -23,9 +23,9 @@ type CommPRet struct {
 	Size        abi.UnpaddedPieceSize
 }
 
-// almost copy paste from https://github.com/filecoin-project/lotus/node/impl/client/client.go#L749-L770
-func CalcCommP(ctx context.Context, inpath string, rename, addPadding bool) (*CommPRet, error) {
-	dir, _ := path.Split(inpath)
+// generatePieceCID computes the commP of the size bytes read from r, padded
+// into a piece
+func generatePieceCID(r io.Reader, size uint64) (cid.Cid, abi.UnpaddedPieceSize, error) {
 	// Hard-code the sector type to 32GiBV1_1, because:
 	// - ffiwrapper.GeneratePieceCIDFromFile requires a RegisteredSealProof
 	// - commP itself is sector-size independent, with rather low probability of that changing
@@ -36,6 +36,18 @@ func CalcCommP(ctx context.Context, inpath string, rename, addPadding bool) (*Co
 	// "old style" commP, and thus will need to introduce a version switch or similar
 	arbitraryProofType := abi.RegisteredSealProof_StackedDrg32GiBV1_1
 
+	pieceReader, pieceSize := padreader.New(r, size)
+	commP, err := ffiwrapper.GeneratePieceCIDFromFile(arbitraryProofType, pieceReader, pieceSize)
+	if err != nil {
+		return cid.Undef, 0, xerrors.Errorf("computing commP failed: %w", err)
+	}
+	return commP, pieceSize, nil
+}
+
+// almost copy paste from https://github.com/filecoin-project/lotus/node/impl/client/client.go#L749-L770
+func CalcCommP(ctx context.Context, inpath string, rename, addPadding bool) (*CommPRet, error) {
+	dir, _ := path.Split(inpath)
+
 	st, err := os.Stat(inpath)
 	if err != nil {
 		return nil, err
@@ -46,7 +58,12 @@ func CalcCommP(ctx context.Context, inpath string, rename, addPadding bool) (*Co
 	}
 	payloadSize := st.Size()
 
-	rdr, err := os.OpenFile(inpath, os.O_RDWR, 0644)
+	// only need to write when padding the car file
+	flag := os.O_RDONLY
+	if addPadding {
+		flag = os.O_RDWR
+	}
+	rdr, err := os.OpenFile(inpath, flag, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -67,10 +84,9 @@ func CalcCommP(ctx context.Context, inpath string, rename, addPadding bool) (*Co
 		return nil, xerrors.Errorf("seek to start: %w", err)
 	}
 
-	pieceReader, pieceSize := padreader.New(rdr, uint64(carSize))
-	commP, err := ffiwrapper.GeneratePieceCIDFromFile(arbitraryProofType, pieceReader, pieceSize)
+	commP, pieceSize, err := generatePieceCID(rdr, uint64(carSize))
 	if err != nil {
-		return nil, xerrors.Errorf("computing commP failed: %w", err)
+		return nil, err
 	}
 
 	if padreader.PaddedSize(uint64(payloadSize)) != pieceSize {
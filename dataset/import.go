@@ -21,7 +21,10 @@ import (
 
 var log = logging.Logger("graphsplit/dataset")
 
-func Import(ctx context.Context, target, mongouri string) error {
+// Import imports the files under target selected by filter into the
+// datastore of mongouri, recording them in the record.json of target so
+// that a later import skips them
+func Import(ctx context.Context, target, mongouri string, filter graphsplit.FileFilter) error {
 	recordPath := path.Join(target, record_json)
 	// check if record.json has data
 	records, err := readRecords(recordPath)
@@ -49,14 +52,16 @@ func Import(ctx context.Context, target, mongouri string) error {
 	}
 
 	// read files
-	allfiles, err := graphsplit.GetFileList([]string{target})
-	if err != nil {
+	var allfiles []graphsplit.Finfo
+	if err := graphsplit.WalkLocalFiles(target, filter, func(item graphsplit.Finfo) error {
+		allfiles = append(allfiles, item)
+		return nil
+	}); err != nil {
 		return err
 	}
 	totol_files := len(allfiles)
 	var ferr error
-	files := graphsplit.GetFileListAsync([]string{target})
-	for item := range files {
+	for _, item := range allfiles {
 		// ignore record_json
 		if item.Name == record_json {
 			totol_files -= 1
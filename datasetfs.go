@@ -0,0 +1,326 @@
+package graphsplit
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	pa "path"
+	"time"
+
+	files "github.com/ipfs/go-libipfs/files"
+	"golang.org/x/xerrors"
+)
+
+// most symlinks followed to open a path, as in Linux
+const maxSymlinks = 40
+
+// datasetFS is the dataset in a directory of slice CAR files as a read-only
+// file system
+type datasetFS struct {
+	ctx  context.Context
+	tree *datasetTree
+	// names of the entries in each directory, in lexical order
+	children map[string][]string
+}
+
+// OpenDataset presents the dataset in the CAR files of carDir as one
+// read-only file system, with split files joined back through the file
+// index or manifest next to the CAR files. The file system implements
+// fs.ReadDirFS and fs.StatFS, its files io.Seeker, and it implements
+// io.Closer to close the CAR files once done with. CAR files are opened as
+// the files in them are read, see openDatasetTree.
+//
+// Symlinks are followed as long as they point within the dataset.
+func OpenDataset(carDir string) (fs.FS, error) {
+	ctx := context.Background()
+	pf, err := newPathFilter(nil)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := loadDatasetTree(ctx, carDir, pf)
+	if err != nil {
+		return nil, err
+	}
+	return newDatasetFS(ctx, tree), nil
+}
+
+func newDatasetFS(ctx context.Context, tree *datasetTree) *datasetFS {
+	dfs := &datasetFS{ctx: ctx, tree: tree, children: make(map[string][]string)}
+	for _, p := range tree.Paths() {
+		dir := pa.Dir(p)
+		dfs.children[dir] = append(dfs.children[dir], pa.Base(p))
+	}
+	return dfs
+}
+
+func (dfs *datasetFS) Close() error {
+	return dfs.tree.Close()
+}
+
+// lookup finds the entry at name, following symlinks
+func (dfs *datasetFS) lookup(op, name string) (*treeEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	p := name
+	for i := 0; ; i++ {
+		if p == "." {
+			return &treeEntry{Path: ".", IsDir: true}, nil
+		}
+		e, ok := dfs.tree.entries[p]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if e.Symlink == "" {
+			return e, nil
+		}
+		if i == maxSymlinks {
+			return nil, &fs.PathError{Op: op, Path: name, Err: xerrors.New("too many levels of symbolic links")}
+		}
+		p = pa.Join(pa.Dir(p), e.Symlink)
+		if pa.IsAbs(e.Symlink) || !fs.ValidPath(p) {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+}
+
+func (dfs *datasetFS) Open(name string) (fs.File, error) {
+	e, err := dfs.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	info := &datasetFileInfo{name: pa.Base(name), e: e}
+	if e.IsDir {
+		return &datasetDir{fs: dfs, path: e.Path, info: info}, nil
+	}
+	return &datasetFile{ctx: dfs.ctx, e: e, info: info, part: -1}, nil
+}
+
+func (dfs *datasetFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := dfs.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return &datasetFileInfo{name: pa.Base(name), e: e}, nil
+}
+
+func (dfs *datasetFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := dfs.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: xerrors.New("not a directory")}
+	}
+	return dfs.dirEntries(e.Path), nil
+}
+
+// dirEntries lists the directory p, not following symlinks
+func (dfs *datasetFS) dirEntries(p string) []fs.DirEntry {
+	names := dfs.children[p]
+	entries := make([]fs.DirEntry, 0, len(names))
+	for _, name := range names {
+		e := dfs.tree.entries[pa.Join(p, name)]
+		entries = append(entries, fs.FileInfoToDirEntry(&datasetFileInfo{name: name, e: e}))
+	}
+	return entries
+}
+
+type datasetFileInfo struct {
+	name string
+	e    *treeEntry
+}
+
+func (fi *datasetFileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *datasetFileInfo) Size() int64 {
+	if fi.e.Symlink != "" {
+		return int64(len(fi.e.Symlink))
+	}
+	return fi.e.Size
+}
+
+func (fi *datasetFileInfo) Mode() fs.FileMode {
+	switch {
+	case fi.e.IsDir:
+		return fs.ModeDir | 0555
+	case fi.e.Symlink != "":
+		return fs.ModeSymlink | 0777
+	default:
+		return 0444
+	}
+}
+
+// ModTime is not kept in the CAR files
+func (fi *datasetFileInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (fi *datasetFileInfo) IsDir() bool {
+	return fi.e.IsDir
+}
+
+func (fi *datasetFileInfo) Sys() interface{} {
+	return nil
+}
+
+// datasetDir is an open directory of a datasetFS
+type datasetDir struct {
+	fs      *datasetFS
+	path    string
+	info    *datasetFileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *datasetDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *datasetDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: xerrors.New("is a directory")}
+}
+
+func (d *datasetDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		d.entries = d.fs.dirEntries(d.path)
+		d.read = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *datasetDir) Close() error {
+	return nil
+}
+
+// datasetFile is an open file of a datasetFS, reading across the parts of a
+// split file
+type datasetFile struct {
+	ctx  context.Context
+	e    *treeEntry
+	info *datasetFileInfo
+	off  int64
+	// the part open, its offset in the file and where it is at
+	part      int
+	partStart int64
+	cur       files.File
+	curOff    int64
+	closed    bool
+}
+
+func (f *datasetFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *datasetFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.e.Path, Err: fs.ErrClosed}
+	}
+	for {
+		if f.off >= f.e.Size {
+			return 0, io.EOF
+		}
+		if err := f.seekPart(); err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.e.Path, Err: err}
+		}
+		n, err := f.cur.Read(p)
+		f.off += int64(n)
+		f.curOff += int64(n)
+		if err == io.EOF {
+			// go on with the next part
+			if n > 0 {
+				return n, nil
+			}
+			if f.curOff < f.partStart+f.e.Parts[f.part].Size {
+				return 0, &fs.PathError{Op: "read", Path: f.e.Path, Err: io.ErrUnexpectedEOF}
+			}
+			continue
+		}
+		if err != nil {
+			return n, &fs.PathError{Op: "read", Path: f.e.Path, Err: err}
+		}
+		return n, nil
+	}
+}
+
+// seekPart opens the part holding the offset and moves to it
+func (f *datasetFile) seekPart() error {
+	if f.cur != nil && f.off >= f.partStart && f.off < f.partStart+f.e.Parts[f.part].Size {
+		if f.curOff != f.off {
+			if _, err := f.cur.Seek(f.off-f.partStart, io.SeekStart); err != nil {
+				return err
+			}
+			f.curOff = f.off
+		}
+		return nil
+	}
+	if f.cur != nil {
+		f.cur.Close()
+		f.cur = nil
+	}
+	start := int64(0)
+	for i, part := range f.e.Parts {
+		if f.off < start+part.Size {
+			cur, err := openPart(f.ctx, part)
+			if err != nil {
+				return err
+			}
+			if f.off > start {
+				if _, err := cur.Seek(f.off-start, io.SeekStart); err != nil {
+					cur.Close()
+					return err
+				}
+			}
+			f.part, f.partStart, f.cur, f.curOff = i, start, cur, f.off
+			return nil
+		}
+		start += part.Size
+	}
+	return io.EOF
+}
+
+func (f *datasetFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.e.Path, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.e.Size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.e.Path, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.e.Path, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *datasetFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.e.Path, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	if f.cur != nil {
+		return f.cur.Close()
+	}
+	return nil
+}
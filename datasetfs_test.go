@@ -0,0 +1,156 @@
+package graphsplit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestOpenDataset(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_dataset_fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	carDir := filepath.Join(dir, "cars")
+	big := bytes.Repeat([]byte("0123456789abcdef"), 40000)
+	files := map[string][]byte{
+		"top.txt":       []byte("hello"),
+		"sub/big.bin":   big,
+		"sub/small.txt": []byte("small"),
+	}
+	for p, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(src, p)), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, p), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(carDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	// big.bin is split over three slices
+	if err := Chunk(context.Background(), 250000, src, src, carDir, "test", 1, CSVCallback(carDir), WithFileIndex()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(n int) { maxOpenCars = n }(maxOpenCars)
+	maxOpenCars = 1
+	fsys, err := OpenDataset(carDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsys.(io.Closer).Close()
+	cars := fsys.(*datasetFS).tree.cars
+	// the file index is enough to list the dataset
+	if cars.opened != 0 {
+		t.Fatalf("expect no CAR file opened, %d are", cars.opened)
+	}
+
+	if err := fstest.TestFS(fsys, "top.txt", "sub/big.bin", "sub/small.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if len(cars.open) > 1 {
+		t.Fatalf("expect at most 1 CAR file kept open, %d are", len(cars.open))
+	}
+	for p, content := range files {
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Fatalf("content of %s does not match", p)
+		}
+	}
+
+	f, err := fsys.Open("sub/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// read across the cut between the first two parts
+	off := int64(249990)
+	if _, err := f.(io.Seeker).Seek(off, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, big[off:off+100]) {
+		t.Fatal("content after seek does not match")
+	}
+
+	// without the file index the graphs are walked
+	if err := os.Remove(filepath.Join(carDir, FileIndexName)); err != nil {
+		t.Fatal(err)
+	}
+	walked, err := OpenDataset(carDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer walked.(io.Closer).Close()
+	data, err := fs.ReadFile(walked, "sub/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, big) {
+		t.Fatal("content of sub/big.bin does not match without the file index")
+	}
+}
+
+func TestMissingLastPart(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_missing_part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// big.bin is split over three slices, the last one is lost
+	_, carDir := chunkTestFiles(t, dir, map[string]string{"big.bin": strings.Repeat("0123456789abcdef", 40000)}, 250000)
+	entries, err := ReadFileIndex(filepath.Join(carDir, FileIndexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := entries[0]
+	for _, e := range entries {
+		if e.Part > last.Part {
+			last = e
+		}
+	}
+	if last.Part != 2 {
+		t.Fatalf("expect 3 parts, got %+v", entries)
+	}
+	if err := os.Remove(filepath.Join(carDir, last.PayloadCid+".car")); err != nil {
+		t.Fatal(err)
+	}
+
+	if fsys, err := OpenDataset(carDir); err == nil || !strings.Contains(err.Error(), "missing") {
+		if fsys != nil {
+			fsys.(io.Closer).Close()
+		}
+		t.Fatalf("expect the missing part to fail, got %v", err)
+	}
+	g, err := NewGateway(carDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dataset/big.bin", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expect the truncated file left out, got %d", w.Code)
+	}
+}
@@ -0,0 +1,131 @@
+package graphsplit
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"golang.org/x/xerrors"
+)
+
+// Extract writes a CAR file of the file or directory at p in the CAR file at
+// carPath to w, and returns its root. p is the path as linked in the CAR
+// file, under the directory named after the root if the CAR file has more
+// than one, see rootDirNames.
+//
+// The CAR file is rooted at p, unless withPath is set. Then it is rooted at
+// the root of the slice and holds the blocks on the way to p as well, picked
+// by a path selector, so that p can be checked against the payload cid.
+//
+// version is 1 or 2. A CARv2 file wraps the CARv1 one with an index of its
+// blocks, see writeCarV2; the CARv1 file is written to a temporary file
+// first, as the header of a CARv2 file holds its size. The other commands
+// here read CARv1 only.
+func Extract(ctx context.Context, carPath, p string, w io.Writer, withPath bool, version int) (cid.Cid, error) {
+	switch version {
+	case 1:
+		return extractV1(ctx, carPath, p, w, withPath)
+	case 2:
+	default:
+		return cid.Undef, xerrors.Errorf("unsupported car version %d", version)
+	}
+	f, err := os.CreateTemp("", "graphsplit-extract-*.car")
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	root, err := extractV1(ctx, carPath, p, f, withPath)
+	if err != nil {
+		return cid.Undef, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return cid.Undef, err
+	}
+	if err := writeCarV2(w, f, size); err != nil {
+		return cid.Undef, err
+	}
+	return root, nil
+}
+
+func extractV1(ctx context.Context, carPath, p string, w io.Writer, withPath bool) (cid.Cid, error) {
+	cd, err := openCarDAG(ctx, carPath)
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer cd.Close()
+	if len(cd.Roots) == 0 {
+		return cid.Undef, xerrors.Errorf("%s has no root", carPath)
+	}
+
+	root := cd.Roots[0]
+	names := splitPath(p)
+	if len(cd.Roots) > 1 {
+		manifests, err := ReadManifest(filepath.Join(carDirOf(carPath), ManifestName))
+		if err != nil && !os.IsNotExist(err) {
+			return cid.Undef, err
+		}
+		if len(names) == 0 {
+			return cid.Undef, xerrors.Errorf("%s has %d roots, name one in the path", carPath, len(cd.Roots))
+		}
+		root = cid.Undef
+		for c, name := range rootDirNames(cd.Roots, manifests) {
+			if name == names[0] {
+				root = c
+			}
+		}
+		if !root.Defined() {
+			return cid.Undef, xerrors.Errorf("%s: %w", names[0], os.ErrNotExist)
+		}
+		names = names[1:]
+	}
+
+	nd, path, err := resolvePath(ctx, cd, root, names)
+	if err != nil {
+		return cid.Undef, err
+	}
+	dag := car.Dag{Root: nd.Cid(), Selector: allSelector()}
+	if withPath {
+		indexes, err := linkIndexes(ctx, cd, path)
+		if err != nil {
+			return cid.Undef, err
+		}
+		dag = car.Dag{Root: root, Selector: pathSelector(indexes)}
+	}
+	sc := car.NewSelectiveCar(ctx, cd.bs, []car.Dag{dag})
+	if err := sc.Write(w); err != nil {
+		return cid.Undef, err
+	}
+	return dag.Root, nil
+}
+
+// linkIndexes finds the index of the link to each block of path in the one
+// before it
+func linkIndexes(ctx context.Context, cd *carDAG, path []cid.Cid) ([]int64, error) {
+	indexes := make([]int64, 0, len(path))
+	for i := 0; i+1 < len(path); i++ {
+		nd, err := cd.Get(ctx, path[i])
+		if err != nil {
+			return nil, err
+		}
+		index := int64(-1)
+		for j, lk := range nd.Links() {
+			if lk.Cid.Equals(path[i+1]) {
+				index = int64(j)
+				break
+			}
+		}
+		if index < 0 {
+			return nil, xerrors.Errorf("%s does not link to %s", path[i], path[i+1])
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
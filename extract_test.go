@@ -0,0 +1,159 @@
+package graphsplit
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"golang.org/x/xerrors"
+)
+
+func TestExtract(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"sub/a.txt": "a",
+		"sub/b.txt": "b",
+		"top.txt":   "top",
+	}
+	_, carDir := chunkTestFiles(t, dir, files, 1<<20)
+	entries, err := ReadFileIndex(filepath.Join(carDir, FileIndexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadCid := entries[0].PayloadCid
+	carFile := filepath.Join(carDir, payloadCid+".car")
+	outDir := filepath.Join(dir, "out")
+	if err := os.MkdirAll(outDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, withPath := range []bool{false, true} {
+		outFile := filepath.Join(outDir, "sub.car")
+		var buf bytes.Buffer
+		root, err := Extract(ctx, carFile, "/sub", &buf, withPath, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cr, err := car.NewCarReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cr.Header.Version != 1 || len(cr.Header.Roots) != 1 || !cr.Header.Roots[0].Equals(root) {
+			t.Fatalf("with path %t: expect a CARv1 rooted at %s, got %+v", withPath, root, cr.Header)
+		}
+		if withPath && root.String() != payloadCid || !withPath && root.String() == payloadCid {
+			t.Fatalf("with path %t: unexpected root %s", withPath, root)
+		}
+		if err := ioutil.WriteFile(outFile, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		prefix := ""
+		if withPath {
+			prefix = "sub/"
+		}
+		for _, name := range []string{"a.txt", "b.txt"} {
+			var out bytes.Buffer
+			if err := Cat(ctx, outFile, prefix+name, &out); err != nil {
+				t.Fatalf("with path %t: %s", withPath, err)
+			}
+			if out.String() != files["sub/"+name] {
+				t.Fatalf("with path %t: content of %s does not match", withPath, name)
+			}
+		}
+		// only the blocks on the path are kept besides sub
+		if withPath {
+			if _, err := List(ctx, outFile, "top.txt", false); err == nil {
+				t.Fatal("expect top.txt left out")
+			}
+		}
+	}
+
+	if _, err := Extract(ctx, carFile, "/none", &bytes.Buffer{}, false, 1); !xerrors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expect a missing path to fail, got %v", err)
+	}
+
+	// a CARv2 wraps the same CARv1 data, with an index of its sections
+	var v1, v2 bytes.Buffer
+	if _, err := Extract(ctx, carFile, "/sub", &v1, false, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Extract(ctx, carFile, "/sub", &v2, false, 2); err != nil {
+		t.Fatal(err)
+	}
+	data := v2.Bytes()
+	if !bytes.HasPrefix(data, carV2Pragma) {
+		t.Fatal("expect the CARv2 pragma")
+	}
+	header := data[len(carV2Pragma) : len(carV2Pragma)+carV2HeaderSize]
+	dataOffset := binary.LittleEndian.Uint64(header[16:])
+	dataSize := binary.LittleEndian.Uint64(header[24:])
+	indexOffset := binary.LittleEndian.Uint64(header[32:])
+	payload := data[dataOffset : dataOffset+dataSize]
+	if !bytes.Equal(payload, v1.Bytes()) || indexOffset != dataOffset+dataSize {
+		t.Fatalf("expect the CARv1 data at %d, got %d bytes at %d and the index at %d", len(carV2Pragma)+carV2HeaderSize, dataSize, dataOffset, indexOffset)
+	}
+	index := bytes.NewReader(data[indexOffset:])
+	codec, err := binary.ReadUvarint(index)
+	if err != nil || codec != carIndexSorted {
+		t.Fatalf("expect an IndexSorted index, got %x %v", codec, err)
+	}
+	var buckets int32
+	binary.Read(index, binary.LittleEndian, &buckets)
+	indexed := 0
+	for i := int32(0); i < buckets; i++ {
+		var width uint32
+		var size int64
+		binary.Read(index, binary.LittleEndian, &width)
+		binary.Read(index, binary.LittleEndian, &size)
+		records := make([]byte, size)
+		if _, err := io.ReadFull(index, records); err != nil {
+			t.Fatal(err)
+		}
+		for r := records; len(r) > 0; r = r[width:] {
+			digest, offset := r[:width-8], binary.LittleEndian.Uint64(r[width-8:width])
+			// the section at offset holds the block of digest
+			section := bytes.NewReader(payload[offset:])
+			if _, err := binary.ReadUvarint(section); err != nil {
+				t.Fatal(err)
+			}
+			_, c, err := cid.CidFromReader(section)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(c.Hash(), digest) {
+				t.Fatalf("section at %d holds %s, not the digest indexed", offset, c)
+			}
+			indexed++
+		}
+	}
+	cr, err := car.NewCarReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := 0
+	for {
+		if _, err := cr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		blocks++
+	}
+	if indexed != blocks || index.Len() != 0 {
+		t.Fatalf("expect the %d blocks indexed, got %d and %d bytes left", blocks, indexed, index.Len())
+	}
+}
@@ -0,0 +1,369 @@
+package graphsplit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// ExcludedName is the name of the report saved in car-dir of the paths a
+// chunk run excluded, and why
+const ExcludedName = "excluded.csv"
+
+// RegexPrefix marks a pattern of a FileFilter as a regular expression
+const RegexPrefix = "regex:"
+
+// FileFilter selects the files to chunk under the target path. A file is
+// chunked if neither it nor a directory above it is hidden, excluded or
+// ignored, it or a directory above it is included, and its size is within
+// the bounds. Excluded directories are not read.
+//
+// Patterns are matched against the paths relative to the target path. A
+// glob pattern is matched as a line of a .gitignore: without a slash it
+// matches the name of a file or directory at any depth, otherwise the path
+// from the target path, with ** for any number of directories, and a
+// trailing slash only matches directories. A pattern starting with
+// RegexPrefix is a regular expression matching anywhere in the path.
+type FileFilter struct {
+	// only chunk the files matching one of these patterns, all files if none
+	Include []string `json:"include,omitempty"`
+	// skip the files and directories matching one of these patterns
+	Exclude []string `json:"exclude,omitempty"`
+	// lines of .gitignore files, see ReadIgnoreFile
+	Ignore []string `json:"ignore,omitempty"`
+	// chunk hidden files and directories, whose names start with a dot
+	Hidden bool `json:"hidden,omitempty"`
+	// bounds of the size of the files, no upper bound if MaxSize is 0
+	MinSize int64 `json:"minSize,omitempty"`
+	MaxSize int64 `json:"maxSize,omitempty"`
+}
+
+func (f *FileFilter) isZero() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0 && len(f.Ignore) == 0 && !f.Hidden && f.MinSize == 0 && f.MaxSize == 0
+}
+
+// ReadIgnoreFile reads the lines of the file at p in gitignore syntax, for
+// FileFilter.Ignore
+func ReadIgnoreFile(p string) ([]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	return lines, sc.Err()
+}
+
+// pathRule is a pattern of a FileFilter
+type pathRule struct {
+	text string
+	re   *regexp.Regexp
+	segs []string
+	// matched against the whole path rather than the name
+	anchored bool
+	dirOnly  bool
+	// a ! line of a .gitignore, which includes again what it matches
+	negate bool
+}
+
+func parseRule(text string, gitignore bool) (*pathRule, error) {
+	r := &pathRule{text: text}
+	if !gitignore && strings.HasPrefix(text, RegexPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(text, RegexPrefix))
+		if err != nil {
+			return nil, xerrors.Errorf("bad pattern %q: %w", text, err)
+		}
+		r.re = re
+		return r, nil
+	}
+	p := text
+	if gitignore && strings.HasPrefix(p, "!") {
+		r.negate = true
+		p = p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if strings.Contains(p, "/") {
+		r.anchored = true
+		p = strings.TrimPrefix(p, "/")
+	}
+	if p == "" {
+		return nil, xerrors.Errorf("bad pattern %q", text)
+	}
+	r.segs = strings.Split(p, "/")
+	for _, seg := range r.segs {
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil, xerrors.Errorf("bad pattern %q: %w", text, err)
+		}
+	}
+	return r, nil
+}
+
+// parseIgnoreLine parses a line of a .gitignore, nil for blank lines and
+// comments
+func parseIgnoreLine(line string) (*pathRule, error) {
+	line = strings.TrimSuffix(line, "\r")
+	// trailing spaces are dropped, unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	return parseRule(line, true)
+}
+
+func (r *pathRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.re != nil {
+		return r.re.MatchString(rel)
+	}
+	segs := strings.Split(rel, "/")
+	if !r.anchored {
+		ok, _ := path.Match(r.segs[0], segs[len(segs)-1])
+		return ok
+	}
+	return matchGlob(r.segs, segs)
+}
+
+// matchGlob matches the segments of a path to the ones of a pattern, where
+// ** matches any number of segments
+func matchGlob(pat, segs []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchGlob(pat[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], segs[0]); !ok {
+			return false
+		}
+		pat, segs = pat[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// fileFilter is a FileFilter with its patterns parsed
+type fileFilter struct {
+	FileFilter
+	include []*pathRule
+	exclude []*pathRule
+	ignore  []*pathRule
+	// fail on special files rather than skip them
+	failSpecial bool
+}
+
+func newFileFilter(f FileFilter) (*fileFilter, error) {
+	ff := &fileFilter{FileFilter: f}
+	if f.MinSize < 0 || f.MaxSize < 0 || (f.MaxSize > 0 && f.MinSize > f.MaxSize) {
+		return nil, xerrors.Errorf("bad size bounds: %d to %d", f.MinSize, f.MaxSize)
+	}
+	for _, p := range f.Include {
+		r, err := parseRule(p, false)
+		if err != nil {
+			return nil, err
+		}
+		ff.include = append(ff.include, r)
+	}
+	for _, p := range f.Exclude {
+		r, err := parseRule(p, false)
+		if err != nil {
+			return nil, err
+		}
+		ff.exclude = append(ff.exclude, r)
+	}
+	for _, line := range f.Ignore {
+		r, err := parseIgnoreLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			ff.ignore = append(ff.ignore, r)
+		}
+	}
+	return ff, nil
+}
+
+// excludeName tells why the file or directory of name is excluded whatever
+// it is, or gives ""
+func (f *fileFilter) excludeName(name string) string {
+	if !f.Hidden && strings.HasPrefix(name, ".") {
+		return "hidden"
+	}
+	return ""
+}
+
+// excludeDir tells why the directory at rel is excluded, or gives ""
+func (f *fileFilter) excludeDir(rel string) string {
+	return f.excludePath(rel, true)
+}
+
+// excludeFile tells why the file at rel is excluded, or gives "". The
+// directories above it are not checked.
+func (f *fileFilter) excludeFile(rel string, size int64) string {
+	if reason := f.excludePath(rel, false); reason != "" {
+		return reason
+	}
+	if len(f.include) > 0 && !f.included(rel) {
+		return "not included"
+	}
+	if size < f.MinSize {
+		return fmt.Sprintf("smaller than %d bytes", f.MinSize)
+	}
+	if f.MaxSize > 0 && size > f.MaxSize {
+		return fmt.Sprintf("larger than %d bytes", f.MaxSize)
+	}
+	return ""
+}
+
+func (f *fileFilter) excludePath(rel string, isDir bool) string {
+	if reason := f.excludeName(path.Base(rel)); reason != "" {
+		return reason
+	}
+	for _, r := range f.exclude {
+		if r.match(rel, isDir) {
+			return "exclude " + r.text
+		}
+	}
+	// the last line matching decides, as in a .gitignore
+	var last *pathRule
+	for _, r := range f.ignore {
+		if r.match(rel, isDir) {
+			last = r
+		}
+	}
+	if last != nil && !last.negate {
+		return "ignore " + last.text
+	}
+	return ""
+}
+
+// included tells if the file at rel or a directory above it is included
+func (f *fileFilter) included(rel string) bool {
+	for _, r := range f.include {
+		if r.match(rel, false) {
+			return true
+		}
+		for i := range rel {
+			if rel[i] == '/' && r.match(rel[:i], true) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relPath gives the path p of fsys relative to the target path root, as
+// the patterns of a filter are matched, or its name if it is root
+func relPath(root, p string) string {
+	if p == root {
+		return path.Base(p)
+	}
+	if root == "." {
+		return p
+	}
+	return strings.TrimPrefix(p, root+"/")
+}
+
+// fileSelector filters the files of a list, such as an inventory or an
+// archive, which holds no directories. A directory excluded is reported
+// once, before the files below it.
+type fileSelector struct {
+	filter *fileFilter
+	root   string
+	report func(p, reason string)
+	// the directory reported last
+	skipped string
+}
+
+// keep tells if the file at p of size bytes and mode is chunked
+func (s *fileSelector) keep(p string, size int64, mode fs.FileMode) (bool, error) {
+	if s.skipped != "" && strings.HasPrefix(p, s.skipped+"/") {
+		return false, nil
+	}
+	rel := relPath(s.root, p)
+	for i := range rel {
+		if rel[i] != '/' {
+			continue
+		}
+		if reason := s.filter.excludeDir(rel[:i]); reason != "" {
+			// p ends with rel
+			s.skipped = p[:len(p)-len(rel)+i]
+			if s.report != nil {
+				s.report(s.skipped, reason)
+			}
+			return false, nil
+		}
+	}
+	reason, err := s.filter.excludeMode(p, mode)
+	if err != nil {
+		return false, err
+	}
+	if reason == "" {
+		reason = s.filter.excludeFile(rel, size)
+	}
+	if reason != "" {
+		if s.report != nil {
+			s.report(p, reason)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// exclusionReport collects the paths excluded by a filter, to save them in
+// the report of the run
+type exclusionReport struct {
+	lock      sync.Mutex
+	data      bytes.Buffer
+	csvWriter *csv.Writer
+	count     int
+}
+
+func (r *exclusionReport) add(p, reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.csvWriter == nil {
+		r.csvWriter = csv.NewWriter(&r.data)
+	}
+	log.Debugf("exclude %s: %s", p, reason)
+	r.csvWriter.Write([]string{p, reason})
+	r.count++
+}
+
+// save appends the paths excluded to the report in s, if there are any
+func (r *exclusionReport) save(s Sink) error {
+	if r.count == 0 {
+		return nil
+	}
+	r.csvWriter.Flush()
+	if err := r.csvWriter.Error(); err != nil {
+		return err
+	}
+	log.Infof("excluded %d paths, see %s", r.count, ExcludedName)
+	return s.Append(ExcludedName, []byte("path,reason\n"), r.data.Bytes())
+}
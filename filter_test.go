@@ -0,0 +1,117 @@
+package graphsplit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileFilter(t *testing.T) {
+	filter, err := newFileFilter(FileFilter{
+		Exclude: []string{"*.tmp", "regex:^build/.*\\.o$"},
+		Ignore:  []string{"# comment", "", "logs/", "/docs/**/draft*", "*.log", "!keep.log"},
+		MaxSize: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		rel    string
+		isDir  bool
+		size   int64
+		reason string
+	}{
+		{rel: "a.txt", size: 10},
+		{rel: "sub/a.tmp", size: 10, reason: "exclude *.tmp"},
+		{rel: "build/x.o", size: 10, reason: "exclude regex:^build/.*\\.o$"},
+		{rel: "src/build/x.o", size: 10},
+		{rel: ".git", isDir: true, reason: "hidden"},
+		{rel: "logs", isDir: true, reason: "ignore logs/"},
+		{rel: "logs", size: 10},
+		{rel: "docs/a/b/draft1.md", size: 10, reason: "ignore /docs/**/draft*"},
+		{rel: "docs/draft1.md", size: 10, reason: "ignore /docs/**/draft*"},
+		{rel: "sub/docs/draft1.md", size: 10},
+		{rel: "sub/x.log", size: 10, reason: "ignore *.log"},
+		{rel: "sub/keep.log", size: 10},
+		{rel: "big.bin", size: 101, reason: "larger than 100 bytes"},
+	} {
+		var reason string
+		if c.isDir {
+			reason = filter.excludeDir(c.rel)
+		} else {
+			reason = filter.excludeFile(c.rel, c.size)
+		}
+		if reason != c.reason {
+			t.Errorf("%s: got %q, expect %q", c.rel, reason, c.reason)
+		}
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test_file_filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, p := range []string{"a/x.txt", "a/tmp/y.txt", "a/.cache/z.txt", "b/x.txt", ".env"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(p)), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, p), []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filter, err = newFileFilter(FileFilter{Include: []string{"a"}, Exclude: []string{"tmp"}, Hidden: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// walking the source and filtering a list give the same files
+	var walked, listed, reported []string
+	if err := walkFiles(os.DirFS(dir), ".", 4, filter, func(p, reason string) {
+		reported = append(reported, p+": "+reason)
+	}, func(item Finfo) error {
+		walked = append(walked, item.Path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fsel := &fileSelector{filter: filter, root: "."}
+	for _, p := range []string{".env", "a/.cache/z.txt", "a/tmp/y.txt", "a/x.txt", "b/x.txt"} {
+		keep, err := fsel.keep(p, 10, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keep {
+			listed = append(listed, p)
+		}
+	}
+	expect := []string{"a/.cache/z.txt", "a/x.txt"}
+	if !reflect.DeepEqual(walked, expect) || !reflect.DeepEqual(listed, expect) {
+		t.Fatalf("walked %v and listed %v, expect %v", walked, listed, expect)
+	}
+	expectReported := []string{".env: not included", "a/tmp: exclude tmp", "b/x.txt: not included"}
+	if !reflect.DeepEqual(reported, expectReported) {
+		t.Fatalf("reported %v, expect %v", reported, expectReported)
+	}
+
+	// the file lists of the OS skip what chunking skips by default
+	list, err := GetFileList([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = []string{dir + "/a/tmp/y.txt", dir + "/a/x.txt", dir + "/b/x.txt"}
+	if !reflect.DeepEqual(list, expect) {
+		t.Fatalf("listed %v, expect %v", list, expect)
+	}
+	listed = nil
+	if err := WalkLocalFiles(dir, FileFilter{Exclude: []string{"tmp"}, Hidden: true}, func(item Finfo) error {
+		listed = append(listed, item.Path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expect = []string{dir + "/.env", dir + "/a/.cache/z.txt", dir + "/a/x.txt", dir + "/b/x.txt"}
+	if !reflect.DeepEqual(listed, expect) {
+		t.Fatalf("listed %v, expect %v", listed, expect)
+	}
+}
@@ -0,0 +1,458 @@
+package graphsplit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	pa "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+	"golang.org/x/xerrors"
+)
+
+// response formats of the gateway
+const (
+	formatRaw  = "raw"
+	formatCar  = "car"
+	formatJSON = "json"
+)
+
+// Gateway serves the dataset in a directory of slice CAR files over HTTP, in
+// the manner of a trustless IPFS gateway:
+//
+//	/ipfs/<cid>[/path]  the UnixFS file or directory at path below cid, or
+//	                    its block with ?format=raw, or a CAR file of its DAG
+//	                    and the blocks on the path with ?format=car
+//	/dataset/[path]     the dataset, with split files joined back
+//	/                   the slices
+//
+// The formats can be asked for with the Accept header as well. Files are
+// served with Range support, and directories listed as HTML, or as JSON
+// with ?format=json.
+type Gateway struct {
+	dag    *datasetDAG
+	fs     *datasetFS
+	slices []gatewaySlice
+	mux    *http.ServeMux
+}
+
+// gatewaySlice is a root of a CAR file, listed at /
+type gatewaySlice struct {
+	Name        string `json:"name"`
+	PayloadCid  string `json:"payloadCid"`
+	PieceCid    string `json:"pieceCid,omitempty"`
+	PayloadSize int64  `json:"payloadSize,omitempty"`
+	PieceSize   uint64 `json:"pieceSize,omitempty"`
+}
+
+// NewGateway opens the CAR files in carDir to be served, as their blocks are
+// asked for. Split files missing some parts are left out of /dataset.
+func NewGateway(carDir string) (*Gateway, error) {
+	ctx := context.Background()
+	manifests, err := ReadManifest(filepath.Join(carDir, ManifestName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	pf, err := newPathFilter(nil)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := openDatasetTree(ctx, carDir, pf)
+	if err != nil {
+		return nil, err
+	}
+	// blocks are found through an index of the CAR files holding them, which
+	// starts with the files in the tree and grows as CAR files are opened
+	tree.cars.indexBlocks()
+	for p, e := range tree.entries {
+		if err := checkParts(e); err != nil {
+			log.Warnf("leave %s out of the dataset: %s", p, err)
+			delete(tree.entries, p)
+			continue
+		}
+		for _, part := range e.Parts {
+			tree.cars.learn(part.Cid, part.car)
+		}
+	}
+
+	g := &Gateway{
+		dag: &datasetDAG{cars: tree.cars},
+		fs:  newDatasetFS(ctx, tree),
+		mux: http.NewServeMux(),
+	}
+	byPayload := make(map[string]Manifest)
+	for _, m := range manifests {
+		byPayload[m.PayloadCid] = m
+	}
+	for _, roots := range tree.cars.roots {
+		for _, root := range roots {
+			s := gatewaySlice{Name: root.String(), PayloadCid: root.String()}
+			if m, ok := byPayload[root.String()]; ok {
+				s.Name = strings.TrimSuffix(m.Filename, filepath.Ext(m.Filename))
+				s.PieceCid, s.PayloadSize, s.PieceSize = m.PieceCid, m.PayloadSize, m.PieceSize
+			}
+			g.slices = append(g.slices, s)
+		}
+	}
+	sort.Slice(g.slices, func(i, j int) bool {
+		return g.slices[i].Name < g.slices[j].Name
+	})
+	g.mux.HandleFunc("/ipfs/", g.serveIPFS)
+	g.mux.HandleFunc("/dataset/", g.serveDataset)
+	g.mux.HandleFunc("/", g.serveSlices)
+	return g, nil
+}
+
+func (g *Gateway) Close() error {
+	return g.fs.Close()
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	g.mux.ServeHTTP(w, r)
+}
+
+// responseFormat is the format asked for by the format parameter or the
+// Accept header, empty for the UnixFS content itself
+func responseFormat(r *http.Request) string {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.Split(accept, ";")[0])
+		switch mediaType {
+		case "application/vnd.ipld.raw":
+			return formatRaw
+		case "application/vnd.ipld.car":
+			return formatCar
+		case "application/json":
+			return formatJSON
+		}
+	}
+	return ""
+}
+
+func (g *Gateway) serveSlices(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if responseFormat(r) == formatJSON {
+		writeJSON(w, g.slices)
+		return
+	}
+	rows := []listingRow{{Name: "dataset/", Href: "/dataset/"}}
+	for _, s := range g.slices {
+		rows = append(rows, listingRow{Name: s.Name + "/", Href: "/ipfs/" + s.PayloadCid + "/", Size: s.PayloadSize, Cid: s.PayloadCid})
+	}
+	writeListing(w, "slices", rows)
+}
+
+func (g *Gateway) serveDataset(w http.ResponseWriter, r *http.Request) {
+	if responseFormat(r) != formatJSON {
+		http.StripPrefix("/dataset", http.FileServer(http.FS(g.fs))).ServeHTTP(w, r)
+		return
+	}
+	p := strings.Trim(pa.Clean(strings.TrimPrefix(r.URL.Path, "/dataset")), "/")
+	if p == "" {
+		p = "."
+	}
+	e, err := g.fs.lookup("readdir", p)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !e.IsDir {
+		writeJSON(w, listEntryOf(e))
+		return
+	}
+	entries := make([]ListEntry, 0)
+	for _, name := range g.fs.children[e.Path] {
+		entries = append(entries, listEntryOf(g.fs.tree.entries[pa.Join(e.Path, name)]))
+	}
+	writeJSON(w, entries)
+}
+
+func (g *Gateway) serveIPFS(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	segs := strings.Split(strings.TrimPrefix(r.URL.Path, "/ipfs/"), "/")
+	root, err := cid.Decode(segs[0])
+	if err != nil {
+		http.Error(w, "invalid cid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	names := make([]string, 0, len(segs)-1)
+	for _, name := range segs[1:] {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	nd, path, err := resolvePath(ctx, g.dag, root, names)
+	switch {
+	case ipld.IsNotFound(err):
+		http.Error(w, err.Error()+": not in the CAR files", http.StatusNotFound)
+		return
+	case xerrors.Is(err, os.ErrNotExist):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the content is addressed by cid and never changes
+	w.Header().Set("Cache-Control", "public, max-age=29030400, immutable")
+	w.Header().Set("X-Ipfs-Path", r.URL.Path)
+	switch format := responseFormat(r); format {
+	case formatRaw:
+		g.serveRaw(w, r, nd.Cid())
+	case formatCar:
+		g.serveCar(w, r, root, path, nd.Cid())
+	case "", formatJSON:
+		g.serveUnixFS(w, r, nd, names, format)
+	default:
+		http.Error(w, "unsupported format: "+format, http.StatusBadRequest)
+	}
+}
+
+func (g *Gateway) serveRaw(w http.ResponseWriter, r *http.Request, c cid.Cid) {
+	blk, err := g.dag.getBlock(r.Context(), c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.ipld.raw")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Etag", `"`+c.String()+`.raw"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blk.RawData()))
+}
+
+// serveCar writes a CAR file with root as its root, holding the blocks that
+// the path was resolved through and then the whole DAG of c, depth first
+func (g *Gateway) serveCar(w http.ResponseWriter, r *http.Request, root cid.Cid, path []cid.Cid, c cid.Cid) {
+	w.Header().Set("Content-Type", "application/vnd.ipld.car; version=1")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+c.String()+`.car"`)
+	w.Header().Set("Etag", `"`+c.String()+`.car"`)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := g.dag.writeCar(r.Context(), w, root, path, c); err != nil {
+		// the response has begun, cut it short so that the client notices
+		log.Errorf("write CAR of %s: %s", r.URL.Path, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (g *Gateway) serveUnixFS(w http.ResponseWriter, r *http.Request, nd ipld.Node, names []string, format string) {
+	ctx := r.Context()
+	info, ok := unixfsInfoOf(nd)
+	switch {
+	case !ok:
+		http.Error(w, nonUnixFSRoot(r.URL.Path, nd.Cid())+", ask for format=raw or format=car", http.StatusNotAcceptable)
+		return
+	case info.Symlink != "":
+		http.Error(w, "symlink to "+info.Symlink+" is not followed", http.StatusNotImplemented)
+		return
+	case !info.IsDir:
+		f, err := openPart(ctx, treePart{Cid: nd.Cid(), dag: g.dag})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		name := ""
+		if len(names) > 0 {
+			name = names[len(names)-1]
+		}
+		w.Header().Set("Etag", `"`+nd.Cid().String()+`"`)
+		http.ServeContent(w, r, name, time.Time{}, f)
+		return
+	}
+
+	// relative links of the listing need the trailing slash
+	if format == "" && !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	links, err := dirLinks(ctx, g.dag, nd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries := make([]ListEntry, 0, len(links))
+	rows := make([]listingRow, 0, len(links))
+	for _, lk := range links {
+		e := ListEntry{Path: pa.Join(pa.Join(names...), lk.Name), Cid: lk.Cid.String()}
+		child, err := g.dag.Get(ctx, lk.Cid)
+		if err != nil && !ipld.IsNotFound(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		href := lk.Name
+		if child != nil {
+			if info, ok := unixfsInfoOf(child); ok {
+				switch {
+				case info.IsDir:
+					e.Type = EntryDir
+					href += "/"
+				case info.Symlink != "":
+					e.Type, e.Target = EntrySymlink, info.Symlink
+				default:
+					e.Type, e.Size = EntryFile, int64(info.Size)
+				}
+			}
+		}
+		entries = append(entries, e)
+		rows = append(rows, listingRow{Name: href, Href: href, Size: e.Size, Cid: e.Cid})
+	}
+	if format == formatJSON {
+		writeJSON(w, entries)
+		return
+	}
+	w.Header().Set("Etag", `"`+nd.Cid().String()+`.html"`)
+	writeListing(w, r.URL.Path, rows)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Errorf("write json: %s", err)
+	}
+}
+
+type listingRow struct {
+	Name string
+	Href string
+	Size int64
+	Cid  string
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+{{range .Rows}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{if .Size}}{{.Size}}{{end}}</td><td>{{.Cid}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func writeListing(w http.ResponseWriter, title string, rows []listingRow) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := listingTemplate.Execute(w, struct {
+		Title string
+		Rows  []listingRow
+	}{title, rows})
+	if err != nil {
+		log.Errorf("write listing: %s", err)
+	}
+}
+
+// datasetDAG is a read-only DAG service over the blocks of many CAR files
+type datasetDAG struct {
+	cars *carSet
+}
+
+var _ ipld.DAGService = (*datasetDAG)(nil)
+
+// getBlock reads c from the CAR file holding it, see carSet.carOf
+func (dd *datasetDAG) getBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	car, err := dd.cars.carOf(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return dd.cars.getBlock(ctx, car, c)
+}
+
+func (dd *datasetDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	blk, err := dd.getBlock(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return ipld.Decode(blk)
+}
+
+func (dd *datasetDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	return getManyLazily(ctx, dd.Get, cids)
+}
+
+func (dd *datasetDAG) Add(context.Context, ipld.Node) error {
+	return xerrors.New("CAR file is read-only")
+}
+
+func (dd *datasetDAG) AddMany(context.Context, []ipld.Node) error {
+	return xerrors.New("CAR file is read-only")
+}
+
+func (dd *datasetDAG) Remove(context.Context, cid.Cid) error {
+	return xerrors.New("CAR file is read-only")
+}
+
+func (dd *datasetDAG) RemoveMany(context.Context, []cid.Cid) error {
+	return xerrors.New("CAR file is read-only")
+}
+
+// writeCar writes a CARv1 file of root, holding the blocks of path and the
+// whole DAG of c in depth first order, each block once
+func (dd *datasetDAG) writeCar(ctx context.Context, w io.Writer, root cid.Cid, path []cid.Cid, c cid.Cid) error {
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, w); err != nil {
+		return err
+	}
+	written := cid.NewSet()
+	write := func(c cid.Cid) (blocks.Block, error) {
+		blk, err := dd.getBlock(ctx, c)
+		if err != nil || !written.Visit(c) {
+			return blk, err
+		}
+		return blk, util.LdWrite(w, c.Bytes(), blk.RawData())
+	}
+	for _, pc := range path {
+		if _, err := write(pc); err != nil {
+			return err
+		}
+	}
+	walked := cid.NewSet()
+	stack := []cid.Cid{c}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !walked.Visit(c) {
+			continue
+		}
+		blk, err := write(c)
+		if err != nil {
+			return err
+		}
+		nd, err := ipld.Decode(blk)
+		if err != nil {
+			return err
+		}
+		links := nd.Links()
+		for i := len(links) - 1; i >= 0; i-- {
+			stack = append(stack, links[i].Cid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package graphsplit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+)
+
+func TestGateway(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a/one.txt": strings.Repeat("0123456789", 60),
+		"b/big.bin": strings.Repeat("abcdefghij", 250),
+	}
+	_, carDir := chunkTestFiles(t, dir, files, 1000)
+	entries, err := ReadFileIndex(filepath.Join(carDir, FileIndexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root string
+	for _, e := range entries {
+		if e.Path == "a/one.txt" {
+			root = e.PayloadCid
+		}
+	}
+
+	g, err := NewGateway(carDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	get := func(target string, header http.Header) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/ipfs/"+root+"/a/one.txt", nil)
+	if w.Code != http.StatusOK || w.Body.String() != files["a/one.txt"] {
+		t.Fatalf("expect a/one.txt, got %d %q", w.Code, w.Body.String())
+	}
+	// the index finds the blocks without reading the other CAR files
+	if g.dag.cars.opened != 1 {
+		t.Fatalf("expect 1 CAR file opened, %d are", g.dag.cars.opened)
+	}
+
+	w = get("/ipfs/"+root+"/a/one.txt", http.Header{"Range": {"bytes=10-19"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != files["a/one.txt"][10:20] {
+		t.Fatalf("expect bytes 10-19, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = get("/ipfs/"+root+"?format=raw", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/vnd.ipld.raw" {
+		t.Fatalf("expect the raw root block, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	c, err := cid.Decode(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum, err := c.Prefix().Sum(w.Body.Bytes()); err != nil || !sum.Equals(c) {
+		t.Fatalf("raw block does not hash to %s: %v", root, err)
+	}
+
+	w = get("/ipfs/"+root+"/a/one.txt", http.Header{"Accept": {"application/vnd.ipld.car"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expect a CAR file, got %d %s", w.Code, w.Body.String())
+	}
+	cr, err := car.NewCarReader(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cr.Header.Roots) != 1 || cr.Header.Roots[0].String() != root {
+		t.Fatalf("expect root %s, got %v", root, cr.Header.Roots)
+	}
+	var got []cid.Cid
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum, err := blk.Cid().Prefix().Sum(blk.RawData()); err != nil || !sum.Equals(blk.Cid()) {
+			t.Fatalf("block %s does not match its data", blk.Cid())
+		}
+		got = append(got, blk.Cid())
+	}
+	// the root, the directory a and the file
+	if len(got) != 3 || got[0].String() != root {
+		t.Fatalf("expect the blocks of the path and the file, got %v", got)
+	}
+
+	w = get("/ipfs/"+root+"/a?format=json", nil)
+	var listed []ListEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("%d %s: %s", w.Code, w.Body.String(), err)
+	}
+	if len(listed) != 1 || listed[0].Path != "a/one.txt" || listed[0].Type != EntryFile || listed[0].Size != 600 {
+		t.Fatalf("expect a/one.txt listed, got %+v", listed)
+	}
+
+	w = get("/dataset/b/big.bin", nil)
+	if w.Code != http.StatusOK || w.Body.String() != files["b/big.bin"] {
+		t.Fatalf("expect b/big.bin joined, got %d", w.Code)
+	}
+
+	unknown := blocks.NewBlock([]byte("not in the dataset")).Cid()
+	for _, target := range []string{
+		"/ipfs/" + unknown.String(),
+		"/ipfs/" + root + "/a/none.txt",
+		"/dataset/none.txt",
+		"/nothing",
+	} {
+		if w := get(target, nil); w.Code != http.StatusNotFound {
+			t.Fatalf("%s: expect 404, got %d", target, w.Code)
+		}
+	}
+	if w := get("/ipfs/not-a-cid", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("expect 400 for a bad cid, got %d", w.Code)
+	}
+}
@@ -0,0 +1,219 @@
+package graphsplit
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// FileIndexName is the name of the file index saved in car-dir
+const FileIndexName = "fileindex.csv"
+
+var fileIndexHeader = []string{
+	"payload_cid", "filename", "path", "name", "part", "offset", "size", "file_size", "cid", "checksums", "file_checksums",
+}
+
+// FileIndexEntry records where a file, or a part of a split file, is stored
+type FileIndexEntry struct {
+	// payload cid and name of the graph slice
+	PayloadCid string
+	GraphName  string
+	// path of the file relative to the graph root
+	Path string
+	// link name inside the graph slice, differs from the base of Path for parts
+	Name string
+	// index of the part, -1 if the file is not split
+	Part int
+	// byte range of the file stored in this entry
+	Offset int64
+	Size   int64
+
+	FileSize int64
+	Cid      string
+	// checksums of the byte range, keyed by algorithm
+	Checksums map[string]string
+	// checksums of the whole file, only set on the entry of its last part
+	FileChecksums map[string]string
+}
+
+// IsPart reports whether the entry holds a part of a split file
+func (e *FileIndexEntry) IsPart() bool {
+	return e.Part >= 0
+}
+
+func newFileIndexEntry(item Finfo, relPath string) FileIndexEntry {
+	entry := FileIndexEntry{
+		Path:     relPath,
+		Name:     item.Name,
+		Part:     -1,
+		Offset:   0,
+		Size:     item.Info.Size(),
+		FileSize: item.Info.Size(),
+	}
+	if isFilePart(item) {
+		entry.Part = filePartIndex(item)
+		entry.Offset = item.SeekStart
+		entry.Size = item.SeekEnd - item.SeekStart + 1
+	}
+	return entry
+}
+
+// filePartIndex parses the part index from the name of a split file item
+func filePartIndex(item Finfo) int {
+	i, err := strconv.Atoi(strings.TrimPrefix(item.Name, item.Info.Name()+"."))
+	if err != nil {
+		return 0
+	}
+	return i
+}
+
+func (e *FileIndexEntry) record() []string {
+	return []string{
+		e.PayloadCid,
+		e.GraphName,
+		e.Path,
+		e.Name,
+		strconv.Itoa(e.Part),
+		strconv.FormatInt(e.Offset, 10),
+		strconv.FormatInt(e.Size, 10),
+		strconv.FormatInt(e.FileSize, 10),
+		e.Cid,
+		formatChecksums(e.Checksums),
+		formatChecksums(e.FileChecksums),
+	}
+}
+
+// formatChecksums encodes checksums as "algo:hex;algo:hex"
+func formatChecksums(sums map[string]string) string {
+	algos := make([]string, 0, len(sums))
+	for algo := range sums {
+		algos = append(algos, algo)
+	}
+	sort.Strings(algos)
+	var b strings.Builder
+	for i, algo := range algos {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(algo)
+		b.WriteByte(':')
+		b.WriteString(sums[algo])
+	}
+	return b.String()
+}
+
+func parseChecksums(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	sums := make(map[string]string)
+	for _, kv := range strings.Split(s, ";") {
+		algo, sum, ok := strings.Cut(kv, ":")
+		if !ok {
+			return nil, xerrors.Errorf("malformed checksums: %q", s)
+		}
+		sums[algo] = sum
+	}
+	return sums, nil
+}
+
+// appendFileIndex adds entries to the file index in s
+func appendFileIndex(s Sink, entries []FileIndexEntry) error {
+	var header, data bytes.Buffer
+	csvWriter := csv.NewWriter(&header)
+	if err := csvWriter.Write(fileIndexHeader); err != nil {
+		return err
+	}
+	csvWriter.Flush()
+	csvWriter = csv.NewWriter(&data)
+	for _, entry := range entries {
+		if err := csvWriter.Write(entry.record()); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+	return s.Append(FileIndexName, header.Bytes(), data.Bytes())
+}
+
+// ReadFileIndex reads all entries of a file index. Columns are looked up by
+// the header, so that indexes written by other versions can still be read.
+func ReadFileIndex(indexPath string) ([]FileIndexEntry, error) {
+	f, err := os.Open(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, xerrors.Errorf("read header of %s: %w", indexPath, err)
+	}
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		cols[name] = i
+	}
+	field := func(rec []string, name string) string {
+		i, ok := cols[name]
+		if !ok || i >= len(rec) {
+			return ""
+		}
+		return rec[i]
+	}
+	intField := func(rec []string, name string) (int64, error) {
+		s := field(rec, name)
+		if s == "" {
+			return 0, nil
+		}
+		return strconv.ParseInt(s, 10, 64)
+	}
+
+	entries := make([]FileIndexEntry, 0)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry := FileIndexEntry{
+			PayloadCid: field(rec, "payload_cid"),
+			GraphName:  field(rec, "filename"),
+			Path:       field(rec, "path"),
+			Name:       field(rec, "name"),
+			Cid:        field(rec, "cid"),
+		}
+		part, err := intField(rec, "part")
+		if err != nil {
+			return nil, err
+		}
+		entry.Part = int(part)
+		if entry.Offset, err = intField(rec, "offset"); err != nil {
+			return nil, err
+		}
+		if entry.Size, err = intField(rec, "size"); err != nil {
+			return nil, err
+		}
+		if entry.FileSize, err = intField(rec, "file_size"); err != nil {
+			return nil, err
+		}
+		if entry.Checksums, err = parseChecksums(field(rec, "checksums")); err != nil {
+			return nil, err
+		}
+		if entry.FileChecksums, err = parseChecksums(field(rec, "file_checksums")); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
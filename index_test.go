@@ -0,0 +1,135 @@
+package graphsplit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileIndexRoundTrip(t *testing.T) {
+	carDir, err := ioutil.TempDir(os.TempDir(), "test_index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(carDir)
+
+	entries := []FileIndexEntry{
+		{
+			PayloadCid: "bafy-slice-1",
+			GraphName:  "test-total-2-part-1.car",
+			Path:       "a/b/big.bin",
+			Name:       "big.bin.00000000",
+			Part:       0,
+			Offset:     0,
+			Size:       100,
+			FileSize:   150,
+			Cid:        "bafy-part-0",
+			Checksums:  map[string]string{ChecksumSHA256: "aa", ChecksumMD5: "bb"},
+		},
+		{
+			PayloadCid:    "bafy-slice-2",
+			GraphName:     "test-total-2-part-2.car",
+			Path:          "a/b/big.bin",
+			Name:          "big.bin.00000001",
+			Part:          1,
+			Offset:        100,
+			Size:          50,
+			FileSize:      150,
+			Cid:           "bafy-part-1",
+			Checksums:     map[string]string{ChecksumSHA256: "cc", ChecksumMD5: "dd"},
+			FileChecksums: map[string]string{ChecksumSHA256: "ee", ChecksumMD5: "ff"},
+		},
+	}
+	if err := appendFileIndex(DirSink(carDir), entries[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendFileIndex(DirSink(carDir), entries[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ReadFileIndex(path.Join(carDir, FileIndexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, entries) {
+		t.Fatalf("Unexpected file index entries: %+v", res)
+	}
+}
+
+func TestChunkChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_chunk_checksums")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	carDir := filepath.Join(dir, "cars")
+	outDir := filepath.Join(dir, "out")
+	for _, d := range []string{filepath.Join(src, "sub"), carDir, outDir} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := bytes.Repeat([]byte("0123456789"), 25000)
+	if err := ioutil.WriteFile(filepath.Join(src, "sub", "big.bin"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := Chunk(ctx, 100000, src, src, carDir, "test", 1, CSVCallback(carDir), WithChecksums(ChecksumSHA256)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the whole-file checksum of the split file is the one of the source
+	entries, err := ReadFileIndex(filepath.Join(carDir, FileIndexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expect 3 parts, got %d", len(entries))
+	}
+	sum := sha256.Sum256(content)
+	if got := entries[2].FileChecksums[ChecksumSHA256]; got != hex.EncodeToString(sum[:]) {
+		t.Fatalf("expect the sha256 of the source, got %q", got)
+	}
+	sums, err := ReadChecksumFile(filepath.Join(carDir, ChecksumFileName(ChecksumSHA256)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sums["sub/big.bin"] != hex.EncodeToString(sum[:]) {
+		t.Fatalf("expect the sha256 of the source in %s, got %v", ChecksumFileName(ChecksumSHA256), sums)
+	}
+
+	// a part corrupted before it is merged is caught
+	res, err := RestorePaths(ctx, carDir, outDir, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := res.Err(); err != nil {
+		t.Fatal(err)
+	}
+	part := filepath.Join(outDir, "sub", "big.bin.00000001")
+	data, err := ioutil.ReadFile(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[10] ^= 0xff
+	if err := ioutil.WriteFile(part, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	Merge(outDir, 1)
+	failed, err := VerifyChecksums(filepath.Join(carDir, ChecksumFileName(ChecksumSHA256)), outDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(failed, []string{"sub/big.bin"}) {
+		t.Fatalf("expect sub/big.bin to fail, got %v", failed)
+	}
+}
@@ -0,0 +1,144 @@
+package graphsplit
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// types of the entries listed by List
+const (
+	EntryDir     = "dir"
+	EntryFile    = "file"
+	EntrySymlink = "symlink"
+)
+
+// ListEntry is a file or directory of a dataset, as listed by List
+type ListEntry struct {
+	Path string `json:"path"`
+	Type string `json:"type"`
+	// size of the file, or of the parts found of a split file
+	Size int64 `json:"size"`
+	// cid of the file, empty for directories and split files
+	Cid string `json:"cid,omitempty"`
+	// the parts of a split file that are in the CAR files listed
+	Parts  []ListPart `json:"parts,omitempty"`
+	Target string     `json:"target,omitempty"`
+}
+
+// ListPart is a part of a split file
+type ListPart struct {
+	Index int    `json:"index"`
+	Size  int64  `json:"size"`
+	Cid   string `json:"cid"`
+}
+
+// List lists the entries at p in the CAR file, or the CAR files of a car-dir,
+// at carPath: the entries of the directory, everything below it if recursive
+// is set, or the file itself. p may be a glob as in RestorePaths, and an
+// empty p lists the top of the dataset. Split files are put together through
+// the file index or manifest next to the CAR files, and listed with the parts
+// that are found. The file index, or else the manifest, is used to read only
+// the CAR files that hold p.
+func List(ctx context.Context, carPath, p string, recursive bool) ([]ListEntry, error) {
+	var patterns []string
+	segs := splitPath(p)
+	if len(segs) > 0 {
+		patterns = []string{p}
+	}
+	pf, err := newPathFilter(patterns)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := openDatasetTree(ctx, carPath, pf)
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Close()
+
+	found := len(segs) == 0
+	entries := make([]ListEntry, 0)
+	for _, ep := range tree.Paths() {
+		e := tree.entries[ep]
+		depth := len(splitPath(ep))
+		if depth == len(segs) {
+			found = true
+		}
+		// parents of the selected entries, or selected directories themselves
+		if depth < len(segs) || depth == len(segs) && e.IsDir {
+			continue
+		}
+		if depth > len(segs)+1 && !recursive {
+			continue
+		}
+		entries = append(entries, listEntryOf(e))
+	}
+	if !found {
+		return nil, xerrors.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	return entries, nil
+}
+
+func listEntryOf(e *treeEntry) ListEntry {
+	switch {
+	case e.IsDir:
+		return ListEntry{Path: e.Path, Type: EntryDir}
+	case e.Symlink != "":
+		return ListEntry{Path: e.Path, Type: EntrySymlink, Target: e.Symlink}
+	}
+	le := ListEntry{Path: e.Path, Type: EntryFile, Size: e.Size}
+	if len(e.Parts) == 1 && e.Parts[0].Index < 0 {
+		le.Cid = e.Parts[0].Cid.String()
+		return le
+	}
+	for _, part := range e.Parts {
+		le.Parts = append(le.Parts, ListPart{Index: part.Index, Size: part.Size, Cid: part.Cid.String()})
+	}
+	return le
+}
+
+// Cat writes the content of the file at p in the CAR file, or the CAR files
+// of a car-dir, at carPath to w. A split file is written whole, so all of
+// its parts have to be there. Only the CAR files of its parts are read if the
+// file index or manifest is there.
+func Cat(ctx context.Context, carPath, p string, w io.Writer) error {
+	p = strings.Join(splitPath(p), "/")
+	if p == "" {
+		return xerrors.Errorf("no file path given")
+	}
+	pf, err := newPathFilter([]string{p})
+	if err != nil {
+		return err
+	}
+	tree, err := openDatasetTree(ctx, carPath, pf)
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+
+	e, ok := tree.entries[p]
+	switch {
+	case !ok:
+		return xerrors.Errorf("%s: %w", p, os.ErrNotExist)
+	case e.IsDir:
+		return xerrors.Errorf("%s is a directory", p)
+	case e.Symlink != "":
+		return xerrors.Errorf("%s is a symlink to %s", p, e.Symlink)
+	}
+	if err := checkParts(e); err != nil {
+		return err
+	}
+	r := tree.Open(ctx, e)
+	defer r.Close()
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return xerrors.Errorf("read %s: %w", p, err)
+	}
+	if n != e.Size {
+		return xerrors.Errorf("expect %d bytes of %s, got %d", e.Size, p, n)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package graphsplit
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipld/go-car"
+)
+
+func TestInspectOpensOnlyCarsOfPath(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_inspect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// every file is a slice of its own
+	files := map[string]string{
+		"a/one.txt": strings.Repeat("1", 1000),
+		"b/two.txt": strings.Repeat("2", 1000),
+		"c/six.txt": strings.Repeat("6", 1000),
+	}
+	_, carDir := chunkTestFiles(t, dir, files, 1000)
+	entries, err := ReadFileIndex(filepath.Join(carDir, FileIndexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// break the CAR files of the other slices past their headers
+	for _, e := range entries {
+		if e.Path == "b/two.txt" {
+			continue
+		}
+		carFile := filepath.Join(carDir, e.PayloadCid+".car")
+		h, err := readCarHeader(carFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := car.WriteHeader(h, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(carFile, append(buf.Bytes(), 0xff), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	for _, withIndex := range []bool{true, false} {
+		if !withIndex {
+			// the manifest tells the slices apart as well
+			if err := os.Remove(filepath.Join(carDir, FileIndexName)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		listed, err := List(ctx, carDir, "b", false)
+		if err != nil {
+			t.Fatalf("index %t: %s", withIndex, err)
+		}
+		if len(listed) != 1 || listed[0].Path != "b/two.txt" || listed[0].Size != 1000 {
+			t.Fatalf("index %t: expect b/two.txt listed, got %+v", withIndex, listed)
+		}
+		var out bytes.Buffer
+		if err := Cat(ctx, carDir, "b/two.txt", &out); err != nil {
+			t.Fatalf("index %t: %s", withIndex, err)
+		}
+		if out.String() != files["b/two.txt"] {
+			t.Fatalf("index %t: content of b/two.txt does not match", withIndex)
+		}
+		// the broken CAR files are read for the whole dataset
+		if _, err := List(ctx, carDir, "", true); withIndex && err != nil || !withIndex && err == nil {
+			t.Fatalf("index %t: listing everything got %v", withIndex, err)
+		}
+	}
+}
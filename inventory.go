@@ -0,0 +1,229 @@
+package graphsplit
+
+import (
+	"encoding/csv"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// DefaultWalkers is the number of goroutines reading directories at once
+// when walking a source, which are mostly waiting on the file system
+const DefaultWalkers = 16
+
+var inventoryHeader = []string{"path", "size", "mtime", "mode"}
+
+// InventoryEntry is a file found by walking a source, with its path in the
+// file system of the source
+type InventoryEntry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Mode    fs.FileMode
+}
+
+func (e *InventoryEntry) record() []string {
+	return []string{
+		e.Path,
+		strconv.FormatInt(e.Size, 10),
+		e.ModTime.UTC().Format(time.RFC3339Nano),
+		strconv.FormatUint(uint64(e.Mode), 8),
+	}
+}
+
+// finfo gives the entry as walkFiles gives the file
+func (e *InventoryEntry) finfo() Finfo {
+	return Finfo{Path: e.Path, Name: path.Base(e.Path), Info: &inventoryInfo{e: *e}}
+}
+
+// inventoryInfo is the fs.FileInfo of an inventory entry
+type inventoryInfo struct {
+	e InventoryEntry
+}
+
+func (fi *inventoryInfo) Name() string       { return path.Base(fi.e.Path) }
+func (fi *inventoryInfo) Size() int64        { return fi.e.Size }
+func (fi *inventoryInfo) Mode() fs.FileMode  { return fi.e.Mode }
+func (fi *inventoryInfo) ModTime() time.Time { return fi.e.ModTime }
+func (fi *inventoryInfo) IsDir() bool        { return fi.e.Mode.IsDir() }
+func (fi *inventoryInfo) Sys() interface{}   { return nil }
+
+// SaveInventory walks the files under root in fsys selected by filter once,
+// with walkers goroutines reading directories, and saves them to the
+// inventory file at inventoryPath in the order they are chunked. The
+// inventory is written to a temporary file first, so that an interrupted
+// walk leaves none behind. It returns the number of files and their total
+// size.
+func SaveInventory(fsys fs.FS, root string, walkers int, filter FileFilter, inventoryPath string) (int64, int64, error) {
+	ff, err := newFileFilter(filter)
+	if err != nil {
+		return 0, 0, err
+	}
+	return saveInventory(fsys, root, walkers, ff, nil, inventoryPath)
+}
+
+func saveInventory(fsys fs.FS, root string, walkers int, filter *fileFilter, report func(p, reason string), inventoryPath string) (int64, int64, error) {
+	f, err := os.CreateTemp(filepath.Dir(inventoryPath), "."+filepath.Base(inventoryPath)+".*.tmp")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	csvWriter := csv.NewWriter(f)
+	if err := csvWriter.Write(inventoryHeader); err != nil {
+		return 0, 0, err
+	}
+	var count, totalSize int64
+	if err := walkFiles(fsys, root, walkers, filter, report, func(item Finfo) error {
+		count++
+		totalSize += item.Info.Size()
+		e := InventoryEntry{Path: item.Path, Size: item.Info.Size(), ModTime: item.Info.ModTime(), Mode: item.Info.Mode()}
+		return csvWriter.Write(e.record())
+	}); err != nil {
+		return 0, 0, err
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return 0, 0, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return 0, 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, 0, err
+	}
+	if err := os.Rename(f.Name(), inventoryPath); err != nil {
+		return 0, 0, err
+	}
+	return count, totalSize, nil
+}
+
+// ReadInventory calls fn with the entries of the inventory file at
+// inventoryPath in order, reading them one at a time
+func ReadInventory(inventoryPath string, fn func(InventoryEntry) error) error {
+	f, err := os.Open(inventoryPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err != nil {
+		return xerrors.Errorf("read header of %s: %w", inventoryPath, err)
+	}
+	if len(header) < len(inventoryHeader) || header[0] != inventoryHeader[0] {
+		return xerrors.Errorf("%s is not an inventory", inventoryPath)
+	}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := r.FieldPos(0)
+		size, err := strconv.ParseInt(rec[1], 10, 64)
+		if err != nil {
+			return xerrors.Errorf("%s:%d: size: %w", inventoryPath, line, err)
+		}
+		modTime, err := time.Parse(time.RFC3339Nano, rec[2])
+		if err != nil {
+			return xerrors.Errorf("%s:%d: mtime: %w", inventoryPath, line, err)
+		}
+		mode, err := strconv.ParseUint(rec[3], 8, 32)
+		if err != nil {
+			return xerrors.Errorf("%s:%d: mode: %w", inventoryPath, line, err)
+		}
+		if err := fn(InventoryEntry{Path: rec[0], Size: size, ModTime: modTime, Mode: fs.FileMode(mode)}); err != nil {
+			return err
+		}
+	}
+}
+
+// listFiles walks the files to chunk under root in fsys once, and gives a
+// function calling fn with them in the sort order, as many times as it is
+// called, and a function removing what the walk left behind. The walk is
+// saved to the inventory file, or to a temporary one without an inventory,
+// and every call reads the files from it, so that the passes over the files
+// see the same ones however large the source is and whatever changes in it.
+// An inventory that exists already is read without walking. Files are only
+// kept in memory to be sorted in another order than their paths. The files
+// are selected by the filter of o either way, and the paths excluded are
+// reported once.
+func (o *chunkOptions) listFiles(fsys fs.FS, root string) (func(fn func(Finfo) error) error, func(), error) {
+	files, done, err := o.walkFiles(fsys, root)
+	if err != nil || o.sortOrder == SortByPath {
+		return files, done, err
+	}
+	var sorted []Finfo
+	if err := files(func(item Finfo) error {
+		sorted = append(sorted, item)
+		return nil
+	}); err != nil {
+		done()
+		return nil, nil, err
+	}
+	sortFiles(sorted, o.sortOrder)
+	return func(fn func(Finfo) error) error {
+		for _, item := range sorted {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, done, nil
+}
+
+// walkFiles lists the files of listFiles in the order of the walk
+func (o *chunkOptions) walkFiles(fsys fs.FS, root string) (func(fn func(Finfo) error) error, func(), error) {
+	inventoryPath, done := o.inventory, func() {}
+	// the inventory may have been saved with another filter
+	report := o.excluded.add
+	if inventoryPath == "" {
+		f, err := os.CreateTemp("", "graphsplit-inventory-*.csv")
+		if err != nil {
+			return nil, nil, err
+		}
+		f.Close()
+		inventoryPath = f.Name()
+		done = func() { os.Remove(inventoryPath) }
+		count, totalSize, err := saveInventory(fsys, root, o.walkers, o.filter, o.excluded.add, inventoryPath)
+		if err != nil {
+			done()
+			return nil, nil, err
+		}
+		log.Infof("walked %d files, %d bytes", count, totalSize)
+		report = nil
+	} else if _, err := os.Stat(inventoryPath); os.IsNotExist(err) {
+		count, totalSize, err := saveInventory(fsys, root, o.walkers, o.filter, o.excluded.add, inventoryPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Infof("saved inventory of %d files, %d bytes to %s", count, totalSize, inventoryPath)
+		report = nil
+	} else if err != nil {
+		return nil, nil, err
+	} else {
+		log.Infof("reading files from inventory %s", inventoryPath)
+	}
+	return func(fn func(Finfo) error) error {
+		fsel := &fileSelector{filter: o.filter, root: root, report: report}
+		report = nil
+		return ReadInventory(inventoryPath, func(e InventoryEntry) error {
+			if keep, err := fsel.keep(e.Path, e.Size, e.Mode); !keep {
+				return err
+			}
+			return fn(e.finfo())
+		})
+	}, done, nil
+}
@@ -0,0 +1,105 @@
+package graphsplit
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestInventory(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	var expect []string
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 5; j++ {
+			p := fmt.Sprintf("d%02d/e%d/f.txt", i, j)
+			if err := os.MkdirAll(filepath.Join(src, filepath.Dir(p)), 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(src, p), []byte(p), 0644); err != nil {
+				t.Fatal(err)
+			}
+			expect = append(expect, p)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "d03", ".hidden"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(expect)
+
+	fsys, root, err := LocalSource(src, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inventoryPath := filepath.Join(dir, "inventory.csv")
+	count, totalSize, err := SaveInventory(fsys, root, 8, FileFilter{}, inventoryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != int64(len(expect)) || totalSize != int64(len(expect)*len("d00/e0/f.txt")) {
+		t.Fatalf("expect %d files, got %d files of %d bytes", len(expect), count, totalSize)
+	}
+	var got []string
+	if err := ReadInventory(inventoryPath, func(e InventoryEntry) error {
+		info, err := os.Stat(filepath.Join(src, e.Path))
+		if err != nil {
+			return err
+		}
+		if e.Size != info.Size() || !e.ModTime.Equal(info.ModTime()) || e.Mode != info.Mode() {
+			return fmt.Errorf("%s: got %d %s %s, expect %d %s %s", e.Path, e.Size, e.ModTime, e.Mode, info.Size(), info.ModTime(), info.Mode())
+		}
+		got = append(got, e.Path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("got files\n%v\nexpect\n%v", got, expect)
+	}
+
+	// without an inventory, chunking walks the source once for every pass
+	fsys = &readDirCounter{FS: fsys, reads: make(map[string]int)}
+	carDir := filepath.Join(dir, "cars")
+	if err := os.MkdirAll(carDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	tmpInventories := filepath.Join(os.TempDir(), "graphsplit-inventory-*")
+	before, _ := filepath.Glob(tmpInventories)
+	if err := ChunkFS(context.Background(), 4<<20, fsys, root, carDir, "test", 2, CSVCallback(carDir), WithAlignedCuts()); err != nil {
+		t.Fatal(err)
+	}
+	for p, n := range fsys.(*readDirCounter).reads {
+		if n != 1 {
+			t.Fatalf("%s is read %d times", p, n)
+		}
+	}
+	if after, _ := filepath.Glob(tmpInventories); len(after) != len(before) {
+		t.Fatalf("temporary inventories %v are left", after)
+	}
+}
+
+// readDirCounter counts the reads of every directory
+type readDirCounter struct {
+	fs.FS
+	lock  sync.Mutex
+	reads map[string]int
+}
+
+func (c *readDirCounter) ReadDir(name string) ([]fs.DirEntry, error) {
+	c.lock.Lock()
+	c.reads[name]++
+	c.lock.Unlock()
+	return fs.ReadDir(c.FS, name)
+}
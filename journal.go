@@ -0,0 +1,81 @@
+package graphsplit
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RestoreJournalName is the default name of the progress journal that
+// restore keeps in the output directory
+const RestoreJournalName = ".graphsplit-restore"
+
+// restoreJournal records the CAR files restored completely, one line of
+// payload cid and path filter each, so that an interrupted restore can go on
+// where it stopped
+type restoreJournal struct {
+	path string
+	lock sync.Mutex
+	done map[string]bool
+}
+
+func openRestoreJournal(path string) (*restoreJournal, error) {
+	j := &restoreJournal{path: path, done: make(map[string]bool)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// a line cut short by a crash has no tab and is ignored
+		if strings.Contains(sc.Text(), "\t") {
+			j.done[sc.Text()] = true
+		}
+	}
+	return j, sc.Err()
+}
+
+// journalFilter is how the patterns of a restore are kept in the journal,
+// empty if everything is restored
+func journalFilter(patterns []string) string {
+	ps := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		ps = append(ps, "/"+strings.Join(splitPath(p), "/"))
+	}
+	sort.Strings(ps)
+	return strings.Join(ps, ",")
+}
+
+// Done reports whether the CAR file of payloadCid was restored with the same
+// filter, or with everything selected
+func (j *restoreJournal) Done(payloadCid, filter string) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.done[payloadCid+"\t"+filter] || j.done[payloadCid+"\t"]
+}
+
+func (j *restoreJournal) Record(payloadCid, filter string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s\t%s\n", payloadCid, filter); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	j.done[payloadCid+"\t"+filter] = true
+	return f.Close()
+}
@@ -0,0 +1,54 @@
+package graphsplit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreJournal(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journalPath := filepath.Join(dir, RestoreJournalName)
+
+	j, err := openRestoreJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := journalFilter([]string{"b/*.txt", "/a/"})
+	if filter != "/a,/b/*.txt" {
+		t.Fatalf("Unexpected filter: %s", filter)
+	}
+	if err := j.Record("bafy-1", filter); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Record("bafy-2", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = openRestoreJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		payloadCid string
+		filter     string
+		done       bool
+	}{
+		{"bafy-1", filter, true},
+		{"bafy-1", "", false},
+		{"bafy-1", "/a", false},
+		// restored with everything selected
+		{"bafy-2", filter, true},
+		{"bafy-3", "", false},
+	}
+	for _, c := range cases {
+		if j.Done(c.payloadCid, c.filter) != c.done {
+			t.Fatalf("Unexpected done of %s %q, expect %v", c.payloadCid, c.filter, c.done)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package graphsplit
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// ManifestName is the name of the manifest saved in car-dir
+const ManifestName = "manifest.csv"
+
+// ReadManifest reads the manifest.csv written by either CSVCallback or
+// CommPCallback. The former does not quote the detail column, so its lines
+// are split on the first two commas instead of being parsed as csv.
+func ReadManifest(manifestPath string) ([]Manifest, error) {
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	headerLine, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	header, err := csv.NewReader(strings.NewReader(headerLine)).Read()
+	if err != nil {
+		return nil, xerrors.Errorf("read header of %s: %w", manifestPath, err)
+	}
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		// the first column was written as playload_cid
+		if name == "playload_cid" {
+			name = "payload_cid"
+		}
+		cols[name] = i
+	}
+
+	var readRecord func() ([]string, error)
+	if len(header) == 3 && cols["detail"] == 2 {
+		readRecord = func() ([]string, error) {
+			for {
+				line, err := br.ReadString('\n')
+				if line == "" && err != nil {
+					return nil, err
+				}
+				line = strings.TrimRight(line, "\r\n")
+				if line == "" {
+					continue
+				}
+				return strings.SplitN(line, ",", 3), nil
+			}
+		}
+	} else {
+		r := csv.NewReader(br)
+		r.FieldsPerRecord = -1
+		readRecord = r.Read
+	}
+
+	manifests := make([]Manifest, 0)
+	for {
+		rec, err := readRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			i, ok := cols[name]
+			if !ok || i >= len(rec) {
+				return ""
+			}
+			return rec[i]
+		}
+		m := Manifest{
+			PayloadCid: field("payload_cid"),
+			Filename:   field("filename"),
+			PieceCid:   field("piece_cid"),
+			Detail:     field("detail"),
+		}
+		if s := field("payload_size"); s != "" {
+			if m.PayloadSize, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return nil, err
+			}
+		}
+		if s := field("piece_size"); s != "" {
+			if m.PieceSize, err = strconv.ParseUint(s, 10, 64); err != nil {
+				return nil, err
+			}
+		}
+		manifests = append(manifests, m)
+	}
+	return manifests, nil
+}
@@ -0,0 +1,46 @@
+package graphsplit
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	detail := `{"Name":"","Hash":"bafy-root","Size":0,"Link":[{"Name":"a","Hash":"bafy-a","Size":10,"Link":null}]}`
+	cases := map[string]string{
+		// written by CSVCallback, detail is not quoted
+		"csv": "playload_cid,filename,detail\n" +
+			"bafy-root,test.car," + detail + "\n",
+		// written by CommPCallback
+		"commp": "playload_cid,filename,piece_cid,payload_size,piece_size,detail\r\n" +
+			`bafy-root,test.car,baga-piece,1000,1016,"{""Name"":"""",""Hash"":""bafy-root"",""Size"":0,""Link"":[{""Name"":""a"",""Hash"":""bafy-a"",""Size"":10,""Link"":null}]}"` + "\r\n",
+	}
+	dir, err := ioutil.TempDir(os.TempDir(), "test_manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range cases {
+		manifestPath := path.Join(dir, name+".csv")
+		if err := ioutil.WriteFile(manifestPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		manifests, err := ReadManifest(manifestPath)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(manifests) != 1 {
+			t.Fatalf("%s: Unexpected number of rows: %d", name, len(manifests))
+		}
+		m := manifests[0]
+		if m.PayloadCid != "bafy-root" || m.Filename != "test.car" || m.Detail != detail {
+			t.Fatalf("%s: Unexpected manifest: %+v", name, m)
+		}
+		if name == "commp" && (m.PieceCid != "baga-piece" || m.PayloadSize != 1000 || m.PieceSize != 1016) {
+			t.Fatalf("%s: Unexpected piece info: %+v", name, m)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package graphsplit
+
+import (
+	"io"
+	"os"
+	pa "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// splitFile is a file that Chunk split across several graph slices
+type splitFile struct {
+	Path string
+	// -1 if unknown
+	FileSize      int64
+	FileChecksums map[string]string
+	Parts         []splitPart
+}
+
+type splitPart struct {
+	Index int
+	// link path of the part inside its graph slice
+	LinkPath string
+	// -1 if unknown
+	Size       int64
+	PayloadCid string
+	GraphName  string
+}
+
+// splitFilesFromIndex lists the split files recorded in the file index
+func splitFilesFromIndex(entries []FileIndexEntry) []*splitFile {
+	byPath := make(map[string]*splitFile)
+	for _, entry := range entries {
+		if !entry.IsPart() {
+			continue
+		}
+		sf, ok := byPath[entry.Path]
+		if !ok {
+			sf = &splitFile{Path: entry.Path, FileSize: entry.FileSize}
+			byPath[entry.Path] = sf
+		}
+		if entry.FileChecksums != nil {
+			sf.FileChecksums = entry.FileChecksums
+		}
+		sf.Parts = append(sf.Parts, splitPart{
+			Index:      entry.Part,
+			LinkPath:   pa.Join(pa.Dir(entry.Path), entry.Name),
+			Size:       entry.Size,
+			PayloadCid: entry.PayloadCid,
+			GraphName:  entry.GraphName,
+		})
+	}
+	return sortedSplitFiles(byPath)
+}
+
+// splitFilesFromManifest lists the split files found in the detail column of
+// the manifest. Sizes are unknown there, and a file is only taken as split
+// if it has more than one part, as Chunk never writes a single part.
+func splitFilesFromManifest(manifests []Manifest) ([]*splitFile, error) {
+	byPath := make(map[string]*splitFile)
+	for _, m := range manifests {
+		linkPaths, err := detailFilePaths(m.Detail)
+		if err != nil {
+			return nil, xerrors.Errorf("parse detail of %s: %w", m.PayloadCid, err)
+		}
+		for _, linkPath := range linkPaths {
+			logical := logicalPath(linkPath)
+			if logical == linkPath {
+				continue
+			}
+			sf, ok := byPath[logical]
+			if !ok {
+				sf = &splitFile{Path: logical, FileSize: -1}
+				byPath[logical] = sf
+			}
+			sf.Parts = append(sf.Parts, splitPart{
+				Index:      partIndexOf(linkPath),
+				LinkPath:   linkPath,
+				Size:       -1,
+				PayloadCid: m.PayloadCid,
+				GraphName:  m.Filename,
+			})
+		}
+	}
+	for p, sf := range byPath {
+		if len(sf.Parts) < 2 {
+			delete(byPath, p)
+		}
+	}
+	return sortedSplitFiles(byPath), nil
+}
+
+func sortedSplitFiles(byPath map[string]*splitFile) []*splitFile {
+	res := make([]*splitFile, 0, len(byPath))
+	for _, sf := range byPath {
+		sort.Slice(sf.Parts, func(i, j int) bool {
+			return sf.Parts[i].Index < sf.Parts[j].Index
+		})
+		res = append(res, sf)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Path < res[j].Path
+	})
+	return res
+}
+
+// MergeParts merges the parts of split files restored into dir. The files and
+// their parts are taken from the file index, or else the manifest, in carDir.
+// A part is only removed once its file has been merged and checked against the
+// expected size and checksum. Files with none of their parts restored are left
+// alone; for files with some parts missing, the error names the slices that
+// still have to be restored. Without index and manifest, it falls back to
+// finding parts by their names.
+func MergeParts(dir, carDir string, parallel int) error {
+	entries, err := ReadFileIndex(filepath.Join(carDir, FileIndexName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var splitFiles []*splitFile
+	if len(entries) > 0 {
+		splitFiles = splitFilesFromIndex(entries)
+	} else {
+		manifests, err := ReadManifest(filepath.Join(carDir, ManifestName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(manifests) == 0 {
+			log.Warn("neither file index nor manifest found, merge parts by their names")
+			Merge(dir, parallel)
+			return nil
+		}
+		if splitFiles, err = splitFilesFromManifest(manifests); err != nil {
+			return err
+		}
+	}
+
+	limitCh := make(chan struct{}, parallel)
+	lock := sync.Mutex{}
+	errs := make([]string, 0)
+	wg := sync.WaitGroup{}
+	for _, sf := range splitFiles {
+		wg.Add(1)
+		limitCh <- struct{}{}
+		go func(sf *splitFile) {
+			defer func() {
+				<-limitCh
+				wg.Done()
+			}()
+			if err := mergeSplitFile(dir, sf); err != nil {
+				lock.Lock()
+				errs = append(errs, err.Error())
+				lock.Unlock()
+			}
+		}(sf)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return xerrors.Errorf("%d files failed to merge:\n%s", len(errs), strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+func mergeSplitFile(dir string, sf *splitFile) error {
+	missing := make([]string, 0)
+	present := 0
+	for i, part := range sf.Parts {
+		if part.Index != i {
+			return xerrors.Errorf("%s: part %d is not recorded, found part %d instead", sf.Path, i, part.Index)
+		}
+		fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(part.LinkPath)))
+		switch {
+		case os.IsNotExist(err):
+			missing = append(missing, part.describe())
+		case err != nil:
+			return err
+		case part.Size >= 0 && fi.Size() != part.Size:
+			return xerrors.Errorf("%s: part %d has %d bytes, expected %d", sf.Path, part.Index, fi.Size(), part.Size)
+		default:
+			present++
+		}
+	}
+	// not restored, or merged already
+	if present == 0 {
+		return nil
+	}
+	if len(missing) > 0 {
+		return xerrors.Errorf("%s: %d of %d parts missing, restore %s", sf.Path, len(missing), len(sf.Parts), strings.Join(missing, ", "))
+	}
+
+	log.Info("merge to ", sf.Path)
+	fpath := filepath.Join(dir, filepath.FromSlash(sf.Path))
+	tmpPath := fpath + ".merging"
+	if err := concatParts(dir, sf, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return xerrors.Errorf("%s: %w", sf.Path, err)
+	}
+	if err := os.Rename(tmpPath, fpath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	for _, part := range sf.Parts {
+		if err := os.Remove(filepath.Join(dir, filepath.FromSlash(part.LinkPath))); err != nil {
+			log.Warn(err)
+		}
+	}
+	return nil
+}
+
+// concatParts writes the parts of sf one after another to outPath, and checks
+// the result against the size and the checksums of the file
+func concatParts(dir string, sf *splitFile, outPath string) error {
+	f, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	algos := make([]string, 0, len(sf.FileChecksums))
+	for algo := range sf.FileChecksums {
+		algos = append(algos, algo)
+	}
+	mh, err := newMultiHash(algos)
+	if err != nil {
+		return err
+	}
+	w := io.MultiWriter(f, mh)
+	var total int64
+	for _, part := range sf.Parts {
+		n, err := copyFile(w, filepath.Join(dir, filepath.FromSlash(part.LinkPath)))
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+	if sf.FileSize >= 0 && total != sf.FileSize {
+		return xerrors.Errorf("merged %d bytes, expected %d", total, sf.FileSize)
+	}
+	for algo, sum := range mh.Sums() {
+		if sum != sf.FileChecksums[algo] {
+			return xerrors.Errorf("%s checksum mismatch, expected %s, got %s", algo, sf.FileChecksums[algo], sum)
+		}
+	}
+	return f.Close()
+}
+
+func copyFile(w io.Writer, fpath string) (int64, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+func (p splitPart) describe() string {
+	if p.GraphName == "" {
+		return p.PayloadCid
+	}
+	return p.GraphName + " (" + p.PayloadCid + ")"
+}
@@ -0,0 +1,80 @@
+package graphsplit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeSplitFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("0123456789abcdefghij")
+	sum := sha256.Sum256(content)
+	newSplitFile := func(checksum string) *splitFile {
+		return &splitFile{
+			Path:          "sub/file.bin",
+			FileSize:      int64(len(content)),
+			FileChecksums: map[string]string{ChecksumSHA256: checksum},
+			Parts: []splitPart{
+				{Index: 0, LinkPath: "sub/file.bin.00000000", Size: 8, PayloadCid: "bafy-1", GraphName: "test-total-2-part-1.car"},
+				{Index: 1, LinkPath: "sub/file.bin.00000001", Size: 12, PayloadCid: "bafy-2", GraphName: "test-total-2-part-2.car"},
+			},
+		}
+	}
+	writeParts := func() {
+		if err := os.MkdirAll(filepath.Join(dir, "sub"), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "sub/file.bin.00000000"), content[:8], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "sub/file.bin.00000001"), content[8:], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// parts are kept when the checksum does not match
+	writeParts()
+	if err := mergeSplitFile(dir, newSplitFile("bad")); err == nil {
+		t.Fatal("expect checksum mismatch")
+	}
+	for _, name := range []string{"sub/file.bin.00000000", "sub/file.bin.00000001"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("part should be kept: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub/file.bin")); !os.IsNotExist(err) {
+		t.Fatal("file should not be merged")
+	}
+
+	// a missing part is reported with the slice holding it
+	if err := os.Remove(filepath.Join(dir, "sub/file.bin.00000001")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mergeSplitFile(dir, newSplitFile(hex.EncodeToString(sum[:]))); err == nil {
+		t.Fatal("expect missing part")
+	}
+
+	writeParts()
+	if err := mergeSplitFile(dir, newSplitFile(hex.EncodeToString(sum[:]))); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := ioutil.ReadFile(filepath.Join(dir, "sub/file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(merged) != string(content) {
+		t.Fatalf("Unexpected merged content: %q", merged)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub/file.bin.00000000")); !os.IsNotExist(err) {
+		t.Fatal("part should be removed after merge")
+	}
+}
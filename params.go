@@ -0,0 +1,268 @@
+package graphsplit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"sort"
+
+	ipld "github.com/ipfs/go-ipld-format"
+	"golang.org/x/xerrors"
+)
+
+// ParamsName is the name of the file in car-dir recording the parameters
+// of every chunk run, one line of JSON per run. It is kept apart from the
+// manifest, whose columns are read by other tools, and joined with its rows
+// by the payload cids of the slices.
+const ParamsName = "params.jsonl"
+
+// sort orders of the files to chunk
+const (
+	// the order of the walk: the entries of every directory by name, and
+	// the files under a directory before its next entry
+	SortByPath = "path"
+	// smallest files first
+	SortBySize = "size"
+	// oldest files first
+	SortByMtime = "mtime"
+	// the order of the entries of an archive read as a stream, as ChunkTar
+	// packs them, recorded in the params of its runs
+	SortByArchive = "archive"
+)
+
+// ChunkParams is everything the CAR files of a chunk run depend on, so that
+// a slice can be regenerated byte for byte from the same source
+type ChunkParams struct {
+	GraphName string `json:"graphName"`
+	SliceSize int64  `json:"sliceSize"`
+	// where the files were read from: the directory of the file system
+	// for dir, the archive for tar and tar.zst, an s3://bucket/prefix,
+	// or - for stdin
+	Source      string `json:"source"`
+	InputFormat string `json:"inputFormat"`
+	// the path chunked in the file system of the source
+	Root      string `json:"root"`
+	SortOrder string `json:"sortOrder"`
+	// the inventory the files were read from, if any
+	Inventory string `json:"inventory,omitempty"`
+	// the files chunked, if not all the files that are not hidden
+	Filter *FileFilter `json:"filter,omitempty"`
+	// split files are cut at multiples of ChunkSize
+	AlignCuts bool `json:"alignCuts,omitempty"`
+	// layout of the UnixFS DAG
+	CidVersion    int    `json:"cidVersion"`
+	HashFunction  string `json:"hashFunction"`
+	ChunkSize     uint64 `json:"chunkSize"`
+	LinksPerLevel int    `json:"linksPerLevel"`
+	RawLeaves     bool   `json:"rawLeaves"`
+	// the slices made, in order
+	Slices []ChunkSlice `json:"slices"`
+}
+
+// ChunkSlice is a slice of a chunk run
+type ChunkSlice struct {
+	Name       string `json:"name"`
+	PayloadCid string `json:"payloadCid"`
+}
+
+func (o *chunkOptions) params(graphName string, sliceSize int64, root string) *ChunkParams {
+	var filter *FileFilter
+	if !o.selection.isZero() {
+		filter = &o.selection
+	}
+	return &ChunkParams{
+		GraphName:     graphName,
+		SliceSize:     sliceSize,
+		Source:        o.source,
+		InputFormat:   o.inputFormat,
+		Root:          root,
+		SortOrder:     o.sortOrder,
+		Inventory:     o.inventory,
+		Filter:        filter,
+		AlignCuts:     o.alignCuts,
+		CidVersion:    1,
+		HashFunction:  "sha2-256",
+		ChunkSize:     UnixfsChunkSize,
+		LinksPerLevel: UnixfsLinksPerLevel,
+		RawLeaves:     false,
+		Slices:        make([]ChunkSlice, 0),
+	}
+}
+
+// check tells if the CAR files of p are built as this version builds them
+func (p *ChunkParams) check() error {
+	expect := (&chunkOptions{}).params("", 0, "")
+	if p.CidVersion != expect.CidVersion || p.HashFunction != expect.HashFunction || p.ChunkSize != expect.ChunkSize ||
+		p.LinksPerLevel != expect.LinksPerLevel || p.RawLeaves != expect.RawLeaves {
+		return xerrors.Errorf("slices of %s are laid out with cid version %d, %s, chunks of %d bytes, %d links per level and raw leaves %t, which are not supported",
+			p.GraphName, p.CidVersion, p.HashFunction, p.ChunkSize, p.LinksPerLevel, p.RawLeaves)
+	}
+	return nil
+}
+
+// appendParams records a chunk run in s
+func appendParams(s Sink, p *ChunkParams) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return s.Append(ParamsName, nil, append(data, '\n'))
+}
+
+// FindChunkParams finds the latest chunk run in the params file at
+// paramsPath that made the slice of payloadCid
+func FindChunkParams(paramsPath, payloadCid string) (*ChunkParams, *ChunkSlice, error) {
+	f, err := os.Open(paramsPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var found *ChunkParams
+	var slice *ChunkSlice
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<30)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var p ChunkParams
+		if err := json.Unmarshal(sc.Bytes(), &p); err != nil {
+			return nil, nil, xerrors.Errorf("read %s: %w", paramsPath, err)
+		}
+		for i := range p.Slices {
+			if p.Slices[i].PayloadCid == payloadCid {
+				found, slice = &p, &p.Slices[i]
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, err
+	}
+	if found == nil {
+		return nil, nil, xerrors.Errorf("no chunk run in %s made the slice of %s, which has to be the %s written with its manifest", paramsPath, payloadCid, ParamsName)
+	}
+	return found, slice, nil
+}
+
+// sortFiles sorts the files to chunk by order, keeping the order of the walk
+// between files of the same key
+func sortFiles(files []Finfo, order string) {
+	switch order {
+	case SortBySize:
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].Info.Size() < files[j].Info.Size()
+		})
+	case SortByMtime:
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].Info.ModTime().Before(files[j].Info.ModTime())
+		})
+	}
+}
+
+// paramsCallback records the slices of a run in its params
+type paramsCallback struct {
+	GraphBuildCallback
+	params *ChunkParams
+}
+
+func (cc *paramsCallback) OnSuccess(node ipld.Node, graphName, fsDetail string) {
+	cc.params.Slices = append(cc.params.Slices, ChunkSlice{Name: graphName, PayloadCid: node.Cid().String()})
+	cc.GraphBuildCallback.OnSuccess(node, graphName, fsDetail)
+}
+
+func (cc *paramsCallback) Err() error {
+	return callbackErr(cc.GraphBuildCallback)
+}
+
+type regenerateCallback struct {
+	payloadCid string
+	err        error
+	done       bool
+}
+
+func (cc *regenerateCallback) OnSuccess(node ipld.Node, graphName, fsDetail string) {
+	cc.done = true
+	if node.Cid().String() != cc.payloadCid {
+		cc.err = xerrors.Errorf("%s is regenerated with payload cid %s, expect %s, the source has changed", graphName, node.Cid(), cc.payloadCid)
+	}
+}
+
+func (cc *regenerateCallback) OnError(err error) {
+	cc.err = err
+}
+
+// Regenerate rebuilds the CAR file of the slice of payloadCid made by the
+// chunk run of params, from the files under params.Root in fsys, and writes
+// it to outDir. The source is planned again as the run planned it, from
+// its inventory if it is still there, but only the files of the slice are
+// read. It fails, leaving no CAR file, if the
+// slice rebuilt has another payload cid, as it does if the source changed.
+func Regenerate(ctx context.Context, params *ChunkParams, fsys fs.FS, payloadCid, outDir string, parallel int, opts ...ChunkOption) error {
+	if err := params.check(); err != nil {
+		return err
+	}
+	var name string
+	for _, s := range params.Slices {
+		if s.PayloadCid == payloadCid {
+			name = s.Name
+		}
+	}
+	if name == "" {
+		return xerrors.Errorf("%s is not a slice of %s", payloadCid, params.GraphName)
+	}
+	sortOrder := params.SortOrder
+	if sortOrder == SortByArchive {
+		// the same if the archive is sorted by name
+		sortOrder = SortByPath
+	}
+	cb := &regenerateCallback{payloadCid: payloadCid}
+	sink := &regenerateSink{Sink: DirSink(outDir), payloadCid: payloadCid}
+	if params.Inventory != "" {
+		if _, err := os.Stat(params.Inventory); err == nil {
+			opts = append(opts, WithInventory(params.Inventory))
+		}
+	}
+	if params.Filter != nil {
+		opts = append(opts, WithFilter(*params.Filter))
+	}
+	if params.AlignCuts {
+		opts = append(opts, WithAlignedCuts())
+	}
+	opts = append(opts,
+		WithSortOrder(sortOrder),
+		WithSource(params.Source, params.InputFormat),
+		WithSink(sink),
+		withSlice(name),
+	)
+	if err := ChunkFS(ctx, params.SliceSize, fsys, params.Root, outDir, params.GraphName, parallel, cb, opts...); err != nil {
+		return err
+	}
+	if cb.err != nil {
+		return cb.err
+	}
+	if !cb.done {
+		return xerrors.Errorf("%s is not planned from the source, the source has changed", name)
+	}
+	return nil
+}
+
+// regenerateSink only commits the CAR file of the slice regenerated
+type regenerateSink struct {
+	Sink
+	payloadCid string
+}
+
+func (s *regenerateSink) Create(name string, size int64) (SinkWriter, error) {
+	w, err := s.Sink.Create(name, size)
+	if err != nil {
+		return nil, err
+	}
+	if name != s.payloadCid+".car" {
+		w.Abort()
+		return nil, xerrors.Errorf("slice is regenerated as %s, expect %s.car, the source has changed", name, s.payloadCid)
+	}
+	return w, nil
+}
@@ -0,0 +1,105 @@
+package graphsplit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegenerate(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_regenerate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	for i := 0; i < 10; i++ {
+		p := filepath.Join(src, fmt.Sprintf("d%d", i%3), fmt.Sprintf("f%d.bin", i))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, bytes.Repeat([]byte{byte(i)}, 30000*(10-i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsys, _, err := LocalSource(src, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, order := range []string{SortByPath, SortBySize} {
+		carDir := filepath.Join(dir, "cars-"+order)
+		outDir := filepath.Join(dir, "out-"+order)
+		for _, d := range []string{carDir, outDir} {
+			if err := os.MkdirAll(d, 0777); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := Chunk(ctx, 100000, src, src, carDir, "test", 2, CSVCallback(carDir), WithSortOrder(order)); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(carDir, ParamsName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var run ChunkParams
+		if err := json.Unmarshal(data, &run); err != nil {
+			t.Fatal(err)
+		}
+		if run.SortOrder != order || len(run.Slices) < 3 {
+			t.Fatalf("expect slices in %s order, got %d in %s order", order, len(run.Slices), run.SortOrder)
+		}
+
+		// every slice is rebuilt byte for byte on its own
+		for _, s := range run.Slices {
+			params, _, err := FindChunkParams(filepath.Join(carDir, ParamsName), s.PayloadCid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Regenerate(ctx, params, fsys, s.PayloadCid, outDir, 2); err != nil {
+				t.Fatal(err)
+			}
+			expect, err := ioutil.ReadFile(filepath.Join(carDir, s.PayloadCid+".car"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(outDir, s.PayloadCid+".car"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, expect) {
+				t.Fatalf("%s in %s order is regenerated differently", s.Name, order)
+			}
+		}
+	}
+
+	// a changed source is detected, and no CAR file is left
+	if err := ioutil.WriteFile(filepath.Join(src, "d0", "f0.bin"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	carDir := filepath.Join(dir, "cars-"+SortByPath)
+	outDir := filepath.Join(dir, "out-changed")
+	if err := os.MkdirAll(outDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(carDir, ParamsName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var params ChunkParams
+	if err := json.Unmarshal(data, &params); err != nil {
+		t.Fatal(err)
+	}
+	if err := Regenerate(ctx, &params, fsys, params.Slices[0].PayloadCid, outDir, 2); err == nil {
+		t.Fatal("regenerated a slice of a changed source")
+	}
+	if entries, _ := ioutil.ReadDir(outDir); len(entries) != 0 {
+		t.Fatalf("expect no file left, got %d", len(entries))
+	}
+}
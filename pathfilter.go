@@ -0,0 +1,112 @@
+package graphsplit
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// pathFilter selects paths of the dataset by glob patterns such as
+// /sub/dir/*.txt, a pattern matching a directory selects everything below it
+type pathFilter struct {
+	patterns [][]string
+}
+
+// newPathFilter returns a filter of patterns, which selects everything if
+// there are no patterns
+func newPathFilter(patterns []string) (*pathFilter, error) {
+	pf := &pathFilter{}
+	if len(patterns) == 0 {
+		pf.patterns = [][]string{{}}
+		return pf, nil
+	}
+	for _, p := range patterns {
+		segs := splitPath(p)
+		for _, seg := range segs {
+			if _, err := path.Match(seg, ""); err != nil {
+				return nil, xerrors.Errorf("bad path pattern %q: %w", p, err)
+			}
+		}
+		pf.patterns = append(pf.patterns, segs)
+	}
+	return pf, nil
+}
+
+// splitPath splits a slash separated path relative to the graph root
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return []string{}
+	}
+	return strings.Split(p, "/")
+}
+
+// match reports whether p, or one of the directories containing it, is
+// matched by a pattern
+func (pf *pathFilter) match(p string) bool {
+	segs := splitPath(p)
+	for _, pat := range pf.patterns {
+		if len(pat) <= len(segs) && matchSegments(pat, segs) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayContain reports whether a path below the directory dir could be matched
+func (pf *pathFilter) mayContain(dir string) bool {
+	segs := splitPath(dir)
+	for _, pat := range pf.patterns {
+		n := len(pat)
+		if len(segs) < n {
+			n = len(segs)
+		}
+		if matchSegments(pat[:n], segs[:n]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pat, segs []string) bool {
+	for i := range pat {
+		if ok, _ := path.Match(pat[i], segs[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+var partSuffix = regexp.MustCompile(`\.[0-9]{8}$`)
+
+// logicalPath strips the part suffix that Chunk adds to the names of split
+// files. It is only a guess, used when there is no file index to tell.
+func logicalPath(p string) string {
+	return partSuffix.ReplaceAllString(p, "")
+}
+
+// detailFilePaths lists the paths of the files in the detail column of the
+// manifest, which is the json of the fsNode tree of a graph slice
+func detailFilePaths(detail string) ([]string, error) {
+	var root fsNode
+	if err := json.Unmarshal([]byte(detail), &root); err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0)
+	var walk func(dir string, links []fsNode)
+	walk = func(dir string, links []fsNode) {
+		for _, ln := range links {
+			p := path.Join(dir, ln.Name)
+			if len(ln.Link) > 0 {
+				walk(p, ln.Link)
+				continue
+			}
+			paths = append(paths, p)
+		}
+	}
+	walk("", root.Link)
+	return paths, nil
+}
@@ -0,0 +1,285 @@
+package graphsplit
+
+import (
+	"fmt"
+	"os"
+	pa "path"
+	"path/filepath"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"golang.org/x/xerrors"
+)
+
+// policies of restore for a path that has different content in two slices,
+// or in a slice and the output directory
+const (
+	// fail the CAR file that runs into the conflict
+	ConflictFail = "fail"
+	// keep the file of the slice whose CAR file comes first
+	ConflictKeepFirst = "keep-first"
+	// keep the file of the slice whose CAR file comes first at the path, and
+	// the others next to it as <path>.conflict-<cid>
+	ConflictRename = "rename"
+)
+
+func checkConflictPolicy(policy string) error {
+	switch policy {
+	case ConflictFail, ConflictKeepFirst, ConflictRename:
+		return nil
+	default:
+		return xerrors.Errorf("unknown conflict policy: %s", policy)
+	}
+}
+
+// pathClaim is what restore writes to a path of the output directory
+type pathClaim struct {
+	isDir bool
+	cid   cid.Cid
+	// index of the CAR file in the lexical order of the CAR files
+	car     int
+	carFile string
+	// held while the file is written
+	lock sync.Mutex
+	// set once the file is in place, a file that failed to be written is
+	// written again by the next slice claiming it, or by a retry
+	written bool
+}
+
+func conflictPath(p string, c cid.Cid) string {
+	return p + ".conflict-" + c.String()
+}
+
+func (w *restoreWriter) addConflict(desc string) {
+	log.Warn("conflict at ", desc)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.conflicts = append(w.conflicts, desc)
+}
+
+// claimFile decides where the file c of a slice goes, car being the index of
+// its CAR file. It returns the path to write to, or "" if there is nothing to
+// write, and holds the lock of that path until release is called, with
+// whether the file is in place. replace is set if the file there is of
+// another slice and is to be replaced.
+//
+// The same directory is in many slices, but a file should only be in one. If
+// two slices have different files at a path, the one whose CAR file comes
+// first takes it, whichever is restored first, so that the outcome does not
+// depend on the order the workers run in. A directory always takes a path
+// over a file, and the file goes to its conflict path unless the policy is to
+// fail.
+func (w *restoreWriter) claimFile(car int, carFile, p string, c cid.Cid) (target string, replace bool, release func(written bool), err error) {
+	w.lock.Lock()
+	cl, ok := w.claims[p]
+	if !ok {
+		cl = &pathClaim{cid: c, car: car, carFile: carFile}
+		cl.lock.Lock()
+		w.claims[p] = cl
+		w.lock.Unlock()
+		return p, false, cl.release, nil
+	}
+	if !cl.isDir && cl.cid.Equals(c) {
+		w.lock.Unlock()
+		// wait for the file to be written, and write it if that failed
+		cl.lock.Lock()
+		w.lock.Lock()
+		same := !cl.isDir && cl.cid.Equals(c)
+		w.lock.Unlock()
+		switch {
+		case !same:
+			// taken over meanwhile
+			cl.lock.Unlock()
+			return w.claimFile(car, carFile, p, c)
+		case cl.written:
+			cl.lock.Unlock()
+			return "", false, func(bool) {}, nil
+		}
+		return p, false, cl.release, nil
+	}
+	if isDir := cl.isDir; isDir || cl.car < car {
+		var first string
+		if isDir {
+			first = "a directory"
+		} else {
+			first = fmt.Sprintf("%s in %s", cl.cid, cl.carFile)
+		}
+		w.lock.Unlock()
+		desc := fmt.Sprintf("%s: %s and %s in %s", p, first, c, carFile)
+		w.addConflict(desc)
+		switch {
+		case w.policy == ConflictFail:
+			return "", false, nil, xerrors.Errorf("conflict at %s", desc)
+		case w.policy == ConflictKeepFirst && !isDir:
+			return "", false, func(bool) {}, nil
+		}
+		return w.claimFile(car, carFile, conflictPath(p, c), c)
+	}
+
+	// this slice comes first, take the path over from the one written
+	prevCid, prevCar, prevCarFile := cl.cid, cl.car, cl.carFile
+	cl.cid, cl.car, cl.carFile = c, car, carFile
+	w.lock.Unlock()
+	desc := fmt.Sprintf("%s: %s in %s and %s in %s", p, c, carFile, prevCid, prevCarFile)
+	w.addConflict(desc)
+	if w.policy == ConflictFail {
+		return "", false, nil, xerrors.Errorf("conflict at %s", desc)
+	}
+	cl.lock.Lock()
+	prevWritten := cl.written
+	cl.written = false
+	if w.policy == ConflictRename {
+		w.lock.Lock()
+		if _, claimed := w.claims[conflictPath(p, prevCid)]; !claimed {
+			w.claims[conflictPath(p, prevCid)] = &pathClaim{cid: prevCid, car: prevCar, carFile: prevCarFile, written: prevWritten}
+		}
+		w.lock.Unlock()
+		if err := w.moveAside(p, prevCid); err != nil {
+			cl.lock.Unlock()
+			return "", false, nil, err
+		}
+	}
+	return p, true, cl.release, nil
+}
+
+// release records whether the file claimed is in place, and lets the path go
+func (cl *pathClaim) release(written bool) {
+	if written {
+		cl.written = true
+	}
+	cl.lock.Unlock()
+}
+
+// moveAside moves the file at p in the output directory, whose cid is c, to
+// its conflict path. It fails rather than overwrite what is there already.
+func (w *restoreWriter) moveAside(p string, c cid.Cid) error {
+	fpath := filepath.Join(w.outputDir, filepath.FromSlash(p))
+	if _, err := os.Lstat(fpath); os.IsNotExist(err) {
+		return nil
+	}
+	target := filepath.Join(w.outputDir, filepath.FromSlash(conflictPath(p, c)))
+	if _, err := os.Lstat(target); err == nil {
+		return xerrors.Errorf("conflict at %s: %s exists already", p, conflictPath(p, c))
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(fpath, target)
+}
+
+// localFileCid computes the cid of a file in the output directory that is
+// not of any slice, as chunk would with the default cid version
+func localFileCid(fpath string) (cid.Cid, error) {
+	cidBuilder, err := merkledag.PrefixForCidVersion(1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	fi, err := os.Lstat(fpath)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fpath)
+		if err != nil {
+			return cid.Undef, err
+		}
+		data, err := unixfs.SymlinkData(target)
+		if err != nil {
+			return cid.Undef, err
+		}
+		nd := merkledag.NodeWithData(data)
+		if err := nd.SetCidBuilder(cidBuilder); err != nil {
+			return cid.Undef, err
+		}
+		return nd.Cid(), nil
+	}
+	nd, err := BuildFileNode(Finfo{Path: fpath, Name: fi.Name(), Info: fi}, discardDAGService{}, cidBuilder)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// ensureDir makes the directory p and its parents in the output directory. A
+// file that is in the way is moved to its conflict path, unless the policy is
+// to fail. A file that is not of any slice is named by the cid chunk would
+// give it.
+func (w *restoreWriter) ensureDir(p string) error {
+	if p == "" || p == "." {
+		return nil
+	}
+	w.lock.Lock()
+	cl, ok := w.claims[p]
+	if ok && cl.isDir {
+		w.lock.Unlock()
+		// wait until the directory is made
+		cl.lock.Lock()
+		cl.lock.Unlock()
+		return nil
+	}
+	if !ok {
+		cl = &pathClaim{isDir: true}
+		cl.lock.Lock()
+		w.claims[p] = cl
+	}
+	w.lock.Unlock()
+	var fileCid cid.Cid
+	var fileCar int
+	var fileCarFile string
+	var fileWritten bool
+	if ok {
+		cl.lock.Lock()
+		w.lock.Lock()
+		isDir := cl.isDir
+		fileCid, fileCar, fileCarFile, fileWritten = cl.cid, cl.car, cl.carFile, cl.written
+		w.lock.Unlock()
+		// made a directory by another worker meanwhile
+		if isDir {
+			cl.lock.Unlock()
+			return nil
+		}
+	}
+	defer cl.lock.Unlock()
+
+	if err := w.ensureDir(pa.Dir(p)); err != nil {
+		return err
+	}
+	fpath := filepath.Join(w.outputDir, filepath.FromSlash(p))
+	if ok {
+		// a file of another slice is at p
+		desc := fmt.Sprintf("%s: %s in %s and a directory", p, fileCid, fileCarFile)
+		w.addConflict(desc)
+		if w.policy == ConflictFail {
+			return xerrors.Errorf("conflict at %s", desc)
+		}
+		if err := w.moveAside(p, fileCid); err != nil {
+			return err
+		}
+		w.lock.Lock()
+		if _, claimed := w.claims[conflictPath(p, fileCid)]; !claimed {
+			w.claims[conflictPath(p, fileCid)] = &pathClaim{cid: fileCid, car: fileCar, carFile: fileCarFile, written: fileWritten}
+		}
+		cl.isDir = true
+		w.lock.Unlock()
+	} else if fi, err := os.Lstat(fpath); err == nil && !fi.IsDir() {
+		// a file of an earlier restore, or not restored at all
+		desc := fmt.Sprintf("%s: a file in the output directory and a directory", p)
+		w.addConflict(desc)
+		if w.policy == ConflictFail {
+			return xerrors.Errorf("conflict at %s", desc)
+		}
+		c, err := localFileCid(fpath)
+		if err != nil {
+			return err
+		}
+		if err := w.moveAside(p, c); err != nil {
+			return err
+		}
+	}
+	err := os.Mkdir(fpath, 0777)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,513 @@
+package graphsplit
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	pa "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipld/go-car"
+	"golang.org/x/xerrors"
+)
+
+// packing strategies of Reslice
+const (
+	// keep every file, and every part of a split file, as it is, so that all
+	// file cids stay the same. A slice is closed when the next file or part
+	// does not fit.
+	ResliceKeepParts = "keep-parts"
+	// fill every slice up to the slice size the way Chunk does, cutting files
+	// at the end of a slice. Files and parts cut differently than before are
+	// chunked again from the old CAR files and get new cids.
+	ResliceFill = "fill"
+)
+
+// ResliceMapName is the name of the mapping from old to new slices that
+// Reslice saves next to the new CAR files
+const ResliceMapName = "reslice.csv"
+
+var resliceMapHeader = []string{
+	"old_payload_cid", "old_filename", "new_payload_cid", "new_filename", "path", "old_cid", "new_cid",
+}
+
+// resliceUnit is a file, or a part of a split file, put in a new slice
+type resliceUnit struct {
+	e *treeEntry
+	// index of the part, -1 if the file is whole
+	part   int
+	offset int64
+	size   int64
+	// the old DAG of the same byte range, nil if it is chunked again
+	keep *treePart
+}
+
+func (u resliceUnit) linkName() string {
+	if u.part < 0 {
+		return pa.Base(u.e.Path)
+	}
+	return fmt.Sprintf("%s.%08d", pa.Base(u.e.Path), u.part)
+}
+
+func (u resliceUnit) linkPath() string {
+	return pa.Join(pa.Dir(u.e.Path), u.linkName())
+}
+
+type reslicer struct {
+	outDir     string
+	sliceSize  int64
+	strategy   string
+	cars       *carSet
+	cidBuilder cid.Builder
+	// names of the old slices by payload cid
+	graphNames map[string]string
+	// checksums kept in the old file index, of the byte range of each cid and
+	// of each whole file by path
+	algos     []string
+	rangeSums map[string]map[string]string
+	fileSums  map[string]map[string]string
+	mapRows   [][]string
+}
+
+// Reslice packs the files of the dataset in the CAR files of carDir into new
+// slices of sliceSize in outDir, named after graphName as Chunk does, without
+// the source data. The blocks of files kept as they are, see strategy, are
+// copied from the old CAR files. A file index is saved with the checksums of
+// the old one carried over, the manifest is saved through cb, and
+// ResliceMapName records which new slice every byte range of the old slices
+// went to.
+func Reslice(ctx context.Context, carDir, outDir string, sliceSize int64, strategy, graphName string, cb GraphBuildCallback) error {
+	if sliceSize <= 0 {
+		return xerrors.Errorf("Unexpected! Slice size has to be greater than 0")
+	}
+	if strategy != ResliceKeepParts && strategy != ResliceFill {
+		return xerrors.Errorf("unknown packing strategy: %s", strategy)
+	}
+	for _, name := range []string{ManifestName, FileIndexName, ResliceMapName} {
+		if _, err := os.Stat(filepath.Join(outDir, name)); err == nil {
+			return xerrors.Errorf("%s already has a %s, reslice into an empty directory", outDir, name)
+		}
+	}
+	manifests, err := ReadManifest(filepath.Join(carDir, ManifestName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	entries, err := ReadFileIndex(filepath.Join(carDir, FileIndexName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	cidBuilder, err := merkledag.PrefixForCidVersion(1)
+	if err != nil {
+		return err
+	}
+	pf, err := newPathFilter(nil)
+	if err != nil {
+		return err
+	}
+	// planned from the file index, if there is one, without reading the CAR
+	// files, which are then read one after another as the files are
+	tree, err := loadDatasetTree(ctx, carDir, pf)
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+	tree.cars.maxOpen = 1
+
+	rs := &reslicer{
+		outDir:     outDir,
+		sliceSize:  sliceSize,
+		strategy:   strategy,
+		cars:       tree.cars,
+		cidBuilder: cidBuilder,
+		graphNames: make(map[string]string),
+		rangeSums:  make(map[string]map[string]string),
+		fileSums:   make(map[string]map[string]string),
+	}
+	for _, m := range manifests {
+		rs.graphNames[m.PayloadCid] = m.Filename
+	}
+	algos := make(map[string]bool)
+	for _, entry := range entries {
+		if len(entry.Checksums) > 0 {
+			rs.rangeSums[entry.Cid] = entry.Checksums
+		}
+		if len(entry.FileChecksums) > 0 {
+			rs.fileSums[entry.Path] = entry.FileChecksums
+		}
+		for algo := range entry.Checksums {
+			algos[algo] = true
+		}
+	}
+	for algo := range algos {
+		rs.algos = append(rs.algos, algo)
+	}
+	sort.Strings(rs.algos)
+
+	slices := rs.plan(tree)
+	for i, units := range slices {
+		if err := rs.writeSlice(ctx, units, GenGraphName(graphName, i, len(slices)), cb); err != nil {
+			return err
+		}
+	}
+	return rs.writeMap()
+}
+
+// plan packs the files of tree into slices in lexical order of their paths
+func (rs *reslicer) plan(tree *datasetTree) [][]resliceUnit {
+	var slices [][]resliceUnit
+	var cur []resliceUnit
+	var cumuSize int64
+	closeSlice := func() {
+		if len(cur) > 0 {
+			slices = append(slices, cur)
+		}
+		cur = nil
+		cumuSize = 0
+	}
+	add := func(u resliceUnit) {
+		cur = append(cur, u)
+		cumuSize += u.size
+		if cumuSize >= rs.sliceSize {
+			closeSlice()
+		}
+	}
+
+	for _, p := range tree.Paths() {
+		e := tree.entries[p]
+		switch {
+		case e.IsDir:
+			continue
+		case e.Symlink != "":
+			log.Warnf("leave out %s, symlinks are not kept by chunk", p)
+			continue
+		}
+		if rs.strategy == ResliceKeepParts {
+			offset := int64(0)
+			for i := range e.Parts {
+				part := &e.Parts[i]
+				if cumuSize > 0 && cumuSize+part.Size > rs.sliceSize {
+					closeSlice()
+				}
+				if part.Size > rs.sliceSize {
+					log.Warnf("%s is bigger than the slice size and gets a slice of its own", resliceUnit{e: e, part: part.Index}.linkName())
+				}
+				add(resliceUnit{e: e, part: part.Index, offset: offset, size: part.Size, keep: part})
+				offset += part.Size
+			}
+			continue
+		}
+
+		if cumuSize+e.Size <= rs.sliceSize {
+			add(rs.fillUnit(e, -1, 0, e.Size))
+			continue
+		}
+		// cut the file as chunk does, the first part fills up the slice
+		offset := int64(0)
+		for index := 0; offset < e.Size; index++ {
+			size := rs.sliceSize - cumuSize
+			if size > e.Size-offset {
+				size = e.Size - offset
+			}
+			add(rs.fillUnit(e, index, offset, size))
+			offset += size
+		}
+	}
+	closeSlice()
+	return slices
+}
+
+// fillUnit keeps the old DAG of the byte range if there is one
+func (rs *reslicer) fillUnit(e *treeEntry, index int, offset, size int64) resliceUnit {
+	u := resliceUnit{e: e, part: index, offset: offset, size: size}
+	partOffset := int64(0)
+	for i := range e.Parts {
+		if partOffset == offset && e.Parts[i].Size == size {
+			u.keep = &e.Parts[i]
+			break
+		}
+		partOffset += e.Parts[i].Size
+	}
+	return u
+}
+
+func (rs *reslicer) writeSlice(ctx context.Context, units []resliceUnit, graphName string, cb GraphBuildCallback) error {
+	mem := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	memDag := merkledag.NewDAGService(blockservice.New(mem, offline.Exchange(mem)))
+
+	dirs := make(map[string]*merkledag.ProtoNode)
+	var dirNode func(p string) *merkledag.ProtoNode
+	dirNode = func(p string) *merkledag.ProtoNode {
+		if nd, ok := dirs[p]; ok {
+			return nd
+		}
+		nd := unixfs.EmptyDirNode()
+		nd.SetCidBuilder(rs.cidBuilder)
+		dirs[p] = nd
+		if p != "." {
+			dirNode(pa.Dir(p))
+		}
+		return nd
+	}
+	root := dirNode(".")
+	old := &oldBlocks{cars: rs.cars, carOf: make(map[string]int)}
+	for _, u := range units {
+		if u.keep != nil {
+			old.keep(u.keep.Cid, u.keep.car)
+		}
+	}
+
+	entries := make([]FileIndexEntry, 0, len(units))
+	newCids := make([]cid.Cid, 0, len(units))
+	for _, u := range units {
+		nd, entry, err := rs.unitNode(ctx, memDag, u)
+		if err != nil {
+			return xerrors.Errorf("%s: %w", u.linkName(), err)
+		}
+		if err := dirNode(pa.Dir(u.e.Path)).AddNodeLink(u.linkName(), nd); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		newCids = append(newCids, nd.Cid())
+	}
+	// link the directories to their parents, the deepest first, as the cid
+	// of a directory changes with every link added
+	paths := make([]string, 0, len(dirs))
+	for p := range dirs {
+		if p != "." {
+			paths = append(paths, p)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		di, dj := strings.Count(paths[i], "/"), strings.Count(paths[j], "/")
+		if di != dj {
+			return di > dj
+		}
+		return paths[i] < paths[j]
+	})
+	for _, p := range paths {
+		if err := dirs[pa.Dir(p)].AddNodeLink(pa.Base(p), dirs[p]); err != nil {
+			return err
+		}
+	}
+	for _, nd := range dirs {
+		if err := memDag.Add(ctx, nd); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("write slice %s with root %s", graphName, root.Cid())
+	carF, err := os.Create(filepath.Join(rs.outDir, root.Cid().String()+".car"))
+	if err != nil {
+		return err
+	}
+	sc := car.NewSelectiveCar(ctx, &resliceStore{mem: mem, old: old}, []car.Dag{{Root: root.Cid(), Selector: allSelector()}})
+	if err := sc.Write(carF); err != nil {
+		carF.Close()
+		return err
+	}
+	if err := carF.Close(); err != nil {
+		return err
+	}
+
+	fsNode, err := NewFSBuilder(root, &resliceDAG{DAGService: memDag, old: old}).Build()
+	if err != nil {
+		return err
+	}
+	fsNodeBytes, err := json.Marshal(fsNode)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		entries[i].PayloadCid = root.Cid().String()
+		entries[i].GraphName = graphName
+	}
+	if err := appendFileIndex(DirSink(rs.outDir), entries); err != nil {
+		return err
+	}
+	if err := appendChecksumFiles(DirSink(rs.outDir), rs.algos, entries); err != nil {
+		return err
+	}
+	for i, u := range units {
+		rs.addMapRows(u, root.Cid(), graphName, newCids[i])
+	}
+	cb.OnSuccess(root, graphName, string(fsNodeBytes))
+	return callbackErr(cb)
+}
+
+// unitNode returns the file node of u, chunking its byte range again from
+// the old slices if it is not kept
+func (rs *reslicer) unitNode(ctx context.Context, memDag ipld.DAGService, u resliceUnit) (ipld.Node, FileIndexEntry, error) {
+	entry := FileIndexEntry{
+		Path:     u.e.Path,
+		Name:     u.linkName(),
+		Part:     u.part,
+		Offset:   u.offset,
+		Size:     u.size,
+		FileSize: u.e.Size,
+	}
+	var nd ipld.Node
+	if u.keep != nil {
+		var err error
+		nd, err = u.keep.dag.Get(ctx, u.keep.Cid)
+		if err != nil {
+			return nil, entry, err
+		}
+		entry.Checksums = rs.rangeSums[u.keep.Cid.String()]
+	} else {
+		f := &datasetFile{ctx: ctx, e: u.e, part: -1}
+		defer f.Close()
+		if _, err := f.Seek(u.offset, io.SeekStart); err != nil {
+			return nil, entry, err
+		}
+		var r io.Reader = io.LimitReader(f, u.size)
+		var rangeHash *multiHash
+		if len(rs.algos) > 0 {
+			var err error
+			if rangeHash, err = newMultiHash(rs.algos); err != nil {
+				return nil, entry, err
+			}
+			r = io.TeeReader(r, rangeHash)
+		}
+		var err error
+		nd, err = layoutFile(r, memDag, rs.cidBuilder)
+		if err != nil {
+			return nil, entry, err
+		}
+		if info, ok := unixfsInfoOf(nd); !ok || int64(info.Size) != u.size {
+			return nil, entry, xerrors.Errorf("expect %d bytes at %d, got fewer", u.size, u.offset)
+		}
+		if rangeHash != nil {
+			entry.Checksums = rangeHash.Sums()
+		}
+	}
+	entry.Cid = nd.Cid().String()
+	if u.offset+u.size == u.e.Size {
+		entry.FileChecksums = rs.fileSums[u.e.Path]
+		if entry.FileChecksums == nil && u.part < 0 {
+			entry.FileChecksums = entry.Checksums
+		}
+	}
+	return nd, entry, nil
+}
+
+// addMapRows maps the old byte ranges that u is made of to its new slice
+func (rs *reslicer) addMapRows(u resliceUnit, payloadCid cid.Cid, graphName string, c cid.Cid) {
+	offset := int64(0)
+	for _, part := range u.e.Parts {
+		end := offset + part.Size
+		if offset < u.offset+u.size && u.offset < end || u.size == 0 && part.Size == 0 {
+			rs.mapRows = append(rs.mapRows, []string{
+				part.Slice.String(), rs.graphNames[part.Slice.String()],
+				payloadCid.String(), graphName,
+				u.linkPath(), part.Cid.String(), c.String(),
+			})
+		}
+		offset = end
+	}
+}
+
+func (rs *reslicer) writeMap() error {
+	f, err := os.Create(filepath.Join(rs.outDir, ResliceMapName))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write(resliceMapHeader)
+	w.WriteAll(rs.mapRows)
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// oldBlocks finds the blocks of the files that a new slice keeps from the old
+// slices. The CAR file of each kept file is known from the tree, and its
+// blocks are taken to be in the same CAR file as they are reached from it,
+// so no index of all blocks is needed.
+type oldBlocks struct {
+	cars  *carSet
+	lock  sync.Mutex
+	carOf map[string]int
+}
+
+// keep records that the DAG of c is in the car-th CAR file
+func (ob *oldBlocks) keep(c cid.Cid, car int) {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	ob.carOf[string(c.Hash())] = car
+}
+
+func (ob *oldBlocks) getBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	ob.lock.Lock()
+	car, ok := ob.carOf[string(c.Hash())]
+	ob.lock.Unlock()
+	if !ok {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	blk, err := ob.cars.getBlock(ctx, car, c)
+	if err != nil {
+		return nil, err
+	}
+	nd, err := ipld.Decode(blk)
+	if err != nil {
+		return nil, err
+	}
+	for _, lk := range nd.Links() {
+		ob.keep(lk.Cid, car)
+	}
+	return blk, nil
+}
+
+// resliceDAG reads the nodes of a new slice, from memory if they are new or
+// else from the old CAR files
+type resliceDAG struct {
+	ipld.DAGService
+	old *oldBlocks
+}
+
+func (d *resliceDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	nd, err := d.DAGService.Get(ctx, c)
+	if !ipld.IsNotFound(err) {
+		return nd, err
+	}
+	blk, err := d.old.getBlock(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return ipld.Decode(blk)
+}
+
+func (d *resliceDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	return getManyLazily(ctx, d.Get, cids)
+}
+
+// resliceStore is resliceDAG for the blocks written to a CAR file
+type resliceStore struct {
+	mem bstore.Blockstore
+	old *oldBlocks
+}
+
+func (s *resliceStore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := s.mem.Get(ctx, c)
+	if ipld.IsNotFound(err) {
+		return s.old.getBlock(ctx, c)
+	}
+	return blk, err
+}
@@ -0,0 +1,136 @@
+package graphsplit
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	pa "path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReslice(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_reslice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// no two parts of big.bin are the same
+	big := make([]byte, 2500)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	files := map[string]string{
+		"a.txt":     strings.Repeat("a", 600),
+		"b/big.bin": string(big),
+		"c.txt":     strings.Repeat("c", 600),
+	}
+	_, carDir := chunkTestFiles(t, dir, files, 1000)
+	oldEntries, err := ReadFileIndex(filepath.Join(carDir, FileIndexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCids := make(map[string]string)
+	for _, e := range oldEntries {
+		oldCids[e.Cid] = e.PayloadCid
+	}
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		strategy  string
+		sliceSize int64
+		// files whose cids stay the same
+		kept []string
+	}{
+		{ResliceKeepParts, 2000, []string{"a.txt", "b/big.bin", "c.txt"}},
+		// a.txt and the first 900 bytes of big.bin fill the first slice
+		{ResliceFill, 1500, []string{"a.txt"}},
+	} {
+		outDir := filepath.Join(dir, c.strategy)
+		if err := os.MkdirAll(outDir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := Reslice(ctx, carDir, outDir, c.sliceSize, c.strategy, "new", CSVCallback(outDir)); err != nil {
+			t.Fatal(err)
+		}
+
+		fsys, err := OpenDataset(outDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for p, content := range files {
+			data, err := fs.ReadFile(fsys, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != content {
+				t.Fatalf("%s: content of %s does not match", c.strategy, p)
+			}
+		}
+		fsys.(io.Closer).Close()
+
+		newEntries, err := ReadFileIndex(filepath.Join(outDir, FileIndexName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range c.kept {
+			for _, e := range newEntries {
+				if e.Path == p && oldCids[e.Cid] == "" {
+					t.Fatalf("%s: expect %s to keep its cid, got %s", c.strategy, e.Name, e.Cid)
+				}
+			}
+		}
+		if c.strategy == ResliceFill {
+			for _, e := range newEntries {
+				if e.Path == "b/big.bin" && e.Offset == 0 && (e.Size != 900 || oldCids[e.Cid] != "") {
+					t.Fatalf("expect the first 900 bytes of big.bin chunked again, got %+v", e)
+				}
+			}
+		}
+
+		// every new byte range is mapped from the old ranges it overlaps
+		f, err := os.Open(filepath.Join(outDir, ResliceMapName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := csv.NewReader(f).ReadAll()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(rows[0], ",") != strings.Join(resliceMapHeader, ",") {
+			t.Fatalf("unexpected header %v", rows[0])
+		}
+		mapped := make(map[string]map[string]string)
+		for _, row := range rows[1:] {
+			if mapped[row[4]] == nil {
+				mapped[row[4]] = make(map[string]string)
+			}
+			mapped[row[4]][row[5]] = row[2] + " " + row[6]
+			if oldCids[row[5]] != row[0] {
+				t.Fatalf("%s: %s is not in old slice %s", c.strategy, row[5], row[0])
+			}
+		}
+		for _, e := range newEntries {
+			linkPath := pa.Join(pa.Dir(e.Path), e.Name)
+			want := 0
+			for _, old := range oldEntries {
+				if old.Path != e.Path || old.Offset >= e.Offset+e.Size || e.Offset >= old.Offset+old.Size {
+					continue
+				}
+				want++
+				if mapped[linkPath][old.Cid] != e.PayloadCid+" "+e.Cid {
+					t.Fatalf("%s: expect %s of %s mapped to %s in %s, got %q", c.strategy, old.Cid, linkPath, e.Cid, e.PayloadCid, mapped[linkPath][old.Cid])
+				}
+			}
+			if want == 0 || len(mapped[linkPath]) != want {
+				t.Fatalf("%s: expect %d old ranges mapped to %s, got %v", c.strategy, want, linkPath, mapped[linkPath])
+			}
+		}
+	}
+}
@@ -1,55 +1,762 @@
 package graphsplit
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"os"
 	pa "path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
-	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
-	"github.com/ipfs/go-datastore"
-	dss "github.com/ipfs/go-datastore/sync"
-	bstore "github.com/ipfs/go-ipfs-blockstore"
-	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
 	files "github.com/ipfs/go-libipfs/files"
-	"github.com/ipfs/go-merkledag"
 	unixfile "github.com/ipfs/go-unixfs/file"
 	"github.com/ipld/go-car"
 	"golang.org/x/xerrors"
 )
 
-func Import(ctx context.Context, path string, st car.Store) (cid.Cid, error) {
+// Import loads the blocks of the CAR file at path into st, and returns its
+// roots, all of them if it has more than one
+func Import(ctx context.Context, path string, st car.Store) ([]cid.Cid, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return cid.Undef, err
+		return nil, err
 	}
 	defer f.Close() //nolint:errcheck
 
-	stat, err := f.Stat()
+	// piece files have zero padding after the CAR
+	result, err := car.LoadCar(ctx, st, newCarPayloadReader(f))
 	if err != nil {
-		return cid.Undef, err
+		return nil, err
 	}
+	return result.Roots, nil
+}
+
+// carDAG is a read-only DAG service over the blocks of a CAR file, which are
+// read from the file as they are needed
+type carDAG struct {
+	Roots []cid.Cid
+	bs    *carBlockstore
+}
 
-	file, err := files.NewReaderPathFile(path, f, stat)
+var _ ipld.DAGService = (*carDAG)(nil)
+
+func openCarDAG(ctx context.Context, carPath string) (*carDAG, error) {
+	bs, err := openCarBlockstore(carPath)
 	if err != nil {
-		return cid.Undef, err
+		return nil, err
 	}
+	return &carDAG{Roots: bs.roots, bs: bs}, nil
+}
 
-	result, err := car.LoadCar(ctx, st, file)
+func (cd *carDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	blk, err := cd.bs.Get(ctx, c)
 	if err != nil {
-		return cid.Undef, err
+		return nil, err
 	}
+	return ipld.Decode(blk)
+}
+
+func (cd *carDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	return getManyLazily(ctx, cd.Get, cids)
+}
+
+// getManyLazily gets one node at a time as the receiver goes, rather than
+// all at once
+func getManyLazily(ctx context.Context, get func(context.Context, cid.Cid) (ipld.Node, error), cids []cid.Cid) <-chan *ipld.NodeOption {
+	ch := make(chan *ipld.NodeOption)
+	go func() {
+		defer close(ch)
+		for _, c := range cids {
+			nd, err := get(ctx, c)
+			select {
+			case ch <- &ipld.NodeOption{Node: nd, Err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func (cd *carDAG) Add(context.Context, ipld.Node) error {
+	return xerrors.New("CAR file is read-only")
+}
+
+func (cd *carDAG) AddMany(context.Context, []ipld.Node) error {
+	return xerrors.New("CAR file is read-only")
+}
 
-	if len(result.Roots) != 1 {
-		return cid.Undef, xerrors.New("cannot import car with more than one root")
+func (cd *carDAG) Remove(context.Context, cid.Cid) error {
+	return xerrors.New("CAR file is read-only")
+}
+
+func (cd *carDAG) RemoveMany(context.Context, []cid.Cid) error {
+	return xerrors.New("CAR file is read-only")
+}
+
+func (cd *carDAG) Close() error {
+	return cd.bs.Close()
+}
+
+// carDirOf returns the directory holding the manifest and the file index of
+// the CAR files at carPath, which is either a directory or a CAR file
+func carDirOf(carPath string) string {
+	if ExistDir(carPath) {
+		return carPath
 	}
+	return filepath.Dir(carPath)
+}
 
-	return result.Roots[0], nil
+// listCarFiles returns the CAR files under carPath. CAR files are found by
+// their header rather than their names, as chunk --add-padding --rename
+// leaves piece files named only by their piece cid.
+func listCarFiles(carPath string) ([]string, error) {
+	carFiles := make([]string, 0)
+	err := filepath.Walk(carPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if !isCarFile(path) {
+			if strings.ToLower(pa.Ext(fi.Name())) == ".car" {
+				log.Warn(path, ", it's not a CAR file, skip it")
+			}
+			return nil
+		}
+		carFiles = append(carFiles, path)
+		return nil
+	})
+	return carFiles, err
+}
+
+// payloadCidOf returns the payload cid of a CAR file. Piece files are mapped
+// through the manifest, otherwise the root in the header is taken.
+func payloadCidOf(carFile string, manifests []Manifest) string {
+	name := filepath.Base(carFile)
+	for _, m := range manifests {
+		if m.PieceCid != "" && m.PieceCid == name {
+			return m.PayloadCid
+		}
+	}
+	root, err := carRoot(carFile)
+	if err != nil {
+		return strings.TrimSuffix(name, pa.Ext(name))
+	}
+	return root.String()
+}
+
+// RestoreOption configures RestorePaths
+type RestoreOption func(*restoreOptions)
+
+type restoreOptions struct {
+	journal        string
+	retries        int
+	dumpRaw        bool
+	conflictPolicy string
+}
+
+// WithJournal keeps the progress of the restore in the journal at path, the
+// CAR files recorded there are skipped when the restore is run again
+func WithJournal(path string) RestoreOption {
+	return func(o *restoreOptions) {
+		o.journal = path
+	}
+}
+
+// WithRetries retries a CAR file up to n more times if restoring it failed
+// on a transient error of the file system, see isTransient
+func WithRetries(n int) RestoreOption {
+	return func(o *restoreOptions) {
+		o.retries = n
+	}
+}
+
+// WithRawBlocks writes the blocks of the roots that are not UnixFS to
+// outputDir/<root cid>.blocks, one file named by cid each
+func WithRawBlocks() RestoreOption {
+	return func(o *restoreOptions) {
+		o.dumpRaw = true
+	}
+}
+
+// WithConflictPolicy sets what to do with a path that has different content
+// in two slices, or in a slice and the output directory, one of ConflictFail,
+// the default, ConflictKeepFirst and ConflictRename
+func WithConflictPolicy(policy string) RestoreOption {
+	return func(o *restoreOptions) {
+		o.conflictPolicy = policy
+	}
+}
+
+// nodeWriteTo writes the files restored, it fails in tests
+var nodeWriteTo = NodeWriteTo
+
+// delay before the first retry, doubled for every following one
+var retryDelay = time.Second
+
+// RestoreResult is the outcome of RestorePaths
+type RestoreResult struct {
+	Restored []string
+	// CAR files found restored in the journal
+	Skipped []string
+	// files found restored already, by their size and checksum or cid
+	SkippedFiles int
+	Failed       map[string]error
+	// roots that are not UnixFS and were not restored
+	NonUnixFS []string
+	// paths that have different content in two slices, or in a slice and
+	// the output directory
+	Conflicts []string
+}
+
+// Err sums up the failed CAR files, it is nil if none failed
+func (r *RestoreResult) Err() error {
+	if len(r.Failed) == 0 {
+		return nil
+	}
+	lines := make([]string, 0, len(r.Failed))
+	for carFile, err := range r.Failed {
+		lines = append(lines, fmt.Sprintf("%s: %s", carFile, err))
+	}
+	sort.Strings(lines)
+	total := len(r.Restored) + len(r.Skipped) + len(r.Failed)
+	return xerrors.Errorf("%d of %d CAR files failed to restore:\n%s", len(r.Failed), total, strings.Join(lines, "\n"))
+}
+
+// RestorePaths restores the files matching the glob patterns, which are
+// paths relative to the dataset root such as /sub/dir or /sub/*.txt, or
+// everything if there are no patterns. The file index, or else the manifest,
+// next to the CAR files is used to pick the slices holding the files, and
+// only the matching part of each graph is traversed. Parts of split files are
+// left to MergeParts.
+//
+// Files that are in place already, with the same size and checksum or cid,
+// are not written again. A CAR file failing does not stop the others, the
+// failures are collected in the result. outputDir is made if it does not
+// exist.
+func RestorePaths(ctx context.Context, carPath, outputDir string, patterns []string, parallel int, opts ...RestoreOption) (*RestoreResult, error) {
+	o := &restoreOptions{conflictPolicy: ConflictFail}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := checkConflictPolicy(o.conflictPolicy); err != nil {
+		return nil, err
+	}
+	pf, err := newPathFilter(patterns)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outputDir, 0777); err != nil {
+		return nil, err
+	}
+	var journal *restoreJournal
+	if o.journal != "" {
+		if journal, err = openRestoreJournal(o.journal); err != nil {
+			return nil, xerrors.Errorf("open journal: %w", err)
+		}
+	}
+	filter := journalFilter(patterns)
+	carDir := carDirOf(carPath)
+	manifests, err := ReadManifest(filepath.Join(carDir, ManifestName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	entries, err := ReadFileIndex(filepath.Join(carDir, FileIndexName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// wanted holds the link paths to restore of each slice, keyed by payload
+	// cid. It stays nil when neither the file index nor the manifest is
+	// there, and every slice is searched then.
+	var wanted map[string]map[string]bool
+	addWanted := func(payloadCid, linkPath string) {
+		if wanted[payloadCid] == nil {
+			wanted[payloadCid] = make(map[string]bool)
+		}
+		wanted[payloadCid][linkPath] = true
+	}
+	// file index entry of each link path, keyed by payload cid
+	indexed := make(map[string]map[string]FileIndexEntry)
+	switch {
+	case len(entries) > 0:
+		wanted = make(map[string]map[string]bool)
+		for _, entry := range entries {
+			linkPath := pa.Join(pa.Dir(entry.Path), entry.Name)
+			if indexed[entry.PayloadCid] == nil {
+				indexed[entry.PayloadCid] = make(map[string]FileIndexEntry)
+			}
+			indexed[entry.PayloadCid][linkPath] = entry
+			if pf.match(entry.Path) {
+				addWanted(entry.PayloadCid, linkPath)
+			}
+		}
+	case len(manifests) > 0:
+		wanted = make(map[string]map[string]bool)
+		for _, m := range manifests {
+			linkPaths, err := detailFilePaths(m.Detail)
+			if err != nil {
+				return nil, xerrors.Errorf("parse detail of %s: %w", m.PayloadCid, err)
+			}
+			for _, linkPath := range linkPaths {
+				if pf.match(logicalPath(linkPath)) {
+					addWanted(m.PayloadCid, linkPath)
+				}
+			}
+		}
+	}
+
+	carFiles, err := listCarFiles(carPath)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, m := range manifests {
+		known[m.PayloadCid] = true
+	}
+	for _, entry := range entries {
+		known[entry.PayloadCid] = true
+	}
+
+	res := &RestoreResult{Failed: make(map[string]error)}
+	w := &restoreWriter{
+		outputDir:     outputDir,
+		manifests:     manifests,
+		dumpRaw:       o.dumpRaw,
+		policy:        o.conflictPolicy,
+		claims:        make(map[string]*pathClaim),
+		fileChecksums: make(map[string]map[string]string),
+		merged:        make(map[string]bool),
+	}
+	// only the row of the last part of a split file has the whole-file checksums
+	for _, entry := range entries {
+		if entry.IsPart() && len(entry.FileChecksums) > 0 {
+			w.fileChecksums[entry.Path] = entry.FileChecksums
+		}
+	}
+	lock := sync.Mutex{}
+	limitCh := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for car, carFile := range carFiles {
+		payloadCid := payloadCidOf(carFile, manifests)
+		var linkPaths map[string]bool
+		if wanted != nil {
+			linkPaths = wanted[payloadCid]
+			// skip the slices that are known to hold nothing wanted
+			if linkPaths == nil && known[payloadCid] {
+				continue
+			}
+		}
+		if journal != nil && journal.Done(payloadCid, filter) {
+			log.Infof("%s is restored already, skip it", carFile)
+			res.Skipped = append(res.Skipped, carFile)
+			continue
+		}
+		wg.Add(1)
+		limitCh <- struct{}{}
+		go func(car int, carFile, payloadCid string, linkPaths map[string]bool) {
+			defer func() {
+				<-limitCh
+				wg.Done()
+			}()
+			log.Info(carFile)
+			var skipped, left int
+			var err error
+			for attempt := 0; ; attempt++ {
+				skipped, left, err = w.restoreCar(ctx, car, carFile, pf, linkPaths, indexed[payloadCid])
+				if err == nil || attempt >= o.retries || !isTransient(err) || ctx.Err() != nil {
+					break
+				}
+				delay := retryDelay << attempt
+				log.Warnf("restore %s failed, retry in %s: %s", carFile, delay, err)
+				time.Sleep(delay)
+			}
+			switch {
+			case err != nil || journal == nil:
+			case left > 0:
+				// restored again with the raw blocks dumped
+				log.Warnf("%s is not recorded in the journal, %d of its roots are not UnixFS and not dumped", carFile, left)
+			default:
+				err = journal.Record(payloadCid, filter)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			res.SkippedFiles += skipped
+			if err != nil {
+				log.Errorf("restore %s: %s", carFile, err)
+				res.Failed[carFile] = err
+				return
+			}
+			res.Restored = append(res.Restored, carFile)
+		}(car, carFile, payloadCid, linkPaths)
+	}
+	wg.Wait()
+	sort.Strings(res.Restored)
+	sort.Strings(res.Skipped)
+	res.NonUnixFS = w.nonUnixFS
+	sort.Strings(res.NonUnixFS)
+	res.Conflicts = w.conflicts
+	sort.Strings(res.Conflicts)
+	return res, nil
+}
+
+// transientErrnos are the errors of the file system that may well go away
+// on retry: interrupted or busy calls, I/O errors and the timeouts and stale
+// handles of network file systems
+var transientErrnos = []syscall.Errno{
+	syscall.EINTR, syscall.EAGAIN, syscall.EBUSY, syscall.EIO, syscall.ETIMEDOUT, syscall.ESTALE,
+}
+
+// isTransient reports whether err is an error of the file system that may
+// well succeed on retry. Errors such as a missing file, a denied permission
+// or a full disk are not retried, nor are broken CAR files.
+func isTransient(err error) bool {
+	var timeout interface{ Timeout() bool }
+	if xerrors.As(err, &timeout) && timeout.Timeout() {
+		return true
+	}
+	var errno syscall.Errno
+	if !xerrors.As(err, &errno) {
+		return false
+	}
+	for _, e := range transientErrnos {
+		if errno == e {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreWriter writes the files of CAR files to outputDir
+type restoreWriter struct {
+	outputDir string
+	manifests []Manifest
+	dumpRaw   bool
+	policy    string
+	// whole-file checksums of split files, keyed by path
+	fileChecksums map[string]map[string]string
+	lock          sync.Mutex
+	// split files found merged already, keyed by path
+	merged map[string]bool
+	// roots that are not UnixFS
+	nonUnixFS []string
+	// what is written to each path
+	claims    map[string]*pathClaim
+	conflicts []string
+}
+
+// restoreCar writes the files of a CAR file that are selected by pf, or by
+// linkPaths if it is not nil, and returns the number of files skipped as they
+// were in place already, and of the roots that are not UnixFS and were left
+// out as their raw blocks are not dumped. indexed is the file index of the slice, if any.
+// Every root of the CAR file is restored, see rootDirNames for where to. car
+// is the index of the CAR file in the lexical order of all, which settles
+// conflicts with other slices, see claimFile.
+func (w *restoreWriter) restoreCar(ctx context.Context, car int, carFile string, pf *pathFilter, linkPaths map[string]bool, indexed map[string]FileIndexEntry) (int, int, error) {
+	cd, err := openCarDAG(ctx, carFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cd.Close()
+	if len(cd.Roots) == 0 {
+		return 0, 0, xerrors.New("no root in CAR file")
+	}
+
+	skipped := 0
+	writeNode := func(p string, nd ipld.Node, info *unixfsInfo) error {
+		if err := w.ensureDir(pa.Dir(p)); err != nil {
+			return err
+		}
+		target, replace, release, err := w.claimFile(car, carFile, p, nd.Cid())
+		if err != nil {
+			return err
+		}
+		// the claim of a file that is not in place is left to a retry,
+		// done is set once the file claimed last is
+		written := false
+		done := &written
+		defer func() { release(written) }()
+		if target == "" {
+			return nil
+		}
+		fpath := filepath.Join(w.outputDir, filepath.FromSlash(target))
+		var entry *FileIndexEntry
+		if e, ok := indexed[p]; ok && target == p {
+			entry = &e
+		}
+		if w.restoredAlready(ctx, cd, fpath, nd, info, entry) {
+			skipped++
+			written = true
+			return nil
+		}
+		if fi, err := os.Lstat(fpath); err == nil && !replace {
+			// a different file from an earlier restore, or not restored at all
+			desc := fmt.Sprintf("%s: a file in the output directory and %s in %s", target, nd.Cid(), carFile)
+			if fi.IsDir() {
+				desc = fmt.Sprintf("%s: a directory in the output directory and %s in %s", target, nd.Cid(), carFile)
+			}
+			w.addConflict(desc)
+			switch {
+			case w.policy == ConflictFail:
+				return xerrors.Errorf("conflict at %s", desc)
+			case w.policy == ConflictKeepFirst && !fi.IsDir():
+				return nil
+			}
+			var releaseAside func(bool)
+			target, _, releaseAside, err = w.claimFile(car, carFile, conflictPath(target, nd.Cid()), nd.Cid())
+			if err != nil {
+				return err
+			}
+			// the file at the path is not of this slice
+			aside := false
+			done = &aside
+			defer func() { releaseAside(aside) }()
+			if target == "" {
+				return nil
+			}
+			fpath = filepath.Join(w.outputDir, filepath.FromSlash(target))
+			if w.restoredAlready(ctx, cd, fpath, nd, info, nil) {
+				skipped++
+				aside = true
+				return nil
+			}
+		}
+		if info.Symlink != "" {
+			if err := os.Remove(fpath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		file, err := unixfile.NewUnixfsFile(ctx, cd, nd)
+		if err != nil {
+			return err
+		}
+		// blocks are read as the file is written, so a broken CAR file
+		// can fail half way, which must not leave a partial file behind
+		tmpPath := fpath + ".restoring"
+		err = nodeWriteTo(file, tmpPath)
+		file.Close()
+		if err == nil {
+			err = os.Rename(tmpPath, fpath)
+		}
+		if err != nil {
+			os.Remove(tmpPath)
+			return xerrors.Errorf("%s: %w", p, err)
+		}
+		*done = true
+		return nil
+	}
+
+	var walk func(nd ipld.Node, dir string) error
+	walk = func(nd ipld.Node, dir string) error {
+		links, err := dirLinks(ctx, cd, nd)
+		if err != nil {
+			return err
+		}
+		for _, lk := range links {
+			p := pa.Join(dir, lk.Name)
+			var isWanted bool
+			if linkPaths != nil {
+				isWanted = linkPaths[p]
+			} else {
+				isWanted = pf.match(logicalPath(p))
+			}
+			if !isWanted && !pf.mayContain(p) {
+				continue
+			}
+			child, err := lk.GetNode(ctx, cd)
+			if err != nil {
+				return err
+			}
+			info, ok := unixfsInfoOf(child)
+			if !ok {
+				log.Warnf("%s is not UnixFS, skip it", p)
+				continue
+			}
+			if info.IsDir {
+				if pf.match(p) {
+					if err := w.ensureDir(p); err != nil {
+						return err
+					}
+				}
+				if err := walk(child, p); err != nil {
+					return err
+				}
+				continue
+			}
+			if !isWanted {
+				continue
+			}
+			if err := writeNode(p, child, info); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	names := rootDirNames(cd.Roots, w.manifests)
+	left := 0
+	for _, root := range cd.Roots {
+		nd, err := cd.Get(ctx, root)
+		if err != nil {
+			return skipped, left, err
+		}
+		name := names[root]
+		info, ok := unixfsInfoOf(nd)
+		if !ok {
+			w.addNonUnixFS(nonUnixFSRoot(carFile, root))
+			if w.dumpRaw {
+				dir := filepath.Join(w.outputDir, root.String()+".blocks")
+				n, err := dumpRawBlocks(ctx, cd, root, dir)
+				if err != nil {
+					return skipped, left, err
+				}
+				log.Infof("dumped %d blocks of %s to %s", n, root, dir)
+			} else {
+				left++
+			}
+			continue
+		}
+		if info.IsDir {
+			if name != "" && pf.match(name) {
+				if err := w.ensureDir(name); err != nil {
+					return skipped, left, err
+				}
+			}
+			if err := walk(nd, name); err != nil {
+				return skipped, left, err
+			}
+			continue
+		}
+		// a root that is a single file is named after its cid
+		if name == "" {
+			name = root.String()
+		}
+		if pf.match(name) {
+			if err := writeNode(name, nd, info); err != nil {
+				return skipped, left, err
+			}
+		}
+	}
+	return skipped, left, nil
+}
+
+func (w *restoreWriter) addNonUnixFS(desc string) {
+	log.Warn(desc)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.nonUnixFS = append(w.nonUnixFS, desc)
+}
+
+// restoredAlready reports whether the file nd is in place at fpath, by its
+// size and then its checksums or its cid in the file index. Without an entry
+// in the file index, the CAR file may be chunked differently from what
+// graphsplit does, and the content is compared instead. For a part of a split
+// file, the merged file is checked against the whole-file checksums in the
+// file index.
+func (w *restoreWriter) restoredAlready(ctx context.Context, dag ipld.DAGService, fpath string, nd ipld.Node, info *unixfsInfo, entry *FileIndexEntry) bool {
+	fi, err := os.Lstat(fpath)
+	if err != nil {
+		if entry != nil && entry.IsPart() {
+			return w.mergedAlready(*entry)
+		}
+		return false
+	}
+	if info.Symlink != "" {
+		target, err := os.Readlink(fpath)
+		return err == nil && target == info.Symlink
+	}
+	if !fi.Mode().IsRegular() || uint64(fi.Size()) != info.Size {
+		return false
+	}
+	if entry != nil && len(entry.Checksums) > 0 {
+		for algo, sum := range entry.Checksums {
+			got, err := fileChecksum(algo, fpath)
+			if err != nil || got != sum {
+				return false
+			}
+		}
+		return true
+	}
+	if entry != nil {
+		item := Finfo{Path: fpath, Name: fi.Name(), Info: fi}
+		got, err := BuildFileNode(item, discardDAGService{}, nd.Cid().Prefix())
+		return err == nil && got.Cid().Equals(nd.Cid())
+	}
+	same, err := sameContent(ctx, dag, nd, fpath)
+	return err == nil && same
+}
+
+// sameContent compares the content of the file nd to the file at fpath
+func sameContent(ctx context.Context, dag ipld.DAGService, nd ipld.Node, fpath string) (bool, error) {
+	fnd, err := unixfile.NewUnixfsFile(ctx, dag, nd)
+	if err != nil {
+		return false, err
+	}
+	defer fnd.Close()
+	r, ok := fnd.(files.File)
+	if !ok {
+		return false, xerrors.Errorf("%s is not a file", nd.Cid())
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	bufA := make([]byte, 32<<10)
+	bufB := make([]byte, 32<<10)
+	for {
+		n, errA := io.ReadFull(r, bufA)
+		m, errB := io.ReadFull(f, bufB)
+		if n != m || !bytes.Equal(bufA[:n], bufB[:m]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+func (w *restoreWriter) mergedAlready(entry FileIndexEntry) bool {
+	sums := w.fileChecksums[entry.Path]
+	if len(sums) == 0 {
+		return false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if merged, ok := w.merged[entry.Path]; ok {
+		return merged
+	}
+	merged := false
+	fpath := filepath.Join(w.outputDir, filepath.FromSlash(entry.Path))
+	if fi, err := os.Stat(fpath); err == nil && fi.Mode().IsRegular() && fi.Size() == entry.FileSize {
+		merged = true
+		for algo, sum := range sums {
+			got, err := fileChecksum(algo, fpath)
+			if err != nil || got != sum {
+				merged = false
+				break
+			}
+		}
+	}
+	w.merged[entry.Path] = merged
+	return merged
 }
 
 func NodeWriteTo(nd files.Node, fpath string) error {
@@ -70,7 +777,7 @@ func NodeWriteTo(nd files.Node, fpath string) error {
 	case files.Directory:
 		if !ExistDir(fpath) {
 			err := os.Mkdir(fpath, 0777)
-			if err != nil && os.IsNotExist(err) {
+			if err != nil && !os.IsExist(err) {
 				return err
 			}
 		}
@@ -96,132 +803,25 @@ func ExistDir(path string) bool {
 	return s.IsDir()
 }
 
+// CarTo restores every file of the CAR files under carPath to outputDir, the
+// CAR files that fail are logged. Prefer RestorePaths, which returns them.
 func CarTo(carPath, outputDir string, parallel int) {
-	ctx := context.Background()
-
-	workerCh := make(chan func())
-	go func() {
-		defer close(workerCh)
-		err := filepath.Walk(carPath, func(path string, fi os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if fi.IsDir() {
-				return nil
-			}
-			if strings.ToLower(pa.Ext(fi.Name())) != ".car" {
-				log.Warn(path, ", it's not a CAR file, skip it")
-				return nil
-			}
-			workerCh <- func() {
-				bs2 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
-				rdag := merkledag.NewDAGService(blockservice.New(bs2, offline.Exchange(bs2)))
-				log.Info(path)
-				root, err := Import(ctx, path, bs2)
-				if err != nil {
-					log.Error("import error, ", err)
-					return
-				}
-				nd, err := rdag.Get(ctx, root)
-				if err != nil {
-					log.Error("dagService.Get error, ", err)
-					return
-				}
-				file, err := unixfile.NewUnixfsFile(ctx, rdag, nd)
-				if err != nil {
-					log.Error("NewUnixfsFile error, ", err)
-					return
-				}
-				defer file.Close()
-				err = NodeWriteTo(file, outputDir)
-				if err != nil {
-					log.Error("NodeWriteTo error, ", err)
-				}
-			}
-			return nil
-		})
-		if err != nil {
-			log.Error("Walk path failed, ", err)
-		}
-	}()
-
-	limitCh := make(chan struct{}, parallel)
-	wg := sync.WaitGroup{}
-	func() {
-		for {
-			select {
-			case taskFunc, ok := <-workerCh:
-				if !ok {
-					return
-				}
-				limitCh <- struct{}{}
-				wg.Add(1)
-				go func() {
-					defer func() {
-						<-limitCh
-						wg.Done()
-					}()
-					taskFunc()
-				}()
-			}
-		}
-	}()
-	wg.Wait()
+	res, err := RestorePaths(context.Background(), carPath, outputDir, nil, parallel)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err := res.Err(); err != nil {
+		log.Error(err)
+	}
 }
 
+// Merge merges the parts of split files in dir found by their names, e.g.
+// file.00000000, file.00000001. Prefer MergeParts, which knows the parts to
+// expect from the file index or the manifest.
 func Merge(dir string, parallel int) {
-	wg := sync.WaitGroup{}
-	limitCh := make(chan struct{}, parallel)
-	mergeCh := make(chan string)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			select {
-			case fpath, ok := <-mergeCh:
-				if !ok {
-					return
-				}
-				limitCh <- struct{}{}
-				wg.Add(1)
-				go func() {
-					defer func() {
-						<-limitCh
-						wg.Done()
-					}()
-					log.Info("merge to ", fpath)
-					f, err := os.Create(fpath)
-					if err != nil {
-						log.Error("Create file failed, ", err)
-						return
-					}
-					defer f.Close()
-					for i := 0; ; i++ {
-						chunkPath := fmt.Sprintf("%s.%08d", fpath, i)
-						err := func(path string) error {
-							chunkF, err := os.Open(path)
-							if err != nil {
-								if os.IsExist(err) {
-									log.Error("Open file failed, ", err)
-								}
-								return err
-							}
-							defer chunkF.Close()
-							_, err = io.Copy(f, chunkF)
-							if err != nil {
-								log.Error("io.Copy failed, ", err)
-							}
-							return err
-						}(chunkPath)
-						os.Remove(chunkPath)
-						if err != nil {
-							break
-						}
-					}
-				}()
-			}
-		}
-	}()
+	// list the first parts before merging, as parts are removed after merge
+	firstParts := make([]string, 0)
 	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -234,13 +834,67 @@ func Merge(dir string, parallel int) {
 			log.Error("filepath.Match failed, ", err)
 			return nil
 		} else if matched {
-			mergeCh <- strings.TrimSuffix(path, ".00000000")
+			firstParts = append(firstParts, path)
 		}
 		return nil
 	})
 	if err != nil {
 		log.Error("Walk path failed, ", err)
 	}
-	close(mergeCh)
+
+	wg := sync.WaitGroup{}
+	limitCh := make(chan struct{}, parallel)
+	for _, firstPart := range firstParts {
+		limitCh <- struct{}{}
+		wg.Add(1)
+		go func(fpath string) {
+			defer func() {
+				<-limitCh
+				wg.Done()
+			}()
+			if err := mergeByName(fpath); err != nil {
+				log.Error("merge failed, ", err)
+			}
+		}(strings.TrimSuffix(firstPart, ".00000000"))
+	}
 	wg.Wait()
 }
+
+func mergeByName(fpath string) error {
+	// a split file has at least two parts, a single one is a file of its own
+	if _, err := os.Stat(fmt.Sprintf("%s.%08d", fpath, 1)); err != nil {
+		log.Warnf("%s.00000000 has no following part, skip it", fpath)
+		return nil
+	}
+	log.Info("merge to ", fpath)
+	tmpPath := fpath + ".merging"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	parts := make([]string, 0)
+	for i := 0; ; i++ {
+		chunkPath := fmt.Sprintf("%s.%08d", fpath, i)
+		if _, err := os.Stat(chunkPath); os.IsNotExist(err) {
+			break
+		}
+		if _, err := copyFile(f, chunkPath); err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		parts = append(parts, chunkPath)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, fpath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	for _, chunkPath := range parts {
+		os.Remove(chunkPath)
+	}
+	return nil
+}
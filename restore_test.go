@@ -0,0 +1,347 @@
+package graphsplit
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-libipfs/files"
+	"golang.org/x/xerrors"
+)
+
+// chunkTestFiles writes files, by slash separated path, under dir/src and
+// chunks them into dir/cars with a file index
+func chunkTestFiles(t *testing.T, dir string, files map[string]string, sliceSize int64) (string, string) {
+	src := filepath.Join(dir, "src")
+	carDir := filepath.Join(dir, "cars")
+	if err := os.MkdirAll(carDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for p, content := range files {
+		fpath := filepath.Join(src, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(fpath), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fpath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Chunk(context.Background(), sliceSize, src, src, carDir, "test", 1, CSVCallback(carDir), WithFileIndex()); err != nil {
+		t.Fatal(err)
+	}
+	return src, carDir
+}
+
+func TestRestoreRetries(t *testing.T) {
+	for _, c := range []struct {
+		err       error
+		transient bool
+	}{
+		{&os.PathError{Op: "open", Path: "a", Err: syscall.EACCES}, false},
+		{&os.PathError{Op: "open", Path: "a", Err: syscall.ENOENT}, false},
+		{&os.PathError{Op: "write", Path: "a", Err: syscall.ENOSPC}, false},
+		{&os.PathError{Op: "write", Path: "a", Err: syscall.EROFS}, false},
+		{&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EEXIST}, false},
+		{xerrors.New("block does not match its data"), false},
+		{&os.PathError{Op: "read", Path: "a", Err: syscall.EIO}, true},
+		{xerrors.Errorf("a: %w", &os.PathError{Op: "write", Path: "a", Err: syscall.EINTR}), true},
+		{&os.PathError{Op: "read", Path: "a", Err: os.ErrDeadlineExceeded}, true},
+	} {
+		if isTransient(c.err) != c.transient {
+			t.Errorf("%s: expect transient %t", c.err, c.transient)
+		}
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test_restore_retries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, carDir := chunkTestFiles(t, dir, map[string]string{"a/x.txt": "x"}, 1<<20)
+
+	// a retry would wait for retryDelay
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = 10 * time.Second
+	ctx := context.Background()
+	outDir := filepath.Join(dir, "out")
+	if os.Geteuid() != 0 {
+		// a permission denied
+		if err := os.MkdirAll(outDir, 0555); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		// root is never denied, a file in the way fails as surely
+		if err := os.MkdirAll(outDir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(outDir, "a"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	res, err := RestorePaths(ctx, carDir, outDir, nil, 1, WithRetries(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Failed) != 1 {
+		t.Fatalf("expect the CAR file to fail, got %+v", res)
+	}
+	if elapsed := time.Since(start); elapsed >= retryDelay {
+		t.Fatalf("expect no retry, restore took %s", elapsed)
+	}
+	if err := res.Err(); err == nil || !strings.Contains(err.Error(), "1 of 1 CAR files failed") {
+		t.Fatalf("expect the failure summed up, got %v", err)
+	}
+
+	// a file failing to be written with EIO is written by the retry
+	_, carDir = chunkTestFiles(t, filepath.Join(dir, "eio"), map[string]string{"a/x.txt": "x", "a/y.txt": "y"}, 1<<20)
+	retryDelay = time.Millisecond
+	defer func(f func(files.Node, string) error) { nodeWriteTo = f }(nodeWriteTo)
+	failed := false
+	nodeWriteTo = func(nd files.Node, fpath string) error {
+		if strings.HasSuffix(fpath, "y.txt.restoring") && !failed {
+			failed = true
+			return &os.PathError{Op: "write", Path: fpath, Err: syscall.EIO}
+		}
+		return NodeWriteTo(nd, fpath)
+	}
+	// the output directory is made, with the journal in it
+	outDir = filepath.Join(dir, "eio", "out")
+	res, err = RestorePaths(ctx, carDir, outDir, nil, 1, WithRetries(1), WithJournal(filepath.Join(outDir, RestoreJournalName)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !failed || res.Err() != nil || len(res.Restored) != 1 {
+		t.Fatalf("expect the CAR file restored by the retry, got %+v", res)
+	}
+	for p, content := range map[string]string{"a/x.txt": "x", "a/y.txt": "y"} {
+		got, err := ioutil.ReadFile(filepath.Join(outDir, filepath.FromSlash(p)))
+		if err != nil || string(got) != content {
+			t.Fatalf("expect %q at %s, got %q %v", content, p, got, err)
+		}
+	}
+}
+
+func TestRestoreConflicts(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_restore_conflicts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// b is a file in one slice and a directory in the other, c is a
+	// directory in a slice and a file in the output directory
+	_, carDirA := chunkTestFiles(t, filepath.Join(dir, "a"), map[string]string{"a/x.txt": "one", "b": "file b"}, 1<<20)
+	_, carDirB := chunkTestFiles(t, filepath.Join(dir, "b"), map[string]string{"a/x.txt": "two", "b/y.txt": "y", "c/z.txt": "z"}, 1<<20)
+	carDir := filepath.Join(dir, "cars")
+	if err := os.MkdirAll(carDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	cids := make(map[string]string)
+	for _, d := range []string{carDirA, carDirB} {
+		entries, err := ReadFileIndex(filepath.Join(d, FileIndexName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			cids[d+":"+e.Path] = e.Cid
+		}
+		cars, err := filepath.Glob(filepath.Join(d, "*.car"))
+		if err != nil || len(cars) != 1 {
+			t.Fatalf("expect a CAR file in %s, got %v %v", d, cars, err)
+		}
+		if err := os.Rename(cars[0], filepath.Join(carDir, filepath.Base(cars[0]))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the slice whose CAR file comes first keeps a/x.txt
+	cars, err := listCarFiles(carDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := "one", "two"
+	secondCid := cids[carDirB+":a/x.txt"]
+	if _, err := os.Stat(filepath.Join(carDirA, filepath.Base(cars[0]))); os.IsNotExist(err) {
+		first, second = "two", "one"
+		secondCid = cids[carDirA+":a/x.txt"]
+	}
+	localCid, err := cid.Parse(cids[carDirA+":b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectFile := func(outDir, p, content string) {
+		t.Helper()
+		got, err := ioutil.ReadFile(filepath.Join(outDir, filepath.FromSlash(p)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Fatalf("expect %q at %s, got %q", content, p, got)
+		}
+	}
+	ctx := context.Background()
+	for _, policy := range []string{ConflictFail, ConflictKeepFirst, ConflictRename} {
+		for _, parallel := range []int{1, 2} {
+			outDir := filepath.Join(dir, fmt.Sprintf("out-%s-%d", policy, parallel))
+			if err := os.MkdirAll(outDir, 0777); err != nil {
+				t.Fatal(err)
+			}
+			// the same content as b, so that its conflict path is known
+			if err := ioutil.WriteFile(filepath.Join(outDir, "c"), []byte("file b"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			res, err := RestorePaths(ctx, carDir, outDir, nil, parallel, WithConflictPolicy(policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Conflicts) == 0 {
+				t.Fatalf("%s: expect conflicts, got %+v", policy, res)
+			}
+			if policy == ConflictFail {
+				if len(res.Failed) == 0 {
+					t.Fatalf("%s: expect a CAR file to fail, got %+v", policy, res)
+				}
+				continue
+			}
+			if len(res.Failed) != 0 {
+				t.Fatalf("%s: %v", policy, res.Err())
+			}
+			expectFile(outDir, "a/x.txt", first)
+			expectFile(outDir, "b/y.txt", "y")
+			expectFile(outDir, "c/z.txt", "z")
+			// a directory always takes the path over a file
+			expectFile(outDir, conflictPath("b", localCid), "file b")
+			expectFile(outDir, conflictPath("c", localCid), "file b")
+			_, err = os.Stat(filepath.Join(outDir, "a", "x.txt.conflict-"+secondCid))
+			if policy == ConflictRename {
+				expectFile(outDir, "a/x.txt.conflict-"+secondCid, second)
+			} else if !os.IsNotExist(err) {
+				t.Fatalf("%s: expect no conflict path of a/x.txt, got %v", policy, err)
+			}
+		}
+	}
+
+	// a file at the conflict path is not overwritten
+	outDir := filepath.Join(dir, "out-taken")
+	if err := os.MkdirAll(outDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, "c"), []byte("file b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, conflictPath("c", localCid)), []byte("taken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := RestorePaths(ctx, carDir, outDir, nil, 1, WithConflictPolicy(ConflictRename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := res.Err(); err == nil || !strings.Contains(err.Error(), "exists already") {
+		t.Fatalf("expect the taken conflict path to fail, got %v", err)
+	}
+	expectFile(outDir, conflictPath("c", localCid), "taken")
+	expectFile(outDir, "c", "file b")
+}
+
+func TestRestorePatterns(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_restore_patterns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	big := make([]byte, 2500)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	files := map[string]string{
+		"other/c.txt":   strings.Repeat("c", 400),
+		"other/d/e.txt": "e",
+		"sub/big.bin":   string(big),
+		"sub/x/a.txt":   "xa",
+		"sub/y/a.txt":   "ya",
+		"sub/y/b.txt":   "yb",
+		// the last slices hold nothing else
+		"top.txt": strings.Repeat("t", 1500),
+	}
+	_, carDir := chunkTestFiles(t, dir, files, 1000)
+	patterns := []string{"/sub/big.bin", "sub/*/a.txt", "/other"}
+	expect := []string{"other/c.txt", "other/d/e.txt", "sub/big.bin", "sub/x/a.txt", "sub/y/a.txt"}
+
+	// the slices holding the files wanted
+	entries, err := ReadFileIndex(filepath.Join(carDir, FileIndexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := make(map[string]bool)
+	for _, e := range entries {
+		for _, p := range expect {
+			if e.Path == p {
+				wanted[e.PayloadCid+".car"] = true
+			}
+		}
+	}
+	cars, err := filepath.Glob(filepath.Join(carDir, "*.car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wanted) == 0 || len(wanted) == len(cars) {
+		t.Fatalf("expect some of the %d CAR files to hold nothing wanted, %d do hold some", len(cars), len(wanted))
+	}
+
+	ctx := context.Background()
+	for _, index := range []bool{true, false} {
+		if !index {
+			// the manifest picks the same slices
+			if err := os.Rename(filepath.Join(carDir, FileIndexName), filepath.Join(dir, FileIndexName)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		outDir := filepath.Join(dir, fmt.Sprintf("out-%t", index))
+		res, err := RestorePaths(ctx, carDir, outDir, patterns, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := res.Err(); err != nil {
+			t.Fatal(err)
+		}
+		read := make(map[string]bool)
+		for _, carFile := range res.Restored {
+			read[filepath.Base(carFile)] = true
+		}
+		if fmt.Sprint(read) != fmt.Sprint(wanted) {
+			t.Fatalf("index %t: expect the CAR files %v read, got %v", index, wanted, read)
+		}
+		if err := MergeParts(outDir, carDir, 1); err != nil {
+			t.Fatal(err)
+		}
+		var restored []string
+		if err := filepath.Walk(outDir, func(fpath string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(outDir, fpath)
+			restored = append(restored, filepath.ToSlash(rel))
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(restored, ",") != strings.Join(expect, ",") {
+			t.Fatalf("index %t: expect %v restored, got %v", index, expect, restored)
+		}
+		for _, p := range expect {
+			got, err := ioutil.ReadFile(filepath.Join(outDir, filepath.FromSlash(p)))
+			if err != nil || string(got) != files[p] {
+				t.Fatalf("index %t: content of %s does not match: %v", index, p, err)
+			}
+		}
+	}
+}
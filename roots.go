@@ -0,0 +1,188 @@
+package graphsplit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	pa "path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+	"golang.org/x/xerrors"
+)
+
+// unixfsInfo describes a UnixFS node
+type unixfsInfo struct {
+	IsDir   bool
+	Symlink string
+	// size of the file content
+	Size uint64
+}
+
+// unixfsInfoOf tells what a node is in UnixFS. Raw blocks are files of their
+// own, as in CAR files made with raw leaves. It returns false for nodes that
+// are not UnixFS, such as DAG-CBOR.
+func unixfsInfoOf(nd ipld.Node) (*unixfsInfo, bool) {
+	switch nd := nd.(type) {
+	case *merkledag.RawNode:
+		return &unixfsInfo{Size: uint64(len(nd.RawData()))}, true
+	case *merkledag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return nil, false
+		}
+		switch {
+		case fsn.IsDir():
+			return &unixfsInfo{IsDir: true}, true
+		case fsn.Type() == unixfs.TSymlink:
+			return &unixfsInfo{Symlink: string(fsn.Data())}, true
+		default:
+			return &unixfsInfo{Size: fsn.FileSize()}, true
+		}
+	default:
+		return nil, false
+	}
+}
+
+// dirLinks lists the entries of a UnixFS directory, sharded ones included
+func dirLinks(ctx context.Context, dag ipld.DAGService, nd ipld.Node) ([]*ipld.Link, error) {
+	dir, err := uio.NewDirectoryFromNode(dag, nd)
+	if err != nil {
+		return nil, err
+	}
+	return dir.Links(ctx)
+}
+
+// resolvePath finds the node at the path of names below root, through
+// UnixFS directories. It returns the cids of the blocks the path goes
+// through as well, from root to the node, shards of sharded directories
+// included.
+func resolvePath(ctx context.Context, dag ipld.DAGService, root cid.Cid, names []string) (ipld.Node, []cid.Cid, error) {
+	rd := &recordingDAG{DAGService: dag}
+	nd, err := rd.Get(ctx, root)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, name := range names {
+		if info, ok := unixfsInfoOf(nd); !ok || !info.IsDir {
+			return nil, nil, xerrors.Errorf("%s: %w", pa.Join(names[:i+1]...), os.ErrNotExist)
+		}
+		dir, err := uio.NewDirectoryFromNode(rd, nd)
+		if err != nil {
+			return nil, nil, err
+		}
+		nd, err = dir.Find(ctx, name)
+		if os.IsNotExist(err) {
+			return nil, nil, xerrors.Errorf("%s: %w", pa.Join(names[:i+1]...), os.ErrNotExist)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return nd, rd.cids, nil
+}
+
+// recordingDAG notes the blocks got through it
+type recordingDAG struct {
+	ipld.DAGService
+	cids []cid.Cid
+}
+
+func (rd *recordingDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	rd.cids = append(rd.cids, c)
+	return rd.DAGService.Get(ctx, c)
+}
+
+func (rd *recordingDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	rd.cids = append(rd.cids, cids...)
+	return rd.DAGService.GetMany(ctx, cids)
+}
+
+// rootDirNames names the directories that the roots of a CAR file with more
+// than one root are restored into, after the slice in the manifest if the
+// root is a payload cid there, or else the root cid. A single root is
+// restored into the output directory itself and gets an empty name.
+func rootDirNames(roots []cid.Cid, manifests []Manifest) map[cid.Cid]string {
+	names := make(map[cid.Cid]string)
+	if len(roots) == 1 {
+		names[roots[0]] = ""
+		return names
+	}
+	graphNames := make(map[string]string)
+	for _, m := range manifests {
+		graphNames[m.PayloadCid] = strings.TrimSuffix(m.Filename, filepath.Ext(m.Filename))
+	}
+	used := make(map[string]bool)
+	for _, root := range roots {
+		name := graphNames[root.String()]
+		if name == "" || used[name] {
+			name = root.String()
+		}
+		used[name] = true
+		names[root] = name
+	}
+	return names
+}
+
+var codecNames = map[uint64]string{
+	cid.DagProtobuf: "dag-pb",
+	cid.DagCBOR:     "dag-cbor",
+	cid.DagJSON:     "dag-json",
+	cid.Raw:         "raw",
+}
+
+// nonUnixFSRoot describes a root that restore could not write out as files
+func nonUnixFSRoot(carFile string, root cid.Cid) string {
+	codec, ok := codecNames[root.Type()]
+	if !ok {
+		codec = fmt.Sprintf("codec 0x%x", root.Type())
+	}
+	return fmt.Sprintf("%s: root %s (%s) is not UnixFS", carFile, root, codec)
+}
+
+// dumpRawBlocks writes every block reachable from root that is in the CAR
+// file to dir, one file named by cid each. Links of blocks that can not be
+// decoded are not followed.
+func dumpRawBlocks(ctx context.Context, cd *carDAG, root cid.Cid, dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return 0, err
+	}
+	seen := cid.NewSet()
+	queue := []cid.Cid{root}
+	n := 0
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if !seen.Visit(c) {
+			continue
+		}
+		blk, err := cd.bs.Get(ctx, c)
+		if ipld.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, c.String()), blk.RawData(), 0644); err != nil {
+			return n, err
+		}
+		n++
+		nd, err := ipld.Decode(blk)
+		if err != nil {
+			log.Warnf("can not decode %s, its links are not followed: %s", c, err)
+			continue
+		}
+		for _, lk := range nd.Links() {
+			queue = append(queue, lk.Cid)
+		}
+	}
+	if n == 0 {
+		return 0, xerrors.Errorf("no block of %s in the CAR file", root)
+	}
+	return n, nil
+}
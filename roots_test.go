@@ -0,0 +1,192 @@
+package graphsplit
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipfs/go-unixfs/hamt"
+	"github.com/multiformats/go-multihash"
+)
+
+// cborLinkBlock is a DAG-CBOR block of a map linking to c under "a"
+func cborLinkBlock(t *testing.T, c cid.Cid) blocks.Block {
+	// {"a": tag 42 of the cid bytes with the identity multibase prefix}
+	data := append([]byte{0xa1, 0x61, 'a', 0xd8, 0x2a, 0x58, byte(len(c.Bytes()) + 1), 0x00}, c.Bytes()...)
+	bc, err := cid.Prefix{Version: 1, Codec: cid.DagCBOR, MhType: multihash.SHA2_256, MhLength: -1}.Sum(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := blocks.NewBlockWithCid(data, bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blk
+}
+
+func TestUnixFSNodes(t *testing.T) {
+	ctx := context.Background()
+	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dag := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	file := merkledag.NodeWithData(unixfs.FilePBData([]byte("hello"), 5))
+	symlink, err := unixfs.SymlinkData("../target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := unixfs.EmptyDirNode()
+	if err := dir.AddNodeLink("hello.txt", file); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		nd   ipld.Node
+		info *unixfsInfo
+	}{
+		{merkledag.NewRawNode([]byte("raw")), &unixfsInfo{Size: 3}},
+		{file, &unixfsInfo{Size: 5}},
+		{merkledag.NodeWithData(symlink), &unixfsInfo{Symlink: "../target"}},
+		{dir, &unixfsInfo{IsDir: true}},
+		{merkledag.NodeWithData([]byte("not unixfs")), nil},
+	} {
+		info, ok := unixfsInfoOf(c.nd)
+		if ok != (c.info != nil) || ok && !reflect.DeepEqual(info, c.info) {
+			t.Fatalf("%s: expect %+v, got %+v", c.nd.Cid(), c.info, info)
+		}
+	}
+
+	// the links of a sharded directory are listed as the ones of a plain one
+	if err := dag.AddMany(ctx, []ipld.Node{file, dir}); err != nil {
+		t.Fatal(err)
+	}
+	shard, err := hamt.NewShard(dag, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"a", "b", "c", "d"}
+	for _, name := range names {
+		if err := shard.Set(ctx, name, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shardNode, err := shard.Node()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dag.Add(ctx, shardNode); err != nil {
+		t.Fatal(err)
+	}
+	for nd, expect := range map[ipld.Node][]string{dir: {"hello.txt"}, shardNode: names} {
+		links, err := dirLinks(ctx, dag, nd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, lk := range links {
+			got = append(got, lk.Name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("expect links %v, got %v", expect, got)
+		}
+	}
+}
+
+func TestRestoreNonUnixFSRoots(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_restore_roots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a CAR file of a UnixFS directory and a DAG-CBOR root linking to a raw
+	// block in the CAR file and to one that is not
+	file := merkledag.NodeWithData(unixfs.FilePBData([]byte("hello"), 5))
+	fsRoot := unixfs.EmptyDirNode()
+	if err := fsRoot.AddNodeLink("hello.txt", file); err != nil {
+		t.Fatal(err)
+	}
+	raw := merkledag.NewRawNode([]byte("raw data"))
+	rawRoot := cborLinkBlock(t, raw.Cid())
+	missing := cborLinkBlock(t, merkledag.NewRawNode([]byte("missing")).Cid())
+	carPath := filepath.Join(dir, "multi.car")
+	writeTestCar(t, carPath, []cid.Cid{fsRoot.Cid(), rawRoot.Cid(), missing.Cid()}, fsRoot, file, rawRoot, raw, missing)
+
+	ctx := context.Background()
+	// Import gives every root
+	roots, err := Import(ctx, carPath, bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 3 || !roots[0].Equals(fsRoot.Cid()) || !roots[2].Equals(missing.Cid()) {
+		t.Fatalf("expect 3 roots imported, got %v", roots)
+	}
+	outDir := filepath.Join(dir, "out")
+	if err := os.MkdirAll(outDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	journal := WithJournal(filepath.Join(dir, RestoreJournalName))
+	res, err := RestorePaths(ctx, carPath, outDir, nil, 1, journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := res.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.NonUnixFS) != 2 {
+		t.Fatalf("expect 2 roots reported, got %v", res.NonUnixFS)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(outDir, fsRoot.Cid().String(), "hello.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("expect hello.txt restored, got %q, %v", data, err)
+	}
+
+	// not journaled, so the raw blocks are dumped when asked for
+	res, err = RestorePaths(ctx, carPath, outDir, nil, 1, journal, WithRawBlocks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := res.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Skipped) != 0 || len(res.Restored) != 1 {
+		t.Fatalf("expect the CAR file restored again, got %+v", res)
+	}
+	for root, expect := range map[cid.Cid][]string{
+		rawRoot.Cid(): {raw.Cid().String(), rawRoot.Cid().String()},
+		missing.Cid(): {missing.Cid().String()},
+	} {
+		entries, err := os.ReadDir(filepath.Join(outDir, root.String()+".blocks"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		sort.Strings(expect)
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("expect blocks %v dumped, got %v", expect, got)
+		}
+	}
+	res, err = RestorePaths(ctx, carPath, outDir, nil, 1, journal, WithRawBlocks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Skipped) != 1 {
+		t.Fatalf("expect the CAR file journaled, got %+v", res)
+	}
+}
@@ -0,0 +1,479 @@
+package graphsplit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	pa "path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// payload hashes signed: the sha256 of an empty payload, and the one for
+// uploads, which are checked by their Content-MD5 or ETag instead
+const (
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+)
+
+// S3Config locates a bucket of an S3-compatible object store
+type S3Config struct {
+	// URL of the store, such as https://s3.amazonaws.com, or
+	// http://127.0.0.1:9000 for a local MinIO
+	Endpoint string
+	Region   string
+	Bucket   string
+	// key prefix of the objects, presented as the top directory
+	Prefix string
+	// requests are not signed without an access key
+	AccessKey string
+	SecretKey string
+	// defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// s3Client sends the requests for the objects under a prefix of a bucket
+type s3Client struct {
+	cfg    S3Config
+	client *http.Client
+	now    func() time.Time
+}
+
+func newS3Client(cfg S3Config) (*s3Client, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, xerrors.Errorf("s3 endpoint and bucket have to be set")
+	}
+	if _, err := url.Parse(cfg.Endpoint); err != nil {
+		return nil, err
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &s3Client{cfg: cfg, client: client, now: time.Now}, nil
+}
+
+// s3FS is a prefix of a bucket as a read-only file system
+type s3FS struct {
+	*s3Client
+}
+
+// OpenS3FS presents the objects of a bucket under a prefix as a read-only
+// file system, with the slashes of their keys as directories. It is a
+// RangeFS, so ChunkFS reads the parts of split files by range requests.
+// Requests use path-style URLs, which MinIO and S3 both serve, and are
+// signed with AWS Signature Version 4.
+func OpenS3FS(cfg S3Config) (fs.FS, error) {
+	c, err := newS3Client(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &s3FS{s3Client: c}, nil
+}
+
+// key is the object key of name
+func (s *s3Client) key(name string) string {
+	switch {
+	case name == ".":
+		return s.cfg.Prefix
+	case s.cfg.Prefix == "":
+		return name
+	default:
+		return s.cfg.Prefix + "/" + name
+	}
+}
+
+// do sends a signed request for the object key, or for the bucket if key is
+// empty, with size bytes of body if it is not nil, and fails unless it gets
+// a 2xx status. A 5xx status is retried if the request can be sent again.
+func (s *s3Client) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	delay := s3RetryDelay
+	for retry := 0; ; retry++ {
+		resp, err := s.send(method, key, query, header, body, size)
+		var status *s3StatusError
+		if !xerrors.As(err, &status) || status.code/100 != 5 || retry == s3Retries || !retryable(method, body) {
+			return resp, err
+		}
+		log.Warnf("%s, retry in %s", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+		if body != nil {
+			if _, err := body.(io.Seeker).Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// retries of a request answered with a 5xx error, such as a SlowDown, and
+// the delay before the first, which doubles with every one
+var (
+	s3Retries    = 4
+	s3RetryDelay = time.Second
+)
+
+// retryable tells if a request can be sent again: it is idempotent, which
+// the POSTs of multipart uploads are not, and its body can be read again
+func retryable(method string, body io.Reader) bool {
+	if method == http.MethodPost {
+		return false
+	}
+	_, ok := body.(io.Seeker)
+	return body == nil || ok
+}
+
+// s3StatusError is the error of a request not answered with 2xx
+type s3StatusError struct {
+	code int
+	msg  string
+}
+
+func (e *s3StatusError) Error() string {
+	return e.msg
+}
+
+func (s *s3Client) send(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(s.cfg.Endpoint + uriEncode("/"+s.cfg.Bucket+"/"+key, false))
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		req.ContentLength = size
+		payloadHash = unsignedPayload
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.cfg.AccessKey != "" {
+		signV4(req, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, payloadHash, s.now())
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fs.ErrNotExist
+	}
+	return nil, &s3StatusError{code: resp.StatusCode, msg: fmt.Sprintf("s3 %s %s: %s %s", method, u.Path, resp.Status, msg)}
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list lists the objects and common prefixes under the directory key,
+// limited to maxKeys if it is above zero
+func (s *s3Client) list(key string, maxKeys int) ([]fs.DirEntry, error) {
+	prefix := key
+	if prefix != "" {
+		prefix += "/"
+	}
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	var entries []fs.DirEntry
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var res listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, xerrors.Errorf("s3 list %s: %w", prefix, err)
+		}
+		for _, c := range res.Contents {
+			name := strings.TrimPrefix(c.Key, prefix)
+			// a marker object of the directory itself
+			if name == "" {
+				continue
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(&s3FileInfo{name: name, size: c.Size, modTime: c.LastModified}))
+		}
+		for _, cp := range res.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(cp.Prefix, prefix), "/")
+			entries = append(entries, fs.FileInfoToDirEntry(&s3FileInfo{name: name, dir: true}))
+		}
+		if !res.IsTruncated || maxKeys > 0 && len(entries) >= maxKeys {
+			break
+		}
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (s *s3FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &s3FileInfo{name: ".", dir: true}, nil
+	}
+	resp, err := s.do(http.MethodHead, s.key(name), nil, nil, nil, 0)
+	if err == nil {
+		resp.Body.Close()
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return &s3FileInfo{name: pa.Base(name), size: resp.ContentLength, modTime: modTime}, nil
+	}
+	if err != fs.ErrNotExist {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	// a directory is a prefix of some keys
+	entries, err := s.list(s.key(name), 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(entries) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return &s3FileInfo{name: pa.Base(name), dir: true}, nil
+}
+
+func (s *s3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries, err := s.list(s.key(name), 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if len(entries) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return entries, nil
+}
+
+func (s *s3FS) Open(name string) (fs.File, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &listedDir{path: name, info: info, list: func() ([]fs.DirEntry, error) {
+			return s.list(s.key(name), 0)
+		}}, nil
+	}
+	return &s3File{fs: s, name: name, info: info}, nil
+}
+
+func (s *s3FS) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	resp, err := s.do(http.MethodGet, s.key(name), nil, header, nil, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: xerrors.Errorf("range request got %s", resp.Status)}
+	}
+	return resp.Body, nil
+}
+
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *s3FileInfo) Name() string       { return fi.name }
+func (fi *s3FileInfo) Size() int64        { return fi.size }
+func (fi *s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *s3FileInfo) IsDir() bool        { return fi.dir }
+func (fi *s3FileInfo) Sys() interface{}   { return nil }
+
+func (fi *s3FileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// s3File is an open object, read by a GET from the offset on the first Read
+// after opening or seeking
+type s3File struct {
+	fs   *s3FS
+	name string
+	info fs.FileInfo
+	off  int64
+	body io.ReadCloser
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.off >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.fs.OpenRange(f.name, f.off, f.info.Size()-f.off)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(p)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.Size()
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset != f.off && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// signV4 signs req with AWS Signature Version 4 for s3, with the hex sha256
+// of its payload or unsignedPayload
+func signV4(req *http.Request, accessKey, secretKey, region, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, s := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key, as SigV4 signs it
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), query[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes all but the unreserved characters of s, and the
+// slashes unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
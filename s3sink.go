@@ -0,0 +1,401 @@
+package graphsplit
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// limits of the multipart uploads of s3
+const (
+	s3PartSize    = 16 << 20
+	s3MaxPartSize = 5 << 30
+	s3MaxParts    = 10000
+)
+
+// s3Sink writes the files as objects under a prefix of a bucket
+type s3Sink struct {
+	*s3Client
+	lock sync.Mutex
+	// local copies of the files appended to
+	appends map[string]*s3Append
+}
+
+// s3Append is the local copy of a file appended to
+type s3Append struct {
+	f *os.File
+	// appends since the last upload, and when that was
+	pending  int
+	uploaded time.Time
+}
+
+// a file appended to is uploaded once it has this many appends not uploaded
+// yet, or once its last upload is this old, and on Close
+var (
+	s3CheckpointAppends  = 64
+	s3CheckpointInterval = time.Minute
+)
+
+// OpenS3Sink writes the files as objects under the prefix of a bucket. The
+// files created are uploaded in parts, by multipart uploads completed when
+// they are committed, or by a single request if they are smaller than a
+// part. The files appended to, such as the manifest, are kept in local
+// temporary files that start from their objects. They are uploaded whole
+// on Close, and as checkpoints every s3CheckpointAppends appends or
+// s3CheckpointInterval, so that a run that stops leaves the manifest of most
+// slices written in the bucket, without uploading the files again on every
+// slice. Requests that can be sent again are retried on 5xx errors, such as
+// a SlowDown.
+func OpenS3Sink(cfg S3Config) (Sink, error) {
+	c, err := newS3Client(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Sink{s3Client: c, appends: make(map[string]*s3Append)}, nil
+}
+
+func (s *s3Sink) Create(name string, size int64) (SinkWriter, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	partSize := int64(s3PartSize)
+	for size/partSize >= s3MaxParts {
+		partSize *= 2
+	}
+	return &s3Writer{s: s, key: s.key(name), partSize: int(partSize)}, nil
+}
+
+func (s *s3Sink) Append(name string, header, data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	a, ok := s.appends[name]
+	if !ok {
+		f, err := os.CreateTemp("", "graphsplit-sink-*")
+		if err != nil {
+			return err
+		}
+		os.Remove(f.Name())
+		resp, err := s.do(http.MethodGet, s.key(name), nil, nil, nil, 0)
+		switch {
+		case err == fs.ErrNotExist:
+			_, err = f.Write(header)
+		case err == nil:
+			_, err = io.Copy(f, resp.Body)
+			resp.Body.Close()
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		a = &s3Append{f: f, uploaded: s.now()}
+		s.appends[name] = a
+	}
+	if _, err := a.f.Write(data); err != nil {
+		return err
+	}
+	a.pending++
+	if a.pending < s3CheckpointAppends && s.now().Sub(a.uploaded) < s3CheckpointInterval {
+		return nil
+	}
+	return s.checkpoint(name, a)
+}
+
+// checkpoint uploads the local copy of a file appended to
+func (s *s3Sink) checkpoint(name string, a *s3Append) error {
+	if err := s.upload(name, a.f); err != nil {
+		return xerrors.Errorf("upload %s: %w", name, err)
+	}
+	a.pending = 0
+	a.uploaded = s.now()
+	return nil
+}
+
+// Rename copies the object to its new key, which is done in parts above
+// the size of a single copy, and deletes it
+func (s *s3Sink) Rename(oldName, newName string) error {
+	oldKey, newKey := s.key(oldName), s.key(newName)
+	resp, err := s.do(http.MethodHead, oldKey, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	size := resp.ContentLength
+	source := uriEncode("/"+s.cfg.Bucket+"/"+oldKey, false)
+	if size <= s3MaxPartSize {
+		header := http.Header{"X-Amz-Copy-Source": {source}}
+		if err := s.doXML(http.MethodPut, newKey, nil, header, nil, nil); err != nil {
+			return err
+		}
+	} else {
+		w := &s3Writer{s: s, key: newKey}
+		for offset := int64(0); offset < size; offset += s3MaxPartSize {
+			end := offset + s3MaxPartSize
+			if end > size {
+				end = size
+			}
+			header := http.Header{
+				"X-Amz-Copy-Source":       {source},
+				"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", offset, end-1)},
+			}
+			if err := w.copyPart(header); err != nil {
+				w.Abort()
+				return err
+			}
+		}
+		if err := w.complete(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	resp, err = s.do(http.MethodDelete, oldKey, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Close uploads the files appended to since their last checkpoint, and drops
+// their local copies
+func (s *s3Sink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	names := make([]string, 0, len(s.appends))
+	for name := range s.appends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var firstErr error
+	for _, name := range names {
+		a := s.appends[name]
+		if a.pending > 0 {
+			if err := s.checkpoint(name, a); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		a.f.Close()
+		delete(s.appends, name)
+	}
+	return firstErr
+}
+
+func (s *s3Sink) upload(name string, f *os.File) error {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w, err := s.Create(name, size)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+// s3Error is the error of a request answered with 200 OK, as a copy or the
+// completion of a multipart upload may be
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// doXML sends a request expecting an XML result, decoded into v if it is not
+// nil. A copy answered with a SlowDown or InternalError in a 200 OK is
+// retried as a 5xx status is.
+func (s *s3Sink) doXML(method, key string, query url.Values, header http.Header, body []byte, v interface{}) error {
+	delay := s3RetryDelay
+	for retry := 0; ; retry++ {
+		data, err := s.sendXML(method, key, query, header, body)
+		if err != nil {
+			return err
+		}
+		var root struct {
+			XMLName xml.Name
+		}
+		if err := xml.Unmarshal(data, &root); err == nil && root.XMLName.Local == "Error" {
+			var e s3Error
+			xml.Unmarshal(data, &e)
+			err := xerrors.Errorf("s3 %s %s: %s %s", method, key, e.Code, e.Message)
+			if e.Code != "SlowDown" && e.Code != "InternalError" || retry == s3Retries || method == http.MethodPost {
+				return err
+			}
+			log.Warnf("%s, retry in %s", err, delay)
+			time.Sleep(delay)
+			delay *= 2
+			continue
+		}
+		if v == nil {
+			return nil
+		}
+		return xml.Unmarshal(data, v)
+	}
+}
+
+func (s *s3Sink) sendXML(method, key string, query url.Values, header http.Header, body []byte) ([]byte, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	resp, err := s.do(method, key, query, header, r, int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// s3Writer uploads an object in parts of partSize, starting a multipart
+// upload once a part is full
+type s3Writer struct {
+	s        *s3Sink
+	key      string
+	partSize int
+	buf      []byte
+	uploadID string
+	parts    []s3Part
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, w.partSize)
+		}
+		n := w.partSize - len(w.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(w.buf) == w.partSize {
+			if err := w.uploadPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *s3Writer) initiate() error {
+	if w.uploadID != "" {
+		return nil
+	}
+	var res struct {
+		UploadId string
+	}
+	if err := w.s.doXML(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil, nil, &res); err != nil {
+		return err
+	}
+	if res.UploadId == "" {
+		return xerrors.Errorf("s3 upload of %s is not initiated", w.key)
+	}
+	w.uploadID = res.UploadId
+	return nil
+}
+
+func (w *s3Writer) partQuery() url.Values {
+	return url.Values{
+		"partNumber": {strconv.Itoa(len(w.parts) + 1)},
+		"uploadId":   {w.uploadID},
+	}
+}
+
+func (w *s3Writer) uploadPart() error {
+	if err := w.initiate(); err != nil {
+		return err
+	}
+	resp, err := w.s.do(http.MethodPut, w.key, w.partQuery(), nil, bytes.NewReader(w.buf), int64(len(w.buf)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, s3Part{PartNumber: len(w.parts) + 1, ETag: resp.Header.Get("ETag")})
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *s3Writer) copyPart(header http.Header) error {
+	if err := w.initiate(); err != nil {
+		return err
+	}
+	var res struct {
+		ETag string
+	}
+	if err := w.s.doXML(http.MethodPut, w.key, w.partQuery(), header, nil, &res); err != nil {
+		return err
+	}
+	w.parts = append(w.parts, s3Part{PartNumber: len(w.parts) + 1, ETag: res.ETag})
+	return nil
+}
+
+func (w *s3Writer) complete() error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Part    []s3Part
+	}{Part: w.parts})
+	if err != nil {
+		return err
+	}
+	return w.s.doXML(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, nil, body, nil)
+}
+
+func (w *s3Writer) Commit() error {
+	if w.uploadID == "" {
+		resp, err := w.s.do(http.MethodPut, w.key, nil, nil, bytes.NewReader(w.buf), int64(len(w.buf)))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		w.buf = nil
+		return nil
+	}
+	if len(w.buf) > 0 {
+		if err := w.uploadPart(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	w.buf = nil
+	if err := w.complete(); err != nil {
+		w.Abort()
+		return err
+	}
+	return nil
+}
+
+func (w *s3Writer) Abort() error {
+	w.buf = nil
+	if w.uploadID == "" {
+		return nil
+	}
+	resp, err := w.s.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil, 0)
+	w.uploadID = ""
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
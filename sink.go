@@ -0,0 +1,280 @@
+package graphsplit
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/filecoin-project/go-padreader"
+	"github.com/filedrive-team/filehelper/carv1"
+	ipld "github.com/ipfs/go-ipld-format"
+	"golang.org/x/xerrors"
+)
+
+// Sink is where Chunk writes its CAR files and manifests, such as a local
+// directory or a bucket of an S3-compatible object store
+type Sink interface {
+	// Create starts writing the file name of size bytes, or of an unknown
+	// size if it is -1. The file shows up under its name once committed.
+	Create(name string, size int64) (SinkWriter, error)
+	// Append adds data to the end of the file name, after header if the
+	// file does not exist yet
+	Append(name string, header, data []byte) error
+	// Rename renames a committed file
+	Rename(oldName, newName string) error
+	// Close finishes the files appended to
+	Close() error
+}
+
+// SinkWriter writes a file of a Sink
+type SinkWriter interface {
+	io.Writer
+	// Commit makes the file written show up under its name
+	Commit() error
+	// Abort drops the file written
+	Abort() error
+}
+
+type dirSink struct {
+	dir string
+}
+
+// DirSink writes the files to the local directory dir. The files created are
+// written to temporary files in dir, which are renamed when committed.
+func DirSink(dir string) Sink {
+	return &dirSink{dir: dir}
+}
+
+func (s *dirSink) Create(name string, size int64) (SinkWriter, error) {
+	f, err := os.CreateTemp(s.dir, "."+name+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &dirWriter{File: f, path: filepath.Join(s.dir, name)}, nil
+}
+
+func (s *dirSink) Append(name string, header, data []byte) error {
+	p := filepath.Join(s.dir, name)
+	_, err := os.Stat(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	isCreateAction := os.IsNotExist(err)
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if isCreateAction {
+		if _, err := f.Write(header); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *dirSink) Rename(oldName, newName string) error {
+	return os.Rename(filepath.Join(s.dir, oldName), filepath.Join(s.dir, newName))
+}
+
+func (s *dirSink) Close() error {
+	return nil
+}
+
+type dirWriter struct {
+	*os.File
+	path string
+}
+
+func (w *dirWriter) Commit() error {
+	if err := w.File.Chmod(0644); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	return os.Rename(w.File.Name(), w.path)
+}
+
+func (w *dirWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
+
+// pieceSink is a Sink knowing the pieces of the CAR files written
+type pieceSink interface {
+	piece(payloadCid string) (*CommPRet, bool)
+}
+
+type commPSink struct {
+	Sink
+	rename     bool
+	addPadding bool
+	lock       sync.Mutex
+	// pieces by the payload cid of their CAR file
+	pieces map[string]*CommPRet
+}
+
+// CommPSink computes the commP of the CAR files written to s while they are
+// written, as CalcCommP does for a local file once it is written. With
+// addPadding the CAR files are padded into pieces, and with rename they are
+// renamed after their piece cids.
+func CommPSink(s Sink, rename, addPadding bool) Sink {
+	return &commPSink{Sink: s, rename: rename, addPadding: addPadding, pieces: make(map[string]*CommPRet)}
+}
+
+func (s *commPSink) Create(name string, size int64) (SinkWriter, error) {
+	if !strings.HasSuffix(name, ".car") {
+		return s.Sink.Create(name, size)
+	}
+	if size < 0 {
+		return nil, xerrors.Errorf("the size of %s is needed to compute its commP", name)
+	}
+	fileSize := size
+	if s.addPadding {
+		fileSize = int64(padreader.PaddedSize(uint64(size)))
+	}
+	w, err := s.Sink.Create(name, fileSize)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	cw := &commPWriter{s: s, name: name, w: w, pw: pw, size: size, done: make(chan error, 1)}
+	go func() {
+		commP, pieceSize, err := generatePieceCID(pr, uint64(size))
+		// unblock the writes if it stops early
+		pr.CloseWithError(xerrors.Errorf("commP of %s is not computed", name))
+		cw.ret = &CommPRet{Root: commP, PayloadSize: size, Size: pieceSize}
+		cw.done <- err
+	}()
+	return cw, nil
+}
+
+func (s *commPSink) piece(payloadCid string) (*CommPRet, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret, ok := s.pieces[payloadCid]
+	return ret, ok
+}
+
+// commPWriter tees a CAR file into the computation of its commP
+type commPWriter struct {
+	s       *commPSink
+	name    string
+	w       SinkWriter
+	pw      *io.PipeWriter
+	size    int64
+	written int64
+	ret     *CommPRet
+	done    chan error
+}
+
+func (w *commPWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if _, perr := w.pw.Write(p[:n]); perr != nil && err == nil {
+		err = perr
+	}
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *commPWriter) Commit() error {
+	w.pw.Close()
+	if err := <-w.done; err != nil {
+		w.w.Abort()
+		return err
+	}
+	if w.written != w.size {
+		w.w.Abort()
+		return xerrors.Errorf("%s has %d bytes written, expect %d", w.name, w.written, w.size)
+	}
+	if w.s.addPadding {
+		if err := carv1.PadCar(w.w, w.size); err != nil {
+			w.w.Abort()
+			return xerrors.Errorf("failed to pad car file: %w", err)
+		}
+	}
+	if err := w.w.Commit(); err != nil {
+		return err
+	}
+	if w.s.rename {
+		if err := w.s.Sink.Rename(w.name, w.ret.Root.String()); err != nil {
+			return xerrors.Errorf("rename car(%s) file to piece %w", w.name, err)
+		}
+	}
+	w.s.lock.Lock()
+	w.s.pieces[strings.TrimSuffix(w.name, ".car")] = w.ret
+	w.s.lock.Unlock()
+	return nil
+}
+
+func (w *commPWriter) Abort() error {
+	w.pw.CloseWithError(xerrors.Errorf("%s is aborted", w.name))
+	<-w.done
+	return w.w.Abort()
+}
+
+type sinkCallback struct {
+	keptErr
+	sink Sink
+}
+
+// SinkCallback adds the slices to the manifest.csv of s. The manifest has
+// the piece cids and sizes, as CommPCallback writes it, if s is a CommPSink.
+// Errors are kept for Chunk to return, so that the sink can still be closed.
+func SinkCallback(s Sink) GraphBuildCallback {
+	return &sinkCallback{sink: s}
+}
+
+func (cc *sinkCallback) OnSuccess(node ipld.Node, graphName, fsDetail string) {
+	if err := cc.appendManifest(node, graphName, fsDetail); err != nil {
+		cc.OnError(xerrors.Errorf("add %s to %s: %w", graphName, ManifestName, err))
+	}
+}
+
+func (cc *sinkCallback) appendManifest(node ipld.Node, graphName, fsDetail string) error {
+	if ps, ok := cc.sink.(pieceSink); ok {
+		cpRes, ok := ps.piece(node.Cid().String())
+		if !ok {
+			return xerrors.Errorf("piece of %s is not computed", node.Cid())
+		}
+		header, err := encodeCommPManifest([]string{
+			"playload_cid", "filename", "piece_cid", "payload_size", "piece_size", "detail",
+		})
+		if err != nil {
+			return err
+		}
+		data, err := encodeCommPManifest([]string{
+			node.Cid().String(), graphName, cpRes.Root.String(), strconv.FormatInt(cpRes.PayloadSize, 10), strconv.FormatUint(uint64(cpRes.Size), 10), fsDetail,
+		})
+		if err != nil {
+			return err
+		}
+		return cc.sink.Append(ManifestName, header, data)
+	}
+	return cc.sink.Append(ManifestName, []byte("playload_cid,filename,detail\n"), []byte(fmt.Sprintf("%s,%s,%s\n", node.Cid(), graphName, fsDetail)))
+}
+
+// encodeCommPManifest encodes a row of the manifest written by CommPCallback
+func encodeCommPManifest(record []string) ([]byte, error) {
+	var buf bytes.Buffer
+	csvWriter := csv.NewWriter(&buf)
+	csvWriter.UseCRLF = true
+	if err := csvWriter.Write(record); err != nil {
+		return nil, err
+	}
+	csvWriter.Flush()
+	return buf.Bytes(), csvWriter.Error()
+}
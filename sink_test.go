@@ -0,0 +1,170 @@
+package graphsplit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestS3Sink(t *testing.T) {
+	testS3Sink(t, fakeBucket(t))
+}
+
+func testS3Sink(t *testing.T, b *testBucket) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_s3_sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := OpenS3Sink(b.config("out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// parts are uploaded once full, and put together on commit
+	content := bytes.Repeat([]byte("0123456789"), b.minPartSize/4)
+	w, err := sink.Create("parts.bin", int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.(*s3Writer).partSize = b.minPartSize
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.get("out/parts.bin"); ok {
+		t.Fatal("object is uploaded before it is committed")
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.get("out/parts.bin"); !bytes.Equal(got, content) {
+		t.Fatalf("object of %d bytes is uploaded, expect %d", len(got), len(content))
+	}
+	if err := sink.Rename("parts.bin", "renamed.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.get("out/parts.bin"); ok {
+		t.Fatal("object is not renamed")
+	}
+	if got, _ := b.get("out/renamed.bin"); !bytes.Equal(got, content) {
+		t.Fatal("object is not renamed")
+	}
+	w, err = sink.Create("aborted.bin", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.(*s3Writer).partSize = b.minPartSize
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.get("out/aborted.bin"); ok {
+		t.Fatal("aborted object is uploaded")
+	}
+
+	// chunking to the bucket gives the files of chunking to a directory
+	src := filepath.Join(dir, "src")
+	files := map[string][]byte{
+		"top.txt":     []byte("hello"),
+		"sub/big.bin": bytes.Repeat([]byte("0123456789abcdef"), 40000),
+	}
+	for p, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(src, p)), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, p), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	carDir := filepath.Join(dir, "cars")
+	if err := os.MkdirAll(carDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := Chunk(ctx, 250000, src, src, carDir, "test", 2, CSVCallback(carDir), WithFileIndex(), WithChecksums(ChecksumSHA256)); err != nil {
+		t.Fatal(err)
+	}
+	// every other PUT is answered with a SlowDown, and sent again
+	defer func(delay time.Duration) { s3RetryDelay = delay }(s3RetryDelay)
+	s3RetryDelay = time.Millisecond
+	defer func(n int) { s3CheckpointAppends = n }(s3CheckpointAppends)
+	s3CheckpointAppends = 2
+	var puts, slowDowns int
+	failAll := false
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failAll {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodPut {
+			if puts++; puts%2 == 1 {
+				slowDowns++
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprint(w, "<Error><Code>SlowDown</Code></Error>")
+				return
+			}
+		}
+		b.handler.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+	cfg := b.config("out")
+	cfg.Endpoint = flaky.URL
+	sink, err = OpenS3Sink(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Chunk(ctx, 250000, src, src, "", "test", 2, SinkCallback(sink), WithSink(sink), WithFileIndex(), WithChecksums(ChecksumSHA256)); err != nil {
+		t.Fatal(err)
+	}
+	if slowDowns == 0 {
+		t.Fatal("no request is retried")
+	}
+	// the manifest is uploaded every other append, and whole on close
+	manifest, err := ioutil.ReadFile(filepath.Join(carDir, ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := b.get("out/" + ManifestName)
+	if len(got) == 0 || len(got) >= len(manifest) || !bytes.HasPrefix(manifest, got) {
+		t.Fatalf("manifest is uploaded before the sink is closed as\n%s\nexpect a checkpoint of\n%s", got, manifest)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(carDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		expect, err := ioutil.ReadFile(filepath.Join(carDir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := b.get("out/" + e.Name())
+		if !ok {
+			t.Fatalf("%s is not uploaded", e.Name())
+		}
+		if !bytes.Equal(got, expect) {
+			t.Fatalf("%s is uploaded as\n%s\nexpect\n%s", e.Name(), got, expect)
+		}
+	}
+
+	// failed uploads are returned rather than exiting
+	failAll = true
+	if err := Chunk(ctx, 250000, src, src, "", "test", 2, SinkCallback(sink), WithSink(sink)); err == nil {
+		t.Fatal("expect the failed uploads returned")
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
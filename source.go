@@ -0,0 +1,364 @@
+package graphsplit
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// RangeFS is a file system that reads byte ranges of its files without
+// opening them whole, such as an object store. ChunkFS reads the parts of
+// split files through it, or else by seeking the files opened if they are
+// io.Seekers, or by reading past the bytes before the part.
+type RangeFS interface {
+	fs.FS
+	// OpenRange opens length bytes of the file name from offset
+	OpenRange(name string, offset, length int64) (io.ReadCloser, error)
+}
+
+// LocalSource gives the directory at parentPath as a file system, and the
+// path of targetPath in it, as Chunk reads them. A single file is given in
+// its directory.
+func LocalSource(parentPath, targetPath string) (fs.FS, string, error) {
+	dir, root, err := localSourceDir(parentPath, targetPath)
+	if err != nil {
+		return nil, "", err
+	}
+	return os.DirFS(dir), root, nil
+}
+
+// localSourceDir gives the absolute directory of the file system of
+// LocalSource, and the path of targetPath in it
+func localSourceDir(parentPath, targetPath string) (string, string, error) {
+	parent, err := filepath.Abs(parentPath)
+	if err != nil {
+		return "", "", err
+	}
+	target, err := filepath.Abs(targetPath)
+	if err != nil {
+		return "", "", err
+	}
+	info, err := os.Stat(parent)
+	if err != nil {
+		return "", "", err
+	}
+	if !info.IsDir() {
+		if parent != target {
+			return "", "", xerrors.Errorf("parent path %s is a file other than the target path %s", parentPath, targetPath)
+		}
+		return filepath.Dir(parent), filepath.Base(parent), nil
+	}
+	rel, err := filepath.Rel(parent, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", "", xerrors.Errorf("target path %s is not under parent path %s", targetPath, parentPath)
+	}
+	return parent, filepath.ToSlash(rel), nil
+}
+
+// walkFiles calls fn with the files under root in fsys selected by filter in
+// lexical order, as GetFileListAsync lists them on the OS: following
+// symlinks, and skipping hidden files and directories unless the filter
+// keeps them. The directories are read and their entries stated by walkers
+// goroutines, ahead of fn by at most walkReadAhead entries. The paths
+// excluded are given to report, if set, in the same order.
+func walkFiles(fsys fs.FS, root string, walkers int, filter *fileFilter, report func(p, reason string), fn func(Finfo) error) error {
+	info, err := fs.Stat(fsys, root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		reason, err := filter.excludeMode(root, info.Mode())
+		if err != nil {
+			return err
+		}
+		if reason == "" {
+			reason = filter.excludeFile(relPath(root, root), info.Size())
+		}
+		if reason != "" {
+			if report != nil {
+				report(root, reason)
+			}
+			return nil
+		}
+		return fn(Finfo{Path: root, Name: info.Name(), Info: info})
+	}
+	if root != "." {
+		if reason := filter.excludeName(info.Name()); reason != "" {
+			if report != nil {
+				report(root, reason)
+			}
+			return nil
+		}
+	}
+	if walkers <= 0 {
+		walkers = 1
+	}
+	w := &walker{fsys: fsys, root: root, filter: filter, report: report, readAhead: walkReadAhead}
+	w.cond = sync.NewCond(&w.lock)
+	top := w.push(root)
+	for i := 0; i < walkers; i++ {
+		go w.work()
+	}
+	defer w.stop()
+	return w.emit(top, fn)
+}
+
+// most entries the walkers read ahead of the files walked, beyond which they
+// wait for the walk to catch up
+var walkReadAhead = 1 << 16
+
+// walkDir is a directory read by a walker
+type walkDir struct {
+	path string
+	// set once a walker, or the walk waiting for it, takes it to read
+	claimed bool
+	done    chan struct{}
+	entries []walkEntry
+	err     error
+}
+
+type walkEntry struct {
+	path string
+	info fs.FileInfo
+	// set on directories
+	dir *walkDir
+	// why the entry is excluded, if it is
+	excluded string
+}
+
+// walker reads the directories in a stack, so that they are read in about
+// the order they are walked in. The directories taken off the stack by the
+// walk are left in it, and skipped.
+type walker struct {
+	fsys    fs.FS
+	root    string
+	filter  *fileFilter
+	report  func(p, reason string)
+	lock    sync.Mutex
+	cond    *sync.Cond
+	pending []*walkDir
+	// entries read and not walked yet, at most readAhead before the walkers
+	// wait
+	ahead     int
+	readAhead int
+	stopped   bool
+}
+
+func (w *walker) push(p string) *walkDir {
+	d := &walkDir{path: p, done: make(chan struct{})}
+	w.lock.Lock()
+	w.pending = append(w.pending, d)
+	w.lock.Unlock()
+	w.cond.Signal()
+	return d
+}
+
+func (w *walker) stop() {
+	w.lock.Lock()
+	w.stopped = true
+	w.lock.Unlock()
+	w.cond.Broadcast()
+}
+
+func (w *walker) work() {
+	for {
+		w.lock.Lock()
+		for (len(w.pending) == 0 || w.ahead >= w.readAhead) && !w.stopped {
+			w.cond.Wait()
+		}
+		if w.stopped {
+			w.lock.Unlock()
+			return
+		}
+		d := w.pending[len(w.pending)-1]
+		w.pending = w.pending[:len(w.pending)-1]
+		if d.claimed {
+			w.lock.Unlock()
+			continue
+		}
+		d.claimed = true
+		w.lock.Unlock()
+		w.read(d)
+	}
+}
+
+func (w *walker) read(d *walkDir) {
+	defer close(d.done)
+	entries, err := fs.ReadDir(w.fsys, d.path)
+	if err != nil {
+		d.err = err
+		return
+	}
+	var dirs []*walkDir
+	for _, e := range entries {
+		ep := path.Join(d.path, e.Name())
+		// not stated, as broken symlinks are not an error then
+		if reason := w.filter.excludeName(e.Name()); reason != "" {
+			d.entries = append(d.entries, walkEntry{path: ep, excluded: reason})
+			continue
+		}
+		var info fs.FileInfo
+		if e.Type()&fs.ModeSymlink != 0 {
+			info, err = fs.Stat(w.fsys, ep)
+		} else {
+			info, err = e.Info()
+		}
+		if err != nil {
+			d.err = err
+			return
+		}
+		we := walkEntry{path: ep, info: info}
+		if info.IsDir() {
+			we.excluded = w.filter.excludeDir(relPath(w.root, ep))
+		} else if we.excluded, err = w.filter.excludeMode(ep, info.Mode()); err != nil {
+			d.err = err
+			return
+		} else if we.excluded == "" {
+			we.excluded = w.filter.excludeFile(relPath(w.root, ep), info.Size())
+		}
+		if we.excluded == "" && info.IsDir() {
+			we.dir = &walkDir{path: ep, done: make(chan struct{})}
+			dirs = append(dirs, we.dir)
+		}
+		d.entries = append(d.entries, we)
+	}
+	// the first directory on top of the stack
+	w.lock.Lock()
+	w.ahead += len(d.entries)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		w.pending = append(w.pending, dirs[i])
+	}
+	w.lock.Unlock()
+	w.cond.Broadcast()
+}
+
+// emit walks d, reading it if no walker has taken it yet, as they may all
+// wait for the walk to catch up
+func (w *walker) emit(d *walkDir, fn func(Finfo) error) error {
+	w.lock.Lock()
+	claimed := d.claimed
+	d.claimed = true
+	w.lock.Unlock()
+	if !claimed {
+		w.read(d)
+	}
+	<-d.done
+	if d.err != nil {
+		return d.err
+	}
+	entries := d.entries
+	d.entries = nil
+	w.lock.Lock()
+	w.ahead -= len(entries)
+	w.lock.Unlock()
+	w.cond.Broadcast()
+	for _, e := range entries {
+		if e.excluded != "" {
+			if w.report != nil {
+				w.report(e.path, e.excluded)
+			}
+			continue
+		}
+		if e.dir != nil {
+			if err := w.emit(e.dir, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(Finfo{Path: e.path, Name: e.info.Name(), Info: e.info}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openRange opens the bytes of item from SeekStart to SeekEnd in fsys, or
+// from the paths of the OS if fsys is nil
+func openRange(fsys fs.FS, item Finfo) (io.ReadCloser, error) {
+	if fsys == nil {
+		r, f, err := openFinfo(item)
+		if err != nil {
+			return nil, err
+		}
+		return &readCloser{Reader: r, Closer: f}, nil
+	}
+	if !isFilePart(item) {
+		return fsys.Open(item.Path)
+	}
+	offset, length := item.SeekStart, item.SeekEnd-item.SeekStart+1
+	if rfs, ok := fsys.(RangeFS); ok {
+		return rfs.OpenRange(item.Path, offset, length)
+	}
+	f, err := fsys.Open(item.Path)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := f.(io.Seeker); ok {
+		_, err = s.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, f, offset)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// listedDir is an open directory of a file system, listing its entries on
+// the first ReadDir
+type listedDir struct {
+	path    string
+	info    fs.FileInfo
+	list    func() ([]fs.DirEntry, error)
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *listedDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *listedDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: xerrors.New("is a directory")}
+}
+
+func (d *listedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.list()
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.path, Err: err}
+		}
+		d.entries = entries
+		d.read = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *listedDir) Close() error {
+	return nil
+}
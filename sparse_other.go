@@ -0,0 +1,15 @@
+//go:build !linux && !freebsd && !darwin
+
+package graphsplit
+
+// the holes of sparse files are not looked for, they are read as zeros
+const (
+	seekData = 0
+	seekHole = 0
+)
+
+const seekHoleSupported = false
+
+func isNoData(err error) bool {
+	return false
+}
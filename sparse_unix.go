@@ -0,0 +1,22 @@
+//go:build linux || freebsd
+
+package graphsplit
+
+import (
+	"syscall"
+
+	"golang.org/x/xerrors"
+)
+
+// whence of lseek for the data and holes of sparse files
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+const seekHoleSupported = true
+
+// isNoData tells if seeking data failed for there is none up to the end
+func isNoData(err error) bool {
+	return xerrors.Is(err, syscall.ENXIO)
+}
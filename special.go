@@ -0,0 +1,189 @@
+package graphsplit
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"golang.org/x/xerrors"
+)
+
+// policies for the files that are neither regular files nor directories:
+// devices, FIFOs and sockets, which are not read as their content never
+// ends or is not there
+const (
+	// skip them, and report them with the paths excluded
+	SpecialSkip = "skip"
+	// fail the run
+	SpecialFail = "fail"
+)
+
+// specialKind tells what kind of special file mode is of, or gives "" for
+// regular files and directories
+func specialKind(mode fs.FileMode) string {
+	switch {
+	case mode.IsRegular(), mode.IsDir():
+		return ""
+	case mode&fs.ModeDevice != 0:
+		return "device"
+	case mode&fs.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	}
+	return "special file"
+}
+
+// excludeMode tells why the file at p of mode is excluded for being a
+// special file, or gives "". It fails if special files fail the run.
+func (f *fileFilter) excludeMode(p string, mode fs.FileMode) (string, error) {
+	kind := specialKind(mode)
+	if kind == "" {
+		return "", nil
+	}
+	if f.failSpecial {
+		return "", xerrors.Errorf("%s is a %s, which cannot be chunked", p, kind)
+	}
+	return kind, nil
+}
+
+// openSparse opens the bytes of item from SeekStart to SeekEnd as openRange
+// does, reading only the data of a sparse file of the OS and giving zeros
+// for its holes
+func openSparse(fsys fs.FS, item Finfo) (io.ReadCloser, error) {
+	var f fs.File
+	var err error
+	if fsys == nil {
+		f, err = os.Open(item.Path)
+	} else {
+		f, err = fsys.Open(item.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if osf, ok := f.(*os.File); ok && seekHoleSupported {
+		start, end := item.SeekStart, item.Info.Size()
+		if isFilePart(item) {
+			end = item.SeekEnd + 1
+		}
+		// a file without holes in the range is read as any other
+		if hole, err := osf.Seek(start, seekHole); err == nil && hole < end {
+			return &sparseReader{f: osf, off: start, end: end}, nil
+		}
+	}
+	f.Close()
+	return openRange(fsys, item)
+}
+
+// sparseReader reads the bytes of f from off to end, the data by ReadAt and
+// the holes as zeros, which are not read
+type sparseReader struct {
+	f   *os.File
+	off int64
+	end int64
+	// the data or hole at off ends at next
+	hole bool
+	next int64
+}
+
+func (sr *sparseReader) Read(p []byte) (int, error) {
+	if sr.off >= sr.end {
+		return 0, io.EOF
+	}
+	if sr.off >= sr.next {
+		if err := sr.seek(); err != nil {
+			return 0, err
+		}
+	}
+	n := int64(len(p))
+	if n > sr.next-sr.off {
+		n = sr.next - sr.off
+	}
+	p = p[:n]
+	if sr.hole {
+		for i := range p {
+			p[i] = 0
+		}
+	} else {
+		// a file cut short ends the bytes, which readChecked tells
+		m, err := sr.f.ReadAt(p, sr.off)
+		if m == 0 {
+			return 0, err
+		}
+		p = p[:m]
+	}
+	sr.off += int64(len(p))
+	return len(p), nil
+}
+
+// seek finds the data or hole at off, and where it ends
+func (sr *sparseReader) seek() error {
+	data, err := sr.f.Seek(sr.off, seekData)
+	if err != nil && !isNoData(err) {
+		return err
+	}
+	if err != nil || data > sr.off {
+		// a hole up to the data, or to the end of the file
+		sr.hole = true
+		sr.next = sr.end
+		if err == nil && data < sr.end {
+			sr.next = data
+		}
+		return nil
+	}
+	hole, err := sr.f.Seek(sr.off, seekHole)
+	if err != nil {
+		return err
+	}
+	sr.hole = false
+	sr.next = sr.end
+	if hole < sr.end {
+		sr.next = hole
+	}
+	return nil
+}
+
+func (sr *sparseReader) Close() error {
+	return sr.f.Close()
+}
+
+// zeroLeafBuilder gives the cids of nodes as Builder does, but only computes
+// the one of the leaf of a chunk of zeros once, which sparse files are full of
+type zeroLeafBuilder struct {
+	cid.Builder
+	// the leaf of a chunk of zeros, as layoutFile lays it out
+	zeroData []byte
+	zeroCid  cid.Cid
+}
+
+func newZeroLeafBuilder(b cid.Builder) (*zeroLeafBuilder, error) {
+	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dagServ := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	nd, err := layoutFile(bytes.NewReader(make([]byte, UnixfsChunkSize)), dagServ, b)
+	if err != nil {
+		return nil, err
+	}
+	return &zeroLeafBuilder{Builder: b, zeroData: nd.RawData(), zeroCid: nd.Cid()}, nil
+}
+
+func (b *zeroLeafBuilder) Sum(data []byte) (cid.Cid, error) {
+	if bytes.Equal(data, b.zeroData) {
+		return b.zeroCid, nil
+	}
+	return b.Builder.Sum(data)
+}
+
+func (b *zeroLeafBuilder) WithCodec(codec uint64) cid.Builder {
+	if codec == b.GetCodec() {
+		return b
+	}
+	return b.Builder.WithCodec(codec)
+}
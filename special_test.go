@@ -0,0 +1,135 @@
+package graphsplit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSpecialFiles(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_special_files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fsys := fstest.MapFS{
+		"a.txt":      {Data: []byte("hello")},
+		"sub/fifo":   {Mode: fs.ModeNamedPipe | 0644},
+		"sub/tty":    {Mode: fs.ModeDevice | fs.ModeCharDevice | 0644},
+		"sub/socket": {Mode: fs.ModeSocket | 0644},
+	}
+	ctx := context.Background()
+	cb := &resultCallback{}
+	if err := ChunkFS(ctx, 1<<20, fsys, ".", dir, "test", 1, cb); err != nil {
+		t.Fatal(err)
+	}
+	if cb.err != nil || len(cb.cids) != 1 {
+		t.Fatalf("expect a slice, got %v, %v", cb.cids, cb.err)
+	}
+	report, err := ioutil.ReadFile(filepath.Join(dir, ExcludedName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := "path,reason\nsub/fifo,fifo\nsub/socket,socket\nsub/tty,device\n"; string(report) != expect {
+		t.Fatalf("got report\n%s\nexpect\n%s", report, expect)
+	}
+	if err := ChunkFS(ctx, 1<<20, fsys, ".", dir, "test", 1, cb, WithSpecialFiles(SpecialFail)); err == nil || !strings.Contains(err.Error(), "sub/fifo is a fifo") {
+		t.Fatalf("expect the fifo to fail, got %v", err)
+	}
+}
+
+func TestSparseFiles(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_sparse_files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// holes around and between data, the data not on chunk boundaries
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0777); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(src, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{3<<20 + 100, 6 << 20} {
+		if _, err := f.WriteAt(bytes.Repeat([]byte("data"), 300000), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(12 << 20); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	expect, err := ioutil.ReadFile(filepath.Join(src, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(src, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []Finfo{
+		{Path: "disk.img", Info: info},
+		{Path: "disk.img", Info: info, SeekStart: 1 << 20, SeekEnd: 7<<20 - 1},
+	} {
+		r, err := openSparse(os.DirFS(src), item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := expect
+		if isFilePart(item) {
+			want = expect[item.SeekStart : item.SeekEnd+1]
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("read %d bytes from %d differently", len(got), item.SeekStart)
+		}
+	}
+
+	// the same CAR files with and without looking for holes
+	ctx := context.Background()
+	var runs [][]byte
+	for _, opts := range [][]ChunkOption{nil, {WithSparseFiles()}} {
+		carDir, err := ioutil.TempDir(dir, "cars")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Chunk(ctx, 5<<20, src, src, carDir, "test", 1, CSVCallback(carDir), opts...); err != nil {
+			t.Fatal(err)
+		}
+		cars, err := filepath.Glob(filepath.Join(carDir, "*.car"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cars) != 3 {
+			t.Fatalf("expect 3 CAR files, got %d", len(cars))
+		}
+		var run []byte
+		for _, car := range cars {
+			data, err := ioutil.ReadFile(car)
+			if err != nil {
+				t.Fatal(err)
+			}
+			run = append(run, data...)
+		}
+		runs = append(runs, run)
+	}
+	if !bytes.Equal(runs[0], runs[1]) {
+		t.Fatal("CAR files differ when looking for holes")
+	}
+}
@@ -0,0 +1,187 @@
+package graphsplit
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	pa "path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// tarFS is a tar archive as a read-only file system, reading its files at
+// the offsets found by reading the headers once
+type tarFS struct {
+	r       io.ReaderAt
+	entries map[string]*tarEntry
+	// names of the entries in each directory, in lexical order
+	children map[string][]string
+}
+
+type tarEntry struct {
+	name    string
+	dir     bool
+	offset  int64
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+// OpenTarFS presents the uncompressed tar archive of size bytes in r as a
+// read-only file system, whose files are io.Seekers and io.ReaderAts, so
+// that ChunkFS reads them at random and in parallel. Only directories and
+// regular files are kept; symlinks, hard links, sparse files and other
+// special entries are skipped, as ChunkTar skips them.
+func OpenTarFS(r io.ReaderAt, size int64) (fs.FS, error) {
+	tfs := &tarFS{
+		r:        r,
+		entries:  map[string]*tarEntry{".": {name: ".", dir: true, mode: fs.ModeDir | 0555}},
+		children: make(map[string][]string),
+	}
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("read archive: %w", err)
+		}
+		p := strings.TrimPrefix(pa.Clean("/"+hdr.Name), "/")
+		if p == "" {
+			continue
+		}
+		switch {
+		case hdr.Typeflag == tar.TypeDir:
+			e := tfs.addDir(p)
+			e.modTime = hdr.ModTime
+		case hdr.Typeflag == tar.TypeXGlobalHeader:
+		case hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA || isSparseHeader(hdr):
+			log.Warnf("skip %s, entries of type %q are not chunked", p, hdr.Typeflag)
+		default:
+			// the tar reader seeks past the data of the previous entry, so
+			// it is at the data of this one
+			offset, err := sr.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			tfs.addDir(pa.Dir(p))
+			if _, ok := tfs.entries[p]; !ok {
+				tfs.children[pa.Dir(p)] = append(tfs.children[pa.Dir(p)], pa.Base(p))
+			}
+			tfs.entries[p] = &tarEntry{
+				name:    pa.Base(p),
+				offset:  offset,
+				size:    hdr.Size,
+				mode:    fs.FileMode(hdr.Mode).Perm(),
+				modTime: hdr.ModTime,
+			}
+		}
+	}
+	for _, names := range tfs.children {
+		sort.Strings(names)
+	}
+	return tfs, nil
+}
+
+// isSparseHeader tells if the data of hdr is not stored as it is read
+func isSparseHeader(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// addDir adds the directory p and the ones above it
+func (tfs *tarFS) addDir(p string) *tarEntry {
+	if e, ok := tfs.entries[p]; ok {
+		return e
+	}
+	e := &tarEntry{name: pa.Base(p), dir: true, mode: fs.ModeDir | 0555}
+	tfs.entries[p] = e
+	tfs.addDir(pa.Dir(p))
+	tfs.children[pa.Dir(p)] = append(tfs.children[pa.Dir(p)], pa.Base(p))
+	return e
+}
+
+func (tfs *tarFS) lookup(op, name string) (*tarEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := tfs.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (tfs *tarFS) Open(name string) (fs.File, error) {
+	e, err := tfs.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.dir {
+		return &listedDir{path: name, info: e, list: func() ([]fs.DirEntry, error) {
+			return tfs.dirEntries(name), nil
+		}}, nil
+	}
+	return &tarFile{SectionReader: io.NewSectionReader(tfs.r, e.offset, e.size), e: e}, nil
+}
+
+func (tfs *tarFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := tfs.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (tfs *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := tfs.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: xerrors.New("not a directory")}
+	}
+	return tfs.dirEntries(name), nil
+}
+
+func (tfs *tarFS) dirEntries(p string) []fs.DirEntry {
+	names := tfs.children[p]
+	entries := make([]fs.DirEntry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, fs.FileInfoToDirEntry(tfs.entries[pa.Join(p, name)]))
+	}
+	return entries
+}
+
+// tarEntry is its own fs.FileInfo
+func (e *tarEntry) Name() string       { return e.name }
+func (e *tarEntry) Size() int64        { return e.size }
+func (e *tarEntry) Mode() fs.FileMode  { return e.mode }
+func (e *tarEntry) ModTime() time.Time { return e.modTime }
+func (e *tarEntry) IsDir() bool        { return e.dir }
+func (e *tarEntry) Sys() interface{}   { return nil }
+
+type tarFile struct {
+	*io.SectionReader
+	e *tarEntry
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) {
+	return f.e, nil
+}
+
+func (f *tarFile) Close() error {
+	return nil
+}
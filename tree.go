@@ -0,0 +1,388 @@
+package graphsplit
+
+import (
+	"context"
+	"io"
+	"os"
+	pa "path"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	files "github.com/ipfs/go-libipfs/files"
+	unixfile "github.com/ipfs/go-unixfs/file"
+	"golang.org/x/xerrors"
+)
+
+// treeEntry is a file or directory of the dataset, gathered from every slice
+type treeEntry struct {
+	Path    string
+	IsDir   bool
+	Symlink string
+	Size    int64
+	// size of the whole file in the file index, -1 if it is not indexed
+	FileSize int64
+	// the file, or the parts of a split file ordered by index
+	Parts []treePart
+}
+
+// treePart is where a file, or a part of it, is stored
+type treePart struct {
+	// index of the part, -1 if the file is not split
+	Index int
+	Size  int64
+	Cid   cid.Cid
+	// root of the slice it is in
+	Slice cid.Cid
+	dag   ipld.DAGService
+	// index of the CAR file in the carSet of the tree
+	car int
+}
+
+// datasetTree is the file system tree of a dataset, stitched together from
+// the graphs of all its slices
+type datasetTree struct {
+	entries map[string]*treeEntry
+	cars    *carSet
+}
+
+// loadDatasetTree collects the files and directories under carPath selected
+// by pf. Split files are recognised through the file index next to the CAR
+// files, or by the part suffix of their names if there is no index. It fails
+// if a part of a split file is missing.
+func loadDatasetTree(ctx context.Context, carPath string, pf *pathFilter) (*datasetTree, error) {
+	t, err := openDatasetTree(ctx, carPath, pf)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range t.entries {
+		if err := checkParts(e); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// openDatasetTree is loadDatasetTree for the CAR files of part of a dataset,
+// where split files may miss some parts.
+//
+// The files of a slice in the file index are taken from there, and its CAR
+// file is only opened once the content of a file is read. The graphs of the
+// other slices are walked, one CAR file at a time, leaving out the slices
+// whose files in the manifest are not selected by pf. See carSet for how many
+// CAR files are kept open.
+func openDatasetTree(ctx context.Context, carPath string, pf *pathFilter) (*datasetTree, error) {
+	carDir := carDirOf(carPath)
+	manifests, err := ReadManifest(filepath.Join(carDir, ManifestName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	entries, err := ReadFileIndex(filepath.Join(carDir, FileIndexName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	indexed := make(map[string][]FileIndexEntry)
+	for _, entry := range entries {
+		indexed[entry.PayloadCid] = append(indexed[entry.PayloadCid], entry)
+	}
+	details := make(map[string]string)
+	for _, m := range manifests {
+		details[m.PayloadCid] = m.Detail
+	}
+
+	carFiles, err := listCarFiles(carPath)
+	if err != nil {
+		return nil, err
+	}
+	cars, err := newCarSet(carFiles)
+	if err != nil {
+		return nil, err
+	}
+	t := &datasetTree{entries: make(map[string]*treeEntry), cars: cars}
+	for i, carFile := range carFiles {
+		names := rootDirNames(cars.roots[i], manifests)
+		for _, root := range cars.roots[i] {
+			if slice, ok := indexed[root.String()]; ok {
+				if err := t.addIndexed(i, root, names[root], slice, pf); err != nil {
+					t.Close()
+					return nil, xerrors.Errorf("read %s: %w", carFile, err)
+				}
+				continue
+			}
+			if detail, ok := details[root.String()]; ok && !detailMatches(detail, names[root], pf) {
+				continue
+			}
+			dag := cars.dag(i)
+			nd, err := dag.Get(ctx, root)
+			if err != nil {
+				t.Close()
+				return nil, err
+			}
+			if err := t.addRoot(ctx, i, nd, names[root], pf); err != nil {
+				t.Close()
+				return nil, xerrors.Errorf("read %s: %w", carFile, err)
+			}
+			if _, ok := unixfsInfoOf(nd); !ok {
+				log.Warn(nonUnixFSRoot(carFile, root))
+			}
+		}
+	}
+	for _, e := range t.entries {
+		sort.Slice(e.Parts, func(i, j int) bool {
+			return e.Parts[i].Index < e.Parts[j].Index
+		})
+	}
+	return t, nil
+}
+
+// detailMatches reports whether the slice with the detail column of the
+// manifest may hold a file selected by pf, under the directory name. A detail
+// that does not parse may hold anything.
+func detailMatches(detail, name string, pf *pathFilter) bool {
+	linkPaths, err := detailFilePaths(detail)
+	if err != nil {
+		return true
+	}
+	for _, linkPath := range linkPaths {
+		if pf.match(pa.Join(name, logicalPath(linkPath))) {
+			return true
+		}
+	}
+	return false
+}
+
+// addIndexed adds the files of the slice rooted at root, in the car-th CAR
+// file, from their file index entries without reading the CAR file
+func (t *datasetTree) addIndexed(car int, root cid.Cid, name string, entries []FileIndexEntry, pf *pathFilter) error {
+	for _, entry := range entries {
+		p := pa.Join(name, entry.Path)
+		if !pf.match(p) {
+			continue
+		}
+		c, err := cid.Decode(entry.Cid)
+		if err != nil {
+			return xerrors.Errorf("cid of %s in the file index: %w", entry.Name, err)
+		}
+		t.addPart(p, treePart{
+			Index: entry.Part,
+			Size:  entry.Size,
+			Cid:   c,
+			Slice: root,
+			dag:   t.cars.dag(car),
+			car:   car,
+		})
+		t.entries[p].FileSize = entry.FileSize
+	}
+	return nil
+}
+
+// addRoot adds a root of the car-th CAR file under the directory name, see
+// rootDirNames. Roots that are not UnixFS are left out.
+func (t *datasetTree) addRoot(ctx context.Context, car int, nd ipld.Node, name string, pf *pathFilter) error {
+	info, ok := unixfsInfoOf(nd)
+	switch {
+	case !ok:
+		return nil
+	case info.IsDir:
+		if name != "" && pf.match(name) {
+			t.addEntry(&treeEntry{Path: name, IsDir: true})
+		}
+		return t.addDir(ctx, car, nd.Cid(), nd, name, pf)
+	}
+	// a root that is a single file is named after its cid
+	if name == "" {
+		name = nd.Cid().String()
+	}
+	if pf.match(name) {
+		t.addFile(name, -1, nd, info, car, nd.Cid())
+	}
+	return nil
+}
+
+func (t *datasetTree) addDir(ctx context.Context, car int, slice cid.Cid, nd ipld.Node, dir string, pf *pathFilter) error {
+	dag := t.cars.dag(car)
+	links, err := dirLinks(ctx, dag, nd)
+	if err != nil {
+		return err
+	}
+	for _, lk := range links {
+		linkPath := pa.Join(dir, lk.Name)
+		logical := logicalPath(linkPath)
+		index := -1
+		if logical != linkPath {
+			index = partIndexOf(linkPath)
+		}
+		if !pf.match(logical) && !pf.mayContain(linkPath) {
+			continue
+		}
+		child, err := lk.GetNode(ctx, dag)
+		if err != nil {
+			return err
+		}
+		info, ok := unixfsInfoOf(child)
+		switch {
+		case !ok:
+			log.Warnf("%s is not UnixFS, skip it", linkPath)
+		case info.IsDir:
+			if pf.match(linkPath) {
+				t.addEntry(&treeEntry{Path: linkPath, IsDir: true})
+			}
+			if err := t.addDir(ctx, car, slice, child, linkPath, pf); err != nil {
+				return err
+			}
+		case !pf.match(logical):
+		case info.Symlink != "":
+			t.addEntry(&treeEntry{Path: linkPath, Symlink: info.Symlink})
+		default:
+			t.addFile(logical, index, child, info, car, slice)
+		}
+	}
+	return nil
+}
+
+// addFile adds a file, or the part index of a split file, of the slice
+// rooted at slice in the car-th CAR file
+func (t *datasetTree) addFile(p string, index int, nd ipld.Node, info *unixfsInfo, car int, slice cid.Cid) {
+	if info.Symlink != "" {
+		t.addEntry(&treeEntry{Path: p, Symlink: info.Symlink})
+		return
+	}
+	t.addPart(p, treePart{
+		Index: index,
+		Size:  int64(info.Size),
+		Cid:   nd.Cid(),
+		Slice: slice,
+		dag:   t.cars.dag(car),
+		car:   car,
+	})
+}
+
+func (t *datasetTree) addPart(p string, part treePart) {
+	e := t.entries[p]
+	if e == nil {
+		e = &treeEntry{Path: p, FileSize: -1}
+		t.addEntry(e)
+	}
+	e.Parts = append(e.Parts, part)
+	e.Size += part.Size
+}
+
+func (t *datasetTree) addEntry(e *treeEntry) {
+	if old, ok := t.entries[e.Path]; ok && old.IsDir && e.IsDir {
+		return
+	}
+	t.entries[e.Path] = e
+	// make sure the parent directories are listed
+	for dir := pa.Dir(e.Path); dir != "." && dir != "/"; dir = pa.Dir(dir) {
+		if _, ok := t.entries[dir]; ok {
+			break
+		}
+		t.entries[dir] = &treeEntry{Path: dir, IsDir: true}
+	}
+}
+
+// partIndexOf parses the index from the part suffix of a link path
+func partIndexOf(linkPath string) int {
+	i, err := strconv.Atoi(linkPath[len(linkPath)-8:])
+	if err != nil {
+		return -1
+	}
+	return i
+}
+
+// checkParts makes sure no part of a split file is missing. The parts after
+// the last one found are only known to be missing from the file size in the
+// file index.
+func checkParts(e *treeEntry) error {
+	if len(e.Parts) <= 1 && (len(e.Parts) == 0 || e.Parts[0].Index < 0) {
+		return nil
+	}
+	for i, p := range e.Parts {
+		if p.Index != i {
+			return xerrors.Errorf("part %d of %s is missing", i, e.Path)
+		}
+	}
+	if e.FileSize >= 0 && e.Size != e.FileSize {
+		return xerrors.Errorf("parts of %s after part %d are missing, they hold %d of its %d bytes", e.Path, len(e.Parts)-1, e.Size, e.FileSize)
+	}
+	return nil
+}
+
+// Paths returns the paths of all entries in lexical order
+func (t *datasetTree) Paths() []string {
+	paths := make([]string, 0, len(t.entries))
+	for p := range t.entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Open returns the content of a file, reading its parts one after another
+func (t *datasetTree) Open(ctx context.Context, e *treeEntry) io.ReadCloser {
+	return &partsReader{ctx: ctx, parts: e.Parts}
+}
+
+func (t *datasetTree) Close() error {
+	return t.cars.Close()
+}
+
+// partsReader concatenates the parts of a file, opening each when reached
+type partsReader struct {
+	ctx   context.Context
+	parts []treePart
+	cur   files.File
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			f, err := openPart(r.ctx, r.parts[0])
+			if err != nil {
+				return 0, err
+			}
+			r.parts = r.parts[1:]
+			r.cur = f
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+// openPart opens the content of a file, or a part of it
+func openPart(ctx context.Context, part treePart) (files.File, error) {
+	nd, err := part.dag.Get(ctx, part.Cid)
+	if err != nil {
+		return nil, err
+	}
+	fnd, err := unixfile.NewUnixfsFile(ctx, part.dag, nd)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := fnd.(files.File)
+	if !ok {
+		return nil, xerrors.Errorf("%s is not a file", part.Cid)
+	}
+	return f, nil
+}
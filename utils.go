@@ -5,10 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"os"
 	"path"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -126,31 +127,133 @@ func (b *FSBuilder) getNodeByLink(ln *format.Link) (fn fsNode, err error) {
 }
 
 func BuildIpldGraph(ctx context.Context, fileList []Finfo, graphName, parentPath, carDir string, parallel int, cb GraphBuildCallback) {
-	node, fsDetail, err := buildIpldGraph(ctx, fileList, parentPath, carDir, parallel)
+	buildGraph(ctx, nil, fileList, graphName, parentPath, carDir, parallel, cb, &chunkOptions{})
+}
+
+// buildGraph builds the slice of the files of fileList, read from fsys, or
+// from the paths of the OS if fsys is nil
+func buildGraph(ctx context.Context, fsys fs.FS, fileList []Finfo, graphName, parentPath, carDir string, parallel int, cb GraphBuildCallback, o *chunkOptions) {
+	node, fsDetail, entries, err := buildIpldGraph(ctx, fsys, fileList, parentPath, carDir, parallel, o)
 	if err != nil {
 		//log.Fatal(err)
 		cb.OnError(err)
 		return
 	}
+	finishGraph(node, fsDetail, entries, graphName, carDir, cb, o)
+}
+
+// finishGraph records a slice whose CAR file is written in the file index
+// and checksum files, and hands it to cb
+func finishGraph(node ipld.Node, fsDetail string, entries []FileIndexEntry, graphName, carDir string, cb GraphBuildCallback, o *chunkOptions) {
+	if o.saveIndex {
+		for i := range entries {
+			entries[i].PayloadCid = node.Cid().String()
+			entries[i].GraphName = graphName
+		}
+		if err := appendFileIndex(o.output(carDir), entries); err != nil {
+			cb.OnError(err)
+			return
+		}
+		if err := appendChecksumFiles(o.output(carDir), o.checksums, entries); err != nil {
+			cb.OnError(err)
+			return
+		}
+	}
 	cb.OnSuccess(node, graphName, fsDetail)
 }
 
-func buildIpldGraph(ctx context.Context, fileList []Finfo, parentPath, carDir string, parallel int) (ipld.Node, string, error) {
-	bs2 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
-	dagServ := merkledag.NewDAGService(blockservice.New(bs2, offline.Exchange(bs2)))
+// graphBuilder keeps the file nodes of a slice in memory until its directory
+// tree and CAR file are built
+type graphBuilder struct {
+	bs         bstore.Blockstore
+	dagServ    ipld.DAGService
+	cidBuilder cid.Builder
+	fileList   []Finfo
+	entries    []FileIndexEntry
+	lock       sync.Mutex
+	fileNodes  map[string]*dag.ProtoNode
+}
 
+func newGraphBuilder(fileList []Finfo, o *chunkOptions) (*graphBuilder, error) {
+	bs2 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	var cidBuilder cid.Builder
 	cidBuilder, err := merkledag.PrefixForCidVersion(1)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	fileNodeMap := make(map[string]*dag.ProtoNode)
-	dirNodeMap := make(map[string]*dag.ProtoNode)
+	if o.sparse {
+		if cidBuilder, err = newZeroLeafBuilder(cidBuilder); err != nil {
+			return nil, err
+		}
+	}
+	return &graphBuilder{
+		bs:         bs2,
+		dagServ:    merkledag.NewDAGService(blockservice.New(bs2, offline.Exchange(bs2))),
+		cidBuilder: cidBuilder,
+		fileList:   fileList,
+		entries:    make([]FileIndexEntry, len(fileList)),
+		fileNodes:  make(map[string]*dag.ProtoNode),
+	}, nil
+}
 
-	var rootNode *dag.ProtoNode
-	rootNode = unixfs.EmptyDirNode()
-	rootNode.SetCidBuilder(cidBuilder)
-	var rootKey = "root"
-	dirNodeMap[rootKey] = rootNode
+// drop leaves the files of skipped out of the slice
+func (gb *graphBuilder) drop(skipped map[int]bool) {
+	if len(skipped) == 0 {
+		return
+	}
+	fileList := make([]Finfo, 0, len(gb.fileList)-len(skipped))
+	entries := make([]FileIndexEntry, 0, len(gb.fileList)-len(skipped))
+	for i, item := range gb.fileList {
+		if skipped[i] {
+			delete(gb.fileNodes, item.Path)
+			continue
+		}
+		fileList = append(fileList, item)
+		entries = append(entries, gb.entries[i])
+	}
+	gb.fileList, gb.entries = fileList, entries
+}
+
+// addFile chunks the i-th file of the slice from r, which reads its bytes
+// from SeekStart to SeekEnd
+func (gb *graphBuilder) addFile(i int, r io.Reader, parentPath string, o *chunkOptions) error {
+	item := gb.fileList[i]
+	var rangeHash *multiHash
+	if o.hashes != nil {
+		w, h, err := o.hashes.writerFor(item)
+		if err != nil {
+			return err
+		}
+		r, rangeHash = io.TeeReader(r, w), h
+	}
+	fileNode, err := layoutFile(r, gb.dagServ, gb.cidBuilder)
+	if err != nil {
+		return err
+	}
+	entry := newFileIndexEntry(item, path.Join(append(graphDirList(parentPath, item.Path), item.Info.Name())...))
+	entry.Cid = fileNode.Cid().String()
+	if rangeHash != nil {
+		entry.Checksums = rangeHash.Sums()
+		entry.FileChecksums = o.hashes.fileSums(item, entry.Checksums)
+	}
+	gb.entries[i] = entry
+	fn, ok := fileNode.(*dag.ProtoNode)
+	if !ok {
+		return xerrors.Errorf("file node should be *dag.ProtoNode")
+	}
+	gb.lock.Lock()
+	gb.fileNodes[item.Path] = fn
+	gb.lock.Unlock()
+	fmt.Println(item.Path)
+	log.Infof("file node: %s", fileNode)
+	return nil
+}
+
+func buildIpldGraph(ctx context.Context, fsys fs.FS, fileList []Finfo, parentPath, carDir string, parallel int, o *chunkOptions) (ipld.Node, string, []FileIndexEntry, error) {
+	gb, err := newGraphBuilder(fileList, o)
+	if err != nil {
+		return nil, "", nil, err
+	}
 
 	fmt.Println("************ start to build ipld **************")
 	// build file node
@@ -161,7 +264,9 @@ func buildIpldGraph(ctx context.Context, fileList []Finfo, parentPath, carDir st
 	}
 	pchan := make(chan struct{}, parallel)
 	wg := sync.WaitGroup{}
-	lock := sync.Mutex{}
+	var lock sync.Mutex
+	var firstErr error
+	skipped := make(map[int]bool)
 	for i, item := range fileList {
 		wg.Add(1)
 		go func(i int, item Finfo) {
@@ -170,48 +275,52 @@ func buildIpldGraph(ctx context.Context, fileList []Finfo, parentPath, carDir st
 				wg.Done()
 			}()
 			pchan <- struct{}{}
-			fileNode, err := BuildFileNode(item, dagServ, cidBuilder)
-			if err != nil {
-				log.Warn(err)
-				return
+			kept, err := o.readFile(fsys, item, func(r io.Reader) error {
+				return gb.addFile(i, r, parentPath, o)
+			})
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
 			}
-			fn, ok := fileNode.(*dag.ProtoNode)
-			if !ok {
-				emsg := "file node should be *dag.ProtoNode"
-				log.Warn(emsg)
-				return
+			if err == nil && !kept {
+				skipped[i] = true
 			}
-			lock.Lock()
-			fileNodeMap[item.Path] = fn
-			lock.Unlock()
-			fmt.Println(item.Path)
-			log.Infof("file node: %s", fileNode)
 		}(i, item)
 	}
 	wg.Wait()
+	if firstErr != nil {
+		return nil, "", nil, firstErr
+	}
+	gb.drop(skipped)
 
+	node, fsDetail, err := gb.build(ctx, parentPath, o.output(carDir))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return node, fsDetail, gb.entries, nil
+}
+
+// build links the file nodes into their directory tree, and writes the CAR
+// file of the slice to sink
+func (gb *graphBuilder) build(ctx context.Context, parentPath string, sink Sink) (ipld.Node, string, error) {
+	cidBuilder := gb.cidBuilder
+	dagServ := gb.dagServ
+	fileNodeMap := gb.fileNodes
+	dirNodeMap := make(map[string]*dag.ProtoNode)
+
+	var rootNode *dag.ProtoNode
+	rootNode = unixfs.EmptyDirNode()
+	rootNode.SetCidBuilder(cidBuilder)
+	var rootKey = "root"
+	dirNodeMap[rootKey] = rootNode
+
+	var err error
 	// build dir tree
-	for _, item := range fileList {
+	for _, item := range gb.fileList {
 		// log.Info(item.Path)
 		// log.Infof("file name: %s, file size: %d, item size: %d, seek-start:%d, seek-end:%d", item.Name, item.Info.Size(), item.SeekEnd-item.SeekStart, item.SeekStart, item.SeekEnd)
-		dirStr := path.Dir(item.Path)
-		parentPath = path.Clean(parentPath)
-		// when parent path equal target path, and the parent path is also a file path
-		if parentPath == path.Clean(item.Path) {
-			dirStr = ""
-		} else if parentPath != "" && strings.HasPrefix(dirStr, parentPath) {
-			dirStr = dirStr[len(parentPath):]
-		}
-
-		if strings.HasPrefix(dirStr, "/") {
-			dirStr = dirStr[1:]
-		}
-		var dirList []string
-		if dirStr == "" {
-			dirList = []string{}
-		} else {
-			dirList = strings.Split(dirStr, "/")
-		}
+		dirList := graphDirList(parentPath, item.Path)
 		fileNode, ok := fileNodeMap[item.Path]
 		if !ok {
 			panic("unexpected, missing file node")
@@ -267,10 +376,17 @@ func buildIpldGraph(ctx context.Context, fileList []Finfo, parentPath, carDir st
 		}
 	}
 
-	for _, node := range dirNodeMap {
-		//fmt.Printf("add node to store: %v\n", node)
-		//fmt.Printf("key: %s, links: %v\n", key, len(node.Links()))
-		dagServ.Add(ctx, node)
+	// in the order of their keys, so that nothing depends on the order of
+	// the map
+	dirKeys := make([]string, 0, len(dirNodeMap))
+	for key := range dirNodeMap {
+		dirKeys = append(dirKeys, key)
+	}
+	sort.Strings(dirKeys)
+	for _, key := range dirKeys {
+		if err := dagServ.Add(ctx, dirNodeMap[key]); err != nil {
+			return nil, "", err
+		}
 	}
 
 	rootNode = dirNodeMap[rootKey]
@@ -278,17 +394,7 @@ func buildIpldGraph(ctx context.Context, fileList []Finfo, parentPath, carDir st
 	log.Infof("start to generate car for %s", rootNode.Cid())
 	genCarStartTime := time.Now()
 	//car
-	carF, err := os.Create(path.Join(carDir, rootNode.Cid().String()+".car"))
-	if err != nil {
-		return nil, "", err
-	}
-	defer carF.Close()
-	selector := allSelector()
-	sc := car.NewSelectiveCar(ctx, bs2, []car.Dag{{Root: rootNode.Cid(), Selector: selector}})
-	err = sc.Write(carF)
-	// cario := cario.NewCarIO()
-	// err = cario.WriteCar(context.Background(), bs2, rootNode.Cid(), selector, carF)
-	if err != nil {
+	if err := writeCar(ctx, gb.bs, rootNode.Cid(), sink); err != nil {
 		return nil, "", err
 	}
 	log.Infof("generate car file completed, time elapsed: %s", time.Now().Sub(genCarStartTime))
@@ -307,11 +413,74 @@ func buildIpldGraph(ctx context.Context, fileList []Finfo, parentPath, carDir st
 	return rootNode, fmt.Sprintf("%s", fsNodeBytes), nil
 }
 
+// writeCar writes the CAR file of the dag of root in bs to sink, named after
+// root
+func writeCar(ctx context.Context, bs bstore.Blockstore, root cid.Cid, sink Sink) error {
+	sc := car.NewSelectiveCar(ctx, bs, []car.Dag{{Root: root, Selector: allSelector()}})
+	scp, err := sc.Prepare()
+	if err != nil {
+		return err
+	}
+	w, err := sink.Create(root.String()+".car", int64(scp.Size()))
+	if err != nil {
+		return err
+	}
+	if err := scp.Dump(ctx, w); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
 func allSelector() ipldprime.Node {
 	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	return allSelectorSpec(ssb).Node()
+}
+
+func allSelectorSpec(ssb builder.SelectorSpecBuilder) builder.SelectorSpec {
 	return ssb.ExploreRecursive(selector.RecursionLimitNone(),
-		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).
-		Node()
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge()))
+}
+
+// pathSelector follows the links at indexes through dag-pb nodes, and then
+// selects everything below
+func pathSelector(indexes []int64) ipldprime.Node {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	spec := allSelectorSpec(ssb)
+	for i := len(indexes) - 1; i >= 0; i-- {
+		next := spec
+		hash := ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("Hash", next)
+		})
+		link := ssb.ExploreIndex(indexes[i], hash)
+		spec = ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("Links", link)
+		})
+	}
+	return spec.Node()
+}
+
+// graphDirList returns the directories from the graph root down to the file
+// at itemPath, which is placed relative to parentPath
+func graphDirList(parentPath, itemPath string) []string {
+	dirStr := path.Dir(itemPath)
+	parentPath = path.Clean(parentPath)
+	// when parent path equal target path, and the parent path is also a file path
+	if parentPath == path.Clean(itemPath) {
+		dirStr = ""
+	} else if dirStr == parentPath || (parentPath != "" && strings.HasPrefix(dirStr, strings.TrimSuffix(parentPath, "/")+"/")) {
+		// not a directory whose name starts with the parent path, such as
+		// .git under .
+		dirStr = dirStr[len(parentPath):]
+	}
+
+	if strings.HasPrefix(dirStr, "/") {
+		dirStr = dirStr[1:]
+	}
+	if dirStr == "" {
+		return []string{}
+	}
+	return strings.Split(dirStr, "/")
 }
 
 func getDirKey(dirList []string, i int) (key string) {
@@ -384,23 +553,43 @@ func (fs *fileSlice) Read(p []byte) (n int, err error) {
 }
 
 func BuildFileNode(item Finfo, bufDs ipld.DAGService, cidBuilder cid.Builder) (node ipld.Node, err error) {
-	var r io.Reader
-	f, err := os.Open(item.Path)
+	return buildFileNode(item, bufDs, cidBuilder, nil)
+}
+
+// buildFileNode is BuildFileNode that also copies the bytes it reads to w
+func buildFileNode(item Finfo, bufDs ipld.DAGService, cidBuilder cid.Builder, w io.Writer) (node ipld.Node, err error) {
+	r, f, err := openFinfo(item)
 	if err != nil {
 		return nil, err
 	}
-	r = f
+	defer f.Close()
+	if w != nil {
+		r = io.TeeReader(r, w)
+	}
+	return layoutFile(r, bufDs, cidBuilder)
+}
 
+// openFinfo opens the file of item, reading its bytes from SeekStart to
+// SeekEnd
+func openFinfo(item Finfo) (io.Reader, *os.File, error) {
+	f, err := os.Open(item.Path)
+	if err != nil {
+		return nil, nil, err
+	}
 	// read all data of item
 	if item.SeekStart > 0 || item.SeekEnd > 0 {
-		r = &fileSlice{
+		return &fileSlice{
 			r:        f,
 			start:    item.SeekStart,
 			end:      item.SeekEnd,
 			fileSize: item.Info.Size(),
-		}
+		}, f, nil
 	}
+	return f, f, nil
+}
 
+// layoutFile chunks the content read from r into a UnixFS file DAG
+func layoutFile(r io.Reader, bufDs ipld.DAGService, cidBuilder cid.Builder) (node ipld.Node, err error) {
 	params := ihelper.DagBuilderParams{
 		Maxlinks:   UnixfsLinksPerLevel,
 		RawLeaves:  false,
@@ -426,6 +615,8 @@ func GenGraphName(graphName string, sliceCount, sliceTotal int) string {
 	return fmt.Sprintf("%s-total-%d-part-%d.car", graphName, sliceTotal, sliceCount+1)
 }
 
+// GetGraphCount gives the number of slices of sliceSize the files of
+// GetFileList fill
 func GetGraphCount(args []string, sliceSize int64) int {
 	list, err := GetFileList(args)
 	if err != nil {
@@ -446,85 +637,64 @@ func GetGraphCount(args []string, sliceSize int64) int {
 	return int(count)
 }
 
+// GetFileListAsync sends the files under the paths of args, as GetFileList
+// lists them, stopping at the first error, which is logged
 func GetFileListAsync(args []string) chan Finfo {
 	fichan := make(chan Finfo, 0)
 	go func() {
 		defer close(fichan)
 		for _, path := range args {
-			finfo, err := os.Stat(path)
-			if err != nil {
+			if err := WalkLocalFiles(path, FileFilter{}, func(item Finfo) error {
+				fichan <- item
+				return nil
+			}); err != nil {
 				log.Warn(err)
 				return
 			}
-			// 忽略隐藏目录
-			if strings.HasPrefix(finfo.Name(), ".") {
-				continue
-			}
-			if finfo.IsDir() {
-				files, err := ioutil.ReadDir(path)
-				if err != nil {
-					log.Warn(err)
-					return
-				}
-				templist := make([]string, 0)
-				for _, n := range files {
-					templist = append(templist, fmt.Sprintf("%s/%s", path, n.Name()))
-				}
-				embededChan := GetFileListAsync(templist)
-				if err != nil {
-					log.Warn(err)
-					return
-				}
-
-				for item := range embededChan {
-					fichan <- item
-				}
-			} else {
-				fichan <- Finfo{
-					Path: path,
-					Name: finfo.Name(),
-					Info: finfo,
-				}
-			}
 		}
 	}()
 
 	return fichan
 }
 
+// GetFileList lists the files under the paths of args selected by the
+// default filter, which skips hidden files and directories
 func GetFileList(args []string) (fileList []string, err error) {
 	fileList = make([]string, 0)
 	for _, path := range args {
-		finfo, err := os.Stat(path)
-		if err != nil {
+		if err := WalkLocalFiles(path, FileFilter{}, func(item Finfo) error {
+			fileList = append(fileList, item.Path)
+			return nil
+		}); err != nil {
 			return nil, err
 		}
-		// 忽略隐藏目录
-		if strings.HasPrefix(finfo.Name(), ".") {
-			continue
-		}
-		if finfo.IsDir() {
-			files, err := ioutil.ReadDir(path)
-			if err != nil {
-				return nil, err
-			}
-			templist := make([]string, 0)
-			for _, n := range files {
-				templist = append(templist, fmt.Sprintf("%s/%s", path, n.Name()))
-			}
-			list, err := GetFileList(templist)
-			if err != nil {
-				return nil, err
-			}
-			fileList = append(fileList, list...)
-		} else {
-			fileList = append(fileList, path)
-		}
 	}
 
 	return
 }
 
+// WalkLocalFiles calls fn with the files under targetPath on the OS selected
+// by filter, in path order, as Chunk walks them. Their paths are targetPath
+// joined with their paths under it by a slash.
+func WalkLocalFiles(targetPath string, filter FileFilter, fn func(Finfo) error) error {
+	ff, err := newFileFilter(filter)
+	if err != nil {
+		return err
+	}
+	fsys, root, err := LocalSource(targetPath, targetPath)
+	if err != nil {
+		return err
+	}
+	return walkFiles(fsys, root, DefaultWalkers, ff, nil, func(item Finfo) error {
+		if root == "." {
+			item.Path = targetPath + "/" + item.Path
+		} else {
+			item.Path = targetPath
+		}
+		return fn(item)
+	})
+}
+
 // piece info
 type PieceInfo struct {
 	PayloadCid string `csv:"payload_cid"`
@@ -535,6 +705,10 @@ type PieceInfo struct {
 
 // manifest
 type Manifest struct {
-	PayloadCid string `csv:"payload_cid"`
-	Filename   string `csv:"filename"`
+	PayloadCid  string `csv:"payload_cid"`
+	Filename    string `csv:"filename"`
+	PieceCid    string `csv:"piece_cid"`
+	PayloadSize int64  `csv:"payload_size"`
+	PieceSize   uint64 `csv:"piece_size"`
+	Detail      string `csv:"detail"`
 }
@@ -0,0 +1,290 @@
+package graphsplit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car"
+	"golang.org/x/xerrors"
+)
+
+// SliceReport is the result of verifying one graph slice
+type SliceReport struct {
+	CarPath    string
+	PayloadCid string
+	Filename   string
+	Blocks     int
+	Errors     []string
+}
+
+func (r *SliceReport) Passed() bool {
+	return len(r.Errors) == 0
+}
+
+func (r *SliceReport) addError(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// Verify checks the CAR files in carDir. Every CAR must parse, every block
+// must match its cid and the root must be fully reachable, and every slice
+// in the manifest must have its CAR file. If calcCommP is
+// set, the piece cid and size are recomputed and compared to the manifest.
+// If sourceRoot is not empty, the source files recorded in the file index are
+// read again from it and their cids are compared to the index.
+func Verify(ctx context.Context, carDir, sourceRoot string, calcCommP bool, parallel int) ([]*SliceReport, error) {
+	if parallel <= 0 {
+		return nil, xerrors.Errorf("Unexpected! Parallel has to be greater than 0")
+	}
+	manifests, err := ReadManifest(filepath.Join(carDir, ManifestName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	manifestByPayload := make(map[string]Manifest)
+	for _, m := range manifests {
+		manifestByPayload[m.PayloadCid] = m
+	}
+	var entriesByPayload map[string][]FileIndexEntry
+	if sourceRoot != "" {
+		entries, err := ReadFileIndex(filepath.Join(carDir, FileIndexName))
+		if err != nil {
+			return nil, xerrors.Errorf("source verification needs the file index: %w", err)
+		}
+		entriesByPayload = make(map[string][]FileIndexEntry)
+		for _, entry := range entries {
+			entriesByPayload[entry.PayloadCid] = append(entriesByPayload[entry.PayloadCid], entry)
+		}
+	}
+
+	carPaths, err := listCarFiles(carDir)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]*SliceReport, len(carPaths))
+	limitCh := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for i, carPath := range carPaths {
+		wg.Add(1)
+		limitCh <- struct{}{}
+		go func(i int, carPath string) {
+			defer func() {
+				<-limitCh
+				wg.Done()
+			}()
+			log.Infof("verify %s", carPath)
+			report := &SliceReport{CarPath: carPath}
+			reports[i] = report
+
+			root, blocks, err := VerifyCar(carPath)
+			report.Blocks = blocks
+			if err != nil {
+				// the slice of a broken CAR file is not reported missing
+				report.PayloadCid = payloadCidOf(carPath, manifests)
+				if m, ok := manifestByPayload[report.PayloadCid]; ok {
+					report.Filename = m.Filename
+				}
+				report.addError("car: %s", err)
+				return
+			}
+			report.PayloadCid = root.String()
+			m, ok := manifestByPayload[report.PayloadCid]
+			if ok {
+				report.Filename = m.Filename
+			}
+
+			if calcCommP {
+				switch {
+				case !ok || m.PieceCid == "":
+					report.addError("commp: no piece cid of %s in manifest", report.PayloadCid)
+				default:
+					cpRes, err := CalcCommP(ctx, carPath, false, false)
+					if err != nil {
+						report.addError("commp: %s", err)
+					} else if cpRes.Root.String() != m.PieceCid || uint64(cpRes.Size) != m.PieceSize {
+						report.addError("commp: got %s (%d), manifest has %s (%d)", cpRes.Root, cpRes.Size, m.PieceCid, m.PieceSize)
+					}
+				}
+			}
+
+			if sourceRoot != "" {
+				entries, ok := entriesByPayload[report.PayloadCid]
+				if !ok {
+					report.addError("source: no entries of %s in file index", report.PayloadCid)
+				}
+				for _, entry := range entries {
+					if err := verifySourceEntry(sourceRoot, entry); err != nil {
+						report.addError("source: %s", err)
+					}
+				}
+			}
+		}(i, carPath)
+	}
+	wg.Wait()
+
+	found := make(map[string]bool)
+	for _, r := range reports {
+		found[r.PayloadCid] = true
+	}
+	for _, m := range manifests {
+		if found[m.PayloadCid] {
+			continue
+		}
+		found[m.PayloadCid] = true
+		report := &SliceReport{PayloadCid: m.PayloadCid, Filename: m.Filename}
+		report.addError("car: no CAR file of the slice in %s", carDir)
+		reports = append(reports, report)
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Filename != reports[j].Filename {
+			return reports[i].Filename < reports[j].Filename
+		}
+		return reports[i].CarPath < reports[j].CarPath
+	})
+	return reports, nil
+}
+
+// VerifyCar reads the CAR file at carPath, checks every block against its
+// cid and that the whole DAG under the root is present. It returns the root
+// and the number of blocks.
+func VerifyCar(carPath string) (cid.Cid, int, error) {
+	f, err := os.Open(carPath)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	defer f.Close()
+
+	// NewCarReader checks the hash of every block it returns
+	pr := newCarPayloadReader(f)
+	cr, err := car.NewCarReader(pr)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	if len(cr.Header.Roots) != 1 {
+		return cid.Undef, 0, xerrors.Errorf("expect one root, got %d", len(cr.Header.Roots))
+	}
+	links := make(map[cid.Cid][]cid.Cid)
+	blocks := 0
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cid.Undef, blocks, xerrors.Errorf("block %d: %w", blocks, err)
+		}
+		blocks++
+		nd, err := ipld.Decode(blk)
+		if err != nil {
+			return cid.Undef, blocks, xerrors.Errorf("decode %s: %w", blk.Cid(), err)
+		}
+		lks := make([]cid.Cid, 0, len(nd.Links()))
+		for _, lk := range nd.Links() {
+			lks = append(lks, lk.Cid)
+		}
+		links[blk.Cid()] = lks
+	}
+	if _, err := pr.checkPadding(); err != nil {
+		return cid.Undef, blocks, err
+	}
+
+	root := cr.Header.Roots[0]
+	seen := cid.NewSet()
+	queue := []cid.Cid{root}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if !seen.Visit(c) {
+			continue
+		}
+		lks, ok := links[c]
+		if !ok {
+			return root, blocks, xerrors.Errorf("block %s is not reachable from root %s", c, root)
+		}
+		queue = append(queue, lks...)
+	}
+	return root, blocks, nil
+}
+
+// verifySourceEntry reads the byte range of entry from the source again and
+// compares the cid, and the checksums if there are any, to the file index
+func verifySourceEntry(sourceRoot string, entry FileIndexEntry) error {
+	srcPath := filepath.Join(sourceRoot, filepath.FromSlash(entry.Path))
+	finfo, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if finfo.Size() != entry.FileSize {
+		return xerrors.Errorf("size of %s changed, expected %d, got %d", entry.Path, entry.FileSize, finfo.Size())
+	}
+	item := Finfo{
+		Path: srcPath,
+		Name: entry.Name,
+		Info: finfo,
+	}
+	if entry.IsPart() {
+		item.SeekStart = entry.Offset
+		item.SeekEnd = entry.Offset + entry.Size - 1
+	}
+	var rangeHash *multiHash
+	var w io.Writer
+	if len(entry.Checksums) > 0 {
+		algos := make([]string, 0, len(entry.Checksums))
+		for algo := range entry.Checksums {
+			algos = append(algos, algo)
+		}
+		if rangeHash, err = newMultiHash(algos); err != nil {
+			return err
+		}
+		w = rangeHash
+	}
+	cidBuilder, err := merkledag.PrefixForCidVersion(1)
+	if err != nil {
+		return err
+	}
+	nd, err := buildFileNode(item, discardDAGService{}, cidBuilder, w)
+	if err != nil {
+		return err
+	}
+	if nd.Cid().String() != entry.Cid {
+		return xerrors.Errorf("cid of %s changed, expected %s, got %s", entry.Name, entry.Cid, nd.Cid())
+	}
+	if rangeHash != nil {
+		for algo, sum := range rangeHash.Sums() {
+			if sum != entry.Checksums[algo] {
+				return xerrors.Errorf("%s checksum of %s changed, expected %s, got %s", algo, entry.Name, entry.Checksums[algo], sum)
+			}
+		}
+	}
+	return nil
+}
+
+// discardDAGService drops every node added to it, it is used to compute the
+// cid of a file without keeping its blocks
+type discardDAGService struct{}
+
+func (discardDAGService) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	return nil, ipld.ErrNotFound{Cid: c}
+}
+
+func (discardDAGService) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	ch := make(chan *ipld.NodeOption, len(cids))
+	for _, c := range cids {
+		ch <- &ipld.NodeOption{Err: ipld.ErrNotFound{Cid: c}}
+	}
+	close(ch)
+	return ch
+}
+
+func (discardDAGService) Add(context.Context, ipld.Node) error        { return nil }
+func (discardDAGService) AddMany(context.Context, []ipld.Node) error  { return nil }
+func (discardDAGService) Remove(context.Context, cid.Cid) error       { return nil }
+func (discardDAGService) RemoveMany(context.Context, []cid.Cid) error { return nil }
@@ -0,0 +1,129 @@
+package graphsplit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test_verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	carDir := filepath.Join(dir, "cars")
+	for _, d := range []string{src, carDir} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 300000)
+		if err := ioutil.WriteFile(filepath.Join(src, fmt.Sprintf("f%d.bin", i)), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	if err := Chunk(ctx, 300000, src, src, carDir, "test", 1, CSVCallback(carDir), WithFileIndex()); err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := ReadManifest(filepath.Join(carDir, ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 3 {
+		t.Fatalf("expect 3 slices, got %d", len(manifests))
+	}
+	reports, err := Verify(ctx, carDir, src, false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 3 {
+		t.Fatalf("expect 3 reports, got %d", len(reports))
+	}
+	for _, r := range reports {
+		if !r.Passed() || r.Blocks == 0 {
+			t.Fatalf("expect %s to pass, got %v", r.Filename, r.Errors)
+		}
+	}
+
+	carPath := func(i int) string {
+		return filepath.Join(carDir, manifests[i].PayloadCid+".car")
+	}
+	// the first CAR file truncated
+	data, err := ioutil.ReadFile(carPath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(carPath(0), data[:len(data)-1000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the second missing its last block
+	data, err = ioutil.ReadFile(carPath(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr, err := car.NewCarReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := car.WriteHeader(cr.Header, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var last []byte
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(last)
+		var section bytes.Buffer
+		if err := util.LdWrite(&section, blk.Cid().Bytes(), blk.RawData()); err != nil {
+			t.Fatal(err)
+		}
+		last = section.Bytes()
+	}
+	if err := ioutil.WriteFile(carPath(1), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the third deleted
+	if err := os.Remove(carPath(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err = Verify(ctx, carDir, "", false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 3 {
+		t.Fatalf("expect 3 reports, got %d", len(reports))
+	}
+	for i, expect := range []string{"unexpected EOF", "is not reachable", "no CAR file"} {
+		r := reports[i]
+		if r.Filename != manifests[i].Filename || r.PayloadCid != manifests[i].PayloadCid {
+			t.Fatalf("expect the report of %s, got %s", manifests[i].Filename, r.Filename)
+		}
+		if r.Passed() || !strings.Contains(strings.Join(r.Errors, "\n"), expect) {
+			t.Fatalf("expect %s to fail with %q, got %v", r.Filename, expect, r.Errors)
+		}
+	}
+	if reports[2].CarPath != "" {
+		t.Fatalf("expect no CAR file for %s, got %s", reports[2].Filename, reports[2].CarPath)
+	}
+}